@@ -0,0 +1,173 @@
+// Writes one record per request to a dedicated access log, separate from the application log.
+package accesslog
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/abswn/revproxy-go/internal/acl"
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/forward"
+	"github.com/abswn/revproxy-go/internal/requestid"
+)
+
+// Record holds the fields written for a request.
+type Record struct {
+	Time            time.Time
+	ClientIP        string
+	Method          string
+	Path            string
+	Proto           string
+	Endpoint        string
+	Backend         string
+	Status          int
+	Bytes           int64
+	UpstreamLatency time.Duration
+	Latency         time.Duration
+	Retries         int
+	Banned          bool
+	RequestID       string
+	ClientCert      string // identity of the verified client certificate
+	Referer         string
+	UserAgent       string
+}
+
+// Logger writes access records in the configured format.
+type Logger struct {
+	format  string
+	proxies *acl.TrustedProxies
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// New creates a Logger writing to cfg.Output, rotated by lumberjack unless it is stdout.
+func New(cfg config.AccessLogConfig, proxies *acl.TrustedProxies) (*Logger, error) {
+	if cfg.Output == "stdout" || cfg.Output == "" {
+		return newLogger(os.Stdout, cfg.Format, proxies), nil
+	}
+	// Create log directory if it doesn't exist
+	logDir := filepath.Dir(cfg.Output)
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create access log directory %s: %v", logDir, err)
+	}
+	out := &lumberjack.Logger{
+		Filename:   cfg.Output,
+		MaxSize:    cfg.MaxSize,
+		MaxBackups: cfg.MaxBackups,
+		MaxAge:     cfg.MaxAge,
+		Compress:   cfg.Compress == nil || *cfg.Compress,
+	}
+	if out.MaxSize <= 0 {
+		out.MaxSize = 100 // megabytes
+	}
+	if out.MaxBackups <= 0 {
+		out.MaxBackups = 5
+	}
+	if out.MaxAge <= 0 {
+		out.MaxAge = 30 // days
+	}
+	return newLogger(out, cfg.Format, proxies), nil
+}
+
+func newLogger(out io.Writer, format string, proxies *acl.TrustedProxies) *Logger {
+	if format == "" {
+		format = "json"
+	}
+	return &Logger{format: format, proxies: proxies, out: out}
+}
+
+// Middleware records every request passing through next, including the endpoint and backend
+// details that the endpoint handlers report through forward.Result.
+func (l *Logger) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx, res := forward.WithResult(r.Context())
+		rw := &responseWriter{ResponseWriter: w}
+		next(rw, r.WithContext(ctx))
+
+		rec := Record{
+			Time:            start,
+			Method:          r.Method,
+			Path:            r.URL.Path,
+			Proto:           r.Proto,
+			Endpoint:        res.Endpoint,
+			Backend:         res.Backend,
+			Status:          rw.status,
+			Bytes:           rw.bytes,
+			UpstreamLatency: res.UpstreamLatency,
+			Latency:         time.Since(start),
+			Retries:         res.Retries,
+			Banned:          res.Banned,
+			RequestID:       requestid.FromContext(r.Context()),
+			ClientCert:      res.ClientIdentity,
+			Referer:         r.Referer(),
+			UserAgent:       r.UserAgent(),
+		}
+		if ip := l.proxies.ClientIP(r); ip.IsValid() {
+			rec.ClientIP = ip.String()
+		}
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		l.Write(rec)
+	}
+}
+
+// Write formats rec and writes it as one line.
+func (l *Logger) Write(rec Record) {
+	var line []byte
+	switch l.format {
+	case "logfmt":
+		line = formatLogfmt(rec)
+	case "combined":
+		line = formatCombined(rec)
+	default:
+		line = formatJSON(rec)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+}
+
+// responseWriter captures the status code and body size sent to the client.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets streamed responses reach the client through the wrapper.
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,140 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/acl"
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/forward"
+	"github.com/abswn/revproxy-go/internal/requestid"
+)
+
+func sampleRecord() Record {
+	return Record{
+		Time:            time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		ClientIP:        "192.0.2.1",
+		Method:          http.MethodPost,
+		Path:            "/api/chat",
+		Proto:           "HTTP/1.1",
+		Endpoint:        "/api",
+		Backend:         "example.com/v1",
+		Status:          429,
+		Bytes:           17,
+		UpstreamLatency: 1500 * time.Microsecond,
+		Latency:         2 * time.Millisecond,
+		Banned:          true,
+		RequestID:       "abc",
+		UserAgent:       "curl/8.0",
+	}
+}
+
+func TestFormatJSON(t *testing.T) {
+	var got map[string]any
+	if err := json.Unmarshal(formatJSON(sampleRecord()), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"client_ip": "192.0.2.1", "method": "POST", "path": "/api/chat", "endpoint": "/api",
+		"backend": "example.com/v1", "status": 429.0, "bytes": 17.0, "upstream_latency_ms": 1.5,
+		"latency_ms": 2.0, "retries": 0.0, "banned": true, "request_id": "abc",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: got %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestFormatLogfmt(t *testing.T) {
+	rec := sampleRecord()
+	rec.Path = `/a b"c`
+	line := string(formatLogfmt(rec))
+	for _, want := range []string{
+		"time=2024-03-01T12:30:00Z ",
+		`path="/a b\"c"`,
+		"endpoint=/api ",
+		"status=429 ",
+		"upstream_latency_ms=1.5 ",
+		"banned=true ",
+		"request_id=abc\n",
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("expected %q in %q", want, line)
+		}
+	}
+}
+
+func TestFormatCombined(t *testing.T) {
+	line := string(formatCombined(sampleRecord()))
+	prefix := `192.0.2.1 - - [01/Mar/2024:12:30:00 +0000] "POST /api/chat HTTP/1.1" 429 17 "-" "curl/8.0" `
+	if !strings.HasPrefix(line, prefix) {
+		t.Errorf("expected combined prefix, got %q", line)
+	}
+	if !strings.Contains(line, `endpoint="/api" backend="example.com/v1"`) || !strings.Contains(line, "banned=true") {
+		t.Errorf("expected proxy fields, got %q", line)
+	}
+}
+
+func TestFormat_ClientCert(t *testing.T) {
+	rec := sampleRecord()
+	rec.ClientCert = "svc a"
+	if line := string(formatCombined(rec)); !strings.HasPrefix(line, `192.0.2.1 - "svc a" [`) {
+		t.Errorf("expected the identity as the combined user, got %q", line)
+	}
+	if line := string(formatLogfmt(rec)); !strings.HasSuffix(line, ` client_cert="svc a"`+"\n") {
+		t.Errorf("expected client_cert in %q", line)
+	}
+	var got map[string]any
+	json.Unmarshal(formatJSON(rec), &got)
+	if got["client_cert"] != "svc a" {
+		t.Errorf("expected client_cert in JSON, got %v", got)
+	}
+	if line := string(formatJSON(sampleRecord())); strings.Contains(line, "client_cert") {
+		t.Errorf("expected no client_cert without a certificate, got %q", line)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	proxies, _ := acl.NewTrustedProxies([]string{"10.0.0.0/8"})
+	l := newLogger(&out, "json", proxies)
+
+	cfg := config.RequestIDConfig{AcceptIncoming: true}
+	handler := requestid.Middleware(cfg, l.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		_, res := forward.WithResult(r.Context())
+		res.Endpoint = "/api"
+		res.Backend = "example.com"
+		res.Banned = true
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/api/x", nil)
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	r.Header.Set("X-Request-ID", "req-1")
+	handler(httptest.NewRecorder(), r)
+
+	var got map[string]any
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("expected one JSON record, got %q: %v", out.String(), err)
+	}
+	if got["client_ip"] != "198.51.100.7" || got["endpoint"] != "/api" || got["backend"] != "example.com" ||
+		got["status"] != 418.0 || got["bytes"] != 15.0 || got["banned"] != true || got["request_id"] != "req-1" {
+		t.Errorf("unexpected record: %v", got)
+	}
+}
+
+func TestMiddleware_DefaultStatus(t *testing.T) {
+	var out bytes.Buffer
+	l := newLogger(&out, "logfmt", nil)
+	l.Middleware(func(w http.ResponseWriter, r *http.Request) {})(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if !strings.Contains(out.String(), "status=200 ") || !strings.Contains(out.String(), `endpoint=""`) {
+		t.Errorf("unexpected record: %q", out.String())
+	}
+}
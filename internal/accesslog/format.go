@@ -0,0 +1,132 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// milliseconds returns d in milliseconds with microsecond precision.
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// formatJSON writes rec as a JSON object.
+func formatJSON(rec Record) []byte {
+	line, _ := json.Marshal(struct {
+		Time            string  `json:"time"`
+		ClientIP        string  `json:"client_ip"`
+		Method          string  `json:"method"`
+		Path            string  `json:"path"`
+		Endpoint        string  `json:"endpoint"`
+		Backend         string  `json:"backend"`
+		Status          int     `json:"status"`
+		Bytes           int64   `json:"bytes"`
+		UpstreamLatency float64 `json:"upstream_latency_ms"`
+		Latency         float64 `json:"latency_ms"`
+		Retries         int     `json:"retries"`
+		Banned          bool    `json:"banned"`
+		RequestID       string  `json:"request_id"`
+		ClientCert      string  `json:"client_cert,omitempty"`
+	}{
+		Time:            rec.Time.Format(time.RFC3339Nano),
+		ClientIP:        rec.ClientIP,
+		Method:          rec.Method,
+		Path:            rec.Path,
+		Endpoint:        rec.Endpoint,
+		Backend:         rec.Backend,
+		Status:          rec.Status,
+		Bytes:           rec.Bytes,
+		UpstreamLatency: milliseconds(rec.UpstreamLatency),
+		Latency:         milliseconds(rec.Latency),
+		Retries:         rec.Retries,
+		Banned:          rec.Banned,
+		RequestID:       rec.RequestID,
+		ClientCert:      rec.ClientCert,
+	})
+	return append(line, '\n')
+}
+
+// logfmtValue quotes v when it is empty or contains characters that would break key=value parsing.
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\\") || strings.IndexFunc(v, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0 {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// formatLogfmt writes rec as space separated key=value pairs.
+func formatLogfmt(rec Record) []byte {
+	var b strings.Builder
+	pairs := []struct{ key, value string }{
+		{"time", rec.Time.Format(time.RFC3339Nano)},
+		{"client_ip", logfmtValue(rec.ClientIP)},
+		{"method", logfmtValue(rec.Method)},
+		{"path", logfmtValue(rec.Path)},
+		{"endpoint", logfmtValue(rec.Endpoint)},
+		{"backend", logfmtValue(rec.Backend)},
+		{"status", strconv.Itoa(rec.Status)},
+		{"bytes", strconv.FormatInt(rec.Bytes, 10)},
+		{"upstream_latency_ms", strconv.FormatFloat(milliseconds(rec.UpstreamLatency), 'f', -1, 64)},
+		{"latency_ms", strconv.FormatFloat(milliseconds(rec.Latency), 'f', -1, 64)},
+		{"retries", strconv.Itoa(rec.Retries)},
+		{"banned", strconv.FormatBool(rec.Banned)},
+		{"request_id", logfmtValue(rec.RequestID)},
+	}
+	if rec.ClientCert != "" {
+		pairs = append(pairs, struct{ key, value string }{"client_cert", logfmtValue(rec.ClientCert)})
+	}
+	for i, p := range pairs {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(p.key)
+		b.WriteByte('=')
+		b.WriteString(p.value)
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+// dash returns "-" for empty fields of the combined format.
+func dash(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+// formatCombined writes rec in the Apache combined format, followed by the proxy specific fields
+// so that standard parsers still read the leading part. The client certificate identity takes the
+// place of the authenticated user.
+func formatCombined(rec Record) []byte {
+	size := "-"
+	if rec.Bytes > 0 {
+		size = strconv.FormatInt(rec.Bytes, 10)
+	}
+	requestLine := fmt.Sprintf("%s %s %s", rec.Method, rec.Path, rec.Proto)
+	user := "-"
+	if rec.ClientCert != "" {
+		user = logfmtValue(rec.ClientCert)
+	}
+	line := fmt.Sprintf("%s - %s [%s] %s %d %s %s %s endpoint=%s backend=%s upstream_latency_ms=%s latency_ms=%s retries=%d banned=%t request_id=%s\n",
+		dash(rec.ClientIP),
+		user,
+		rec.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(requestLine),
+		rec.Status,
+		size,
+		strconv.Quote(dash(rec.Referer)),
+		strconv.Quote(dash(rec.UserAgent)),
+		strconv.Quote(dash(rec.Endpoint)),
+		strconv.Quote(dash(rec.Backend)),
+		strconv.FormatFloat(milliseconds(rec.UpstreamLatency), 'f', -1, 64),
+		strconv.FormatFloat(milliseconds(rec.Latency), 'f', -1, 64),
+		rec.Retries,
+		rec.Banned,
+		strconv.Quote(dash(rec.RequestID)),
+	)
+	return []byte(line)
+}
@@ -0,0 +1,168 @@
+// CIDR based allow/deny lists with reloadable list files and trusted-proxy aware client IPs.
+package acl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/requestid"
+)
+
+// List is an allow/deny list. The prefix table is swapped atomically on reload.
+type List struct {
+	cfg    config.AccessControlConfig
+	status int
+	table  atomic.Pointer[table]
+
+	mu       sync.Mutex
+	modTimes map[string]time.Time
+}
+
+// New builds a List from the inline prefixes and list files in cfg.
+func New(cfg config.AccessControlConfig) (*List, error) {
+	l := &List{cfg: cfg, status: cfg.Status, modTimes: make(map[string]time.Time)}
+	if l.status == 0 {
+		l.status = http.StatusForbidden
+	}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Status returns the HTTP status sent to rejected clients.
+func (l *List) Status() int {
+	return l.status
+}
+
+// Allowed reports whether ip is permitted. The longest matching prefix decides; when nothing
+// matches, ip is allowed unless the list contains allow entries.
+func (l *List) Allowed(ip netip.Addr) bool {
+	t := l.table.Load()
+	matched, deny := t.lookup(ip)
+	if matched {
+		return !deny
+	}
+	return !t.hasAllow
+}
+
+// Reload rebuilds the prefix table from the config and list files.
+func (l *List) Reload() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	t := &table{}
+	sources := []struct {
+		entries []string
+		file    string
+		deny    bool
+	}{
+		{l.cfg.Allow, l.cfg.AllowFile, false},
+		{l.cfg.Deny, l.cfg.DenyFile, true},
+	}
+	for _, src := range sources {
+		entries := src.entries
+		if src.file != "" {
+			info, err := os.Stat(src.file)
+			if err != nil {
+				return fmt.Errorf("failed to read access list %s: %v", src.file, err)
+			}
+			fileEntries, err := readListFile(src.file)
+			if err != nil {
+				return err
+			}
+			l.modTimes[src.file] = info.ModTime()
+			entries = append(append([]string{}, entries...), fileEntries...)
+		}
+		for _, entry := range entries {
+			p, err := parsePrefix(entry)
+			if err != nil {
+				return fmt.Errorf("invalid access list entry '%s': %v", entry, err)
+			}
+			t.insert(p, src.deny)
+		}
+	}
+	l.table.Store(t)
+	return nil
+}
+
+// StartReloadLoop starts a background goroutine that reloads the list when its files change.
+func (l *List) StartReloadLoop(interval time.Duration) {
+	if l.cfg.AllowFile == "" && l.cfg.DenyFile == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if !l.changed() {
+				continue
+			}
+			if err := l.Reload(); err != nil {
+				log.Errorf("Failed to reload access list, keeping previous: %v", err)
+				continue
+			}
+			log.Infof("Reloaded access list")
+		}
+	}()
+}
+
+// changed reports whether any list file has a different modification time than at the last load.
+func (l *List) changed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, file := range []string{l.cfg.AllowFile, l.cfg.DenyFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err == nil && !info.ModTime().Equal(l.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// readListFile returns the non-empty entries of a list file, ignoring # comments.
+func readListFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access list %s: %v", path, err)
+	}
+	var entries []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx != -1 {
+			line = line[:idx]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			entries = append(entries, line)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// Middleware rejects requests whose client IP is not allowed by l.
+func Middleware(l *List, proxies *TrustedProxies, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := proxies.ClientIP(r)
+		if !ip.IsValid() || !l.Allowed(ip) {
+			requestid.Logger(r.Context()).Warnf("Access denied for %s %s from %s", r.Method, r.URL.Path, ip)
+			http.Error(w, http.StatusText(l.status), l.status)
+			return
+		}
+		next(w, r)
+	}
+}
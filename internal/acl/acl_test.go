@@ -0,0 +1,156 @@
+package acl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+func TestAllowed_LongestPrefixWins(t *testing.T) {
+	l, err := New(config.AccessControlConfig{
+		Allow: []string{"10.0.0.0/8", "10.1.2.3", "2001:db8::/32"},
+		Deny:  []string{"10.1.0.0/16", "2001:db8:dead::/48"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := map[string]bool{
+		"10.2.0.1":         true,  // /8 allow
+		"10.1.0.1":         false, // /16 deny beats /8 allow
+		"10.1.2.3":         true,  // /32 allow beats /16 deny
+		"::ffff:10.1.2.3":  true,  // mapped IPv4
+		"192.168.1.1":      false, // no match, allow list present
+		"2001:db8::1":      true,
+		"2001:db8:dead::1": false,
+		"2001:db9::1":      false,
+	}
+	for ip, want := range tests {
+		if got := l.Allowed(netip.MustParseAddr(ip)); got != want {
+			t.Errorf("Allowed(%s) = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestAllowed_DenyOnly(t *testing.T) {
+	l, err := New(config.AccessControlConfig{Deny: []string{"192.0.2.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Allowed(netip.MustParseAddr("192.0.2.7")) {
+		t.Error("expected denied address to be rejected")
+	}
+	if !l.Allowed(netip.MustParseAddr("198.51.100.1")) {
+		t.Error("expected unmatched address to be allowed when there is no allow list")
+	}
+}
+
+func TestAllowed_SamePrefixDenyWins(t *testing.T) {
+	l, err := New(config.AccessControlConfig{Allow: []string{"192.0.2.0/24"}, Deny: []string{"192.0.2.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Allowed(netip.MustParseAddr("192.0.2.1")) {
+		t.Error("expected deny to win on identical prefixes")
+	}
+}
+
+func TestNew_InvalidEntry(t *testing.T) {
+	if _, err := New(config.AccessControlConfig{Allow: []string{"not-an-ip"}}); err == nil {
+		t.Error("expected error for invalid entry")
+	}
+}
+
+func TestReloadLoop_PicksUpFileChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	if err := os.WriteFile(path, []byte("# blocked\n192.0.2.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := New(config.AccessControlConfig{DenyFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Allowed(netip.MustParseAddr("192.0.2.1")) {
+		t.Fatal("expected 192.0.2.1 to be denied")
+	}
+
+	l.StartReloadLoop(20 * time.Millisecond)
+	if err := os.WriteFile(path, []byte("198.51.100.0/24\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the modification time differs on filesystems with coarse timestamps
+	future := time.Now().Add(time.Second)
+	os.Chtimes(path, future, future)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if l.Allowed(netip.MustParseAddr("192.0.2.1")) && !l.Allowed(netip.MustParseAddr("198.51.100.9")) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("expected list to be reloaded after file change")
+}
+
+func TestClientIP_TrustedProxies(t *testing.T) {
+	tp, err := NewTrustedProxies([]string{"10.0.0.0/8", "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"untrusted peer ignores header", "203.0.113.5:1234", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"trusted peer uses header", "127.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"skips trusted hops", "127.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2", "10.0.0.3"}, "198.51.100.1"},
+		{"rightmost untrusted wins", "127.0.0.1:1234", []string{"1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"no header", "127.0.0.1:1234", nil, "127.0.0.1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.remote
+			for _, v := range tc.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := tp.ClientIP(r).String(); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMiddleware_RejectsWithConfiguredStatus(t *testing.T) {
+	l, err := New(config.AccessControlConfig{Deny: []string{"203.0.113.0/24"}, Status: http.StatusNotFound})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := Middleware(l, nil, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.9:5555"
+	rw := httptest.NewRecorder()
+	handler(rw, r)
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rw.Code)
+	}
+
+	r.RemoteAddr = "198.51.100.9:5555"
+	rw = httptest.NewRecorder()
+	handler(rw, r)
+	if rw.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rw.Code)
+	}
+}
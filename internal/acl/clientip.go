@@ -0,0 +1,66 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies resolves the real client IP of requests arriving through trusted load balancers.
+type TrustedProxies struct {
+	table table
+}
+
+// NewTrustedProxies builds a TrustedProxies from CIDRs or IPs. A nil or empty list trusts nobody.
+func NewTrustedProxies(cidrs []string) (*TrustedProxies, error) {
+	tp := &TrustedProxies{}
+	for _, cidr := range cidrs {
+		p, err := parsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy '%s': %v", cidr, err)
+		}
+		tp.table.insert(p, false)
+	}
+	return tp, nil
+}
+
+// trusted reports whether ip belongs to a trusted proxy.
+func (tp *TrustedProxies) trusted(ip netip.Addr) bool {
+	if tp == nil {
+		return false
+	}
+	matched, _ := tp.table.lookup(ip)
+	return matched
+}
+
+// ClientIP returns the client IP of r. If the peer is a trusted proxy, X-Forwarded-For is walked
+// from right to left and the first untrusted address is returned.
+func (tp *TrustedProxies) ClientIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	ip = ip.Unmap()
+	if !tp.trusted(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		ip = hop.Unmap()
+		if !tp.trusted(ip) {
+			return ip
+		}
+	}
+	return ip
+}
@@ -0,0 +1,82 @@
+package acl
+
+import (
+	"net/netip"
+)
+
+// node is a single bit position in the binary prefix trie.
+type node struct {
+	child [2]*node
+	set   bool // a prefix ends at this node
+	deny  bool
+}
+
+// table is a longest-prefix-match table of allow and deny prefixes.
+type table struct {
+	v4, v6   node
+	hasAllow bool
+}
+
+// insert adds a prefix. When the same prefix is both allowed and denied, deny wins.
+func (t *table) insert(p netip.Prefix, deny bool) {
+	p = p.Masked()
+	addr := p.Addr()
+	n := &t.v6
+	if addr.Is4() {
+		n = &t.v4
+	}
+	b := addr.AsSlice()
+	for i := range p.Bits() {
+		bit := b[i/8] >> (7 - i%8) & 1
+		if n.child[bit] == nil {
+			n.child[bit] = &node{}
+		}
+		n = n.child[bit]
+	}
+	if !n.set || deny {
+		n.deny = deny
+	}
+	n.set = true
+	if !deny {
+		t.hasAllow = true
+	}
+}
+
+// lookup returns whether ip matches any prefix and, if so, whether the longest match is a deny.
+func (t *table) lookup(ip netip.Addr) (matched, deny bool) {
+	ip = ip.Unmap()
+	n := &t.v6
+	if ip.Is4() {
+		n = &t.v4
+	}
+	b := ip.AsSlice()
+	if n.set {
+		matched, deny = true, n.deny
+	}
+	for i := range len(b) * 8 {
+		n = n.child[b[i/8]>>(7-i%8)&1]
+		if n == nil {
+			break
+		}
+		if n.set {
+			matched, deny = true, n.deny
+		}
+	}
+	return matched, deny
+}
+
+// parsePrefix parses a CIDR or a single IP address into a prefix.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if p, err := netip.ParsePrefix(s); err == nil {
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			return netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96), nil
+		}
+		return p, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+// apiKeyAuth accepts requests carrying one of a static set of keys.
+type apiKeyAuth struct {
+	header string
+	hashes [][sha256.Size]byte
+}
+
+// newAPIKey loads keys from cfg.KeysFile (one per line, # comments allowed) and cfg.KeysEnv (comma separated).
+func newAPIKey(cfg config.AuthConfig) (*apiKeyAuth, error) {
+	var keys []string
+	if cfg.KeysFile != "" {
+		data, err := os.ReadFile(cfg.KeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read API keys file: %v", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if idx := strings.Index(line, "#"); idx != -1 {
+				line = line[:idx]
+			}
+			keys = append(keys, line)
+		}
+	}
+	if cfg.KeysEnv != "" {
+		keys = append(keys, strings.Split(os.Getenv(cfg.KeysEnv), ",")...)
+	}
+
+	a := &apiKeyAuth{header: headerOrDefault(cfg.Header, "X-Api-Key")}
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key != "" {
+			a.hashes = append(a.hashes, sha256.Sum256([]byte(key)))
+		}
+	}
+	if len(a.hashes) == 0 {
+		return nil, fmt.Errorf("no API keys configured")
+	}
+	return a, nil
+}
+
+// Authenticate compares the hashed key against every configured key in constant time.
+func (a *apiKeyAuth) Authenticate(r *http.Request) error {
+	key := r.Header.Get(a.header)
+	if a.header == "Authorization" {
+		key = strings.TrimPrefix(key, "Bearer ")
+	}
+	if key == "" {
+		return ErrUnauthorized
+	}
+	sum := sha256.Sum256([]byte(key))
+	match := 0
+	for _, h := range a.hashes {
+		match |= subtle.ConstantTimeCompare(sum[:], h[:])
+	}
+	if match != 1 {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+func (a *apiKeyAuth) Header() string { return a.header }
+
+func (a *apiKeyAuth) Challenge() string { return "" }
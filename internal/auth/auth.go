@@ -0,0 +1,62 @@
+// Authenticates clients in front of endpoints using API keys, basic auth or JWTs.
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/requestid"
+)
+
+// ErrUnauthorized is returned when a request carries missing or invalid credentials.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Authenticator validates the credentials carried by a request.
+type Authenticator interface {
+	// Authenticate returns nil if the request carries valid credentials.
+	Authenticate(r *http.Request) error
+	// Header returns the request header holding the credentials, stripped before forwarding.
+	Header() string
+	// Challenge returns the WWW-Authenticate value sent with 401 responses, empty for none.
+	Challenge() string
+}
+
+// New builds the Authenticator described by cfg.
+func New(cfg config.AuthConfig) (Authenticator, error) {
+	switch cfg.Type {
+	case "api_key":
+		return newAPIKey(cfg)
+	case "basic":
+		return newBasic(cfg)
+	case "jwt":
+		return newJWT(cfg)
+	default:
+		return nil, fmt.Errorf("unsupported auth type '%s'", cfg.Type)
+	}
+}
+
+// Middleware rejects unauthenticated requests with 401 and strips the credentials header before calling next.
+func Middleware(a Authenticator, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := a.Authenticate(r); err != nil {
+			requestid.Logger(r.Context()).Warnf("Authentication failed for %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			if challenge := a.Challenge(); challenge != "" {
+				w.Header().Set("WWW-Authenticate", challenge)
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		r.Header.Del(a.Header())
+		next(w, r)
+	}
+}
+
+// headerOrDefault returns h if set, otherwise def.
+func headerOrDefault(h, def string) string {
+	if h == "" {
+		return def
+	}
+	return http.CanonicalHeaderKey(h)
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+func TestAPIKey_FileAndEnv(t *testing.T) {
+	dir := t.TempDir()
+	keysFile := filepath.Join(dir, "keys.txt")
+	if err := os.WriteFile(keysFile, []byte("key-one # first client\n\nkey-two\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_API_KEYS", "key-three, key-four")
+
+	a, err := New(config.AuthConfig{Type: "api_key", KeysFile: keysFile, KeysEnv: "TEST_API_KEYS"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, key := range []string{"key-one", "key-two", "key-three", "key-four"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-API-Key", key)
+		if err := a.Authenticate(req); err != nil {
+			t.Errorf("expected key %s to be accepted, got %v", key, err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-API-Key", "first client")
+	if err := a.Authenticate(req); err == nil {
+		t.Error("expected unknown key to be rejected")
+	}
+}
+
+func TestAPIKey_BearerHeader(t *testing.T) {
+	t.Setenv("TEST_API_KEYS", "secret")
+	a, err := New(config.AuthConfig{Type: "api_key", Header: "authorization", KeysEnv: "TEST_API_KEYS"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	if err := a.Authenticate(req); err != nil {
+		t.Errorf("expected bearer key to be accepted, got %v", err)
+	}
+}
+
+func TestAPIKey_NoKeys(t *testing.T) {
+	if _, err := New(config.AuthConfig{Type: "api_key", KeysEnv: "TEST_API_KEYS_UNSET"}); err == nil {
+		t.Error("expected error when no keys are configured")
+	}
+}
+
+func TestBasic_Htpasswd(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("bcrypt-pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd := "alice:" + string(bcryptHash) + "\n" +
+		"bob:{SHA}qUqP5cyxm6YcTAhz05Hph5gvu9M=\n" + // "test"
+		"carol:$apr1$saltsalt$LrttParrLPdxvgutaSXWJ0\n" // "secret"
+	path := filepath.Join(t.TempDir(), ".htpasswd")
+	if err := os.WriteFile(path, []byte(htpasswd), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New(config.AuthConfig{Type: "basic", HtpasswdFile: path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		user, pass string
+		ok         bool
+	}{
+		{"alice", "bcrypt-pass", true},
+		{"bob", "test", true},
+		{"carol", "secret", true},
+		{"carol", "wrong", false},
+		{"dave", "test", false},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(tc.user, tc.pass)
+		err := a.Authenticate(req)
+		if tc.ok && err != nil {
+			t.Errorf("expected %s to be accepted, got %v", tc.user, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("expected %s/%s to be rejected", tc.user, tc.pass)
+		}
+	}
+}
+
+func TestMiddleware_RejectsAndStrips(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".htpasswd")
+	if err := os.WriteFile(path, []byte("bob:{SHA}qUqP5cyxm6YcTAhz05Hph5gvu9M=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(config.AuthConfig{Type: "basic", HtpasswdFile: path, Realm: "api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	called := false
+	handler := Middleware(a, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if r.Header.Get("Authorization") != "" {
+			t.Error("expected Authorization header to be stripped before forwarding")
+		}
+	})
+
+	rw := httptest.NewRecorder()
+	handler(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rw.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", rw.Code)
+	}
+	if rw.Header().Get("WWW-Authenticate") != `Basic realm="api"` {
+		t.Errorf("unexpected challenge: %s", rw.Header().Get("WWW-Authenticate"))
+	}
+	if called {
+		t.Error("next handler should not be called for unauthenticated requests")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("bob", "test")
+	handler(httptest.NewRecorder(), req)
+	if !called {
+		t.Error("expected next handler to be called for authenticated request")
+	}
+}
+
+func TestNew_UnknownType(t *testing.T) {
+	if _, err := New(config.AuthConfig{Type: "oauth"}); err == nil {
+		t.Error("expected error for unsupported auth type")
+	}
+}
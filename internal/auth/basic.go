@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+// basicAuth accepts requests whose basic auth credentials match an htpasswd entry.
+type basicAuth struct {
+	realm string
+	users map[string]string // user -> hash
+}
+
+// newBasic loads the htpasswd file referenced by cfg.HtpasswdFile.
+func newBasic(cfg config.AuthConfig) (*basicAuth, error) {
+	if cfg.HtpasswdFile == "" {
+		return nil, fmt.Errorf("htpasswd_file must be specified for basic auth")
+	}
+	data, err := os.ReadFile(cfg.HtpasswdFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read htpasswd file: %v", err)
+	}
+	a := &basicAuth{realm: cfg.Realm, users: make(map[string]string)}
+	if a.realm == "" {
+		a.realm = "revproxy"
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed htpasswd line for user '%s'", user)
+		}
+		a.users[user] = hash
+	}
+	if len(a.users) == 0 {
+		return nil, fmt.Errorf("no users found in %s", cfg.HtpasswdFile)
+	}
+	return a, nil
+}
+
+// Authenticate verifies the basic auth password against the stored hash.
+func (a *basicAuth) Authenticate(r *http.Request) error {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return ErrUnauthorized
+	}
+	hash, ok := a.users[user]
+	if !ok || !verifyHtpasswd(hash, password) {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+func (a *basicAuth) Header() string { return "Authorization" }
+
+func (a *basicAuth) Challenge() string { return fmt.Sprintf("Basic realm=%q", a.realm) }
+
+// verifyHtpasswd checks password against a bcrypt, {SHA} or $apr1$ hash.
+func verifyHtpasswd(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(apr1(password, salt))) == 1
+	default:
+		return false
+	}
+}
+
+// apr1 computes the Apache MD5 crypt hash of password with the given salt.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+	for i := len(pw); i > 0; i -= 16 {
+		ctx.Write(altSum[:min(16, i)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := range 1000 {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	var out strings.Builder
+	encode := func(v uint, n int) {
+		for range n {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, idx := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(final[idx[0]])<<16|uint(final[idx[1]])<<8|uint(final[idx[2]]), 4)
+	}
+	encode(uint(final[11]), 2)
+
+	return magic + salt + "$" + out.String()
+}
@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+// jwk is a single JSON Web Key as found in a JWKS file.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	K   string `json:"k"`   // oct
+	N   string `json:"n"`   // RSA
+	E   string `json:"e"`   // RSA
+	Crv string `json:"crv"` // EC
+	X   string `json:"x"`   // EC
+	Y   string `json:"y"`   // EC
+}
+
+// verificationKey is a parsed key usable for one algorithm.
+type verificationKey struct {
+	kid string
+	alg string
+	key any // []byte, *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+// jwtAuth accepts requests carrying a bearer JWT signed by a key in the JWKS file.
+type jwtAuth struct {
+	header     string
+	keys       []verificationKey
+	algorithms []string
+	issuer     string
+	audience   string
+	claims     map[string]string
+	leeway     time.Duration
+	now        func() time.Time
+}
+
+// newJWT loads the JWKS file referenced by cfg.JWKSFile.
+func newJWT(cfg config.AuthConfig) (*jwtAuth, error) {
+	if cfg.JWKSFile == "" {
+		return nil, fmt.Errorf("jwks_file must be specified for jwt auth")
+	}
+	data, err := os.ReadFile(cfg.JWKSFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS file: %v", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+	a := &jwtAuth{
+		header:     headerOrDefault(cfg.Header, "Authorization"),
+		keys:       keys,
+		algorithms: cfg.Algorithms,
+		issuer:     cfg.Issuer,
+		audience:   cfg.Audience,
+		claims:     cfg.Claims,
+		leeway:     time.Duration(cfg.Leeway) * time.Second,
+		now:        time.Now,
+	}
+	if len(a.algorithms) == 0 {
+		a.algorithms = []string{"HS256", "RS256", "ES256"}
+	}
+	for _, alg := range a.algorithms {
+		if alg != "HS256" && alg != "RS256" && alg != "ES256" {
+			return nil, fmt.Errorf("unsupported JWT algorithm '%s'", alg)
+		}
+	}
+	return a, nil
+}
+
+// parseJWKS parses the keys of a JWKS document, skipping key types it cannot use.
+func parseJWKS(data []byte) ([]verificationKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %v", err)
+	}
+	var keys []verificationKey
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil {
+				return nil, fmt.Errorf("invalid oct key '%s': %v", k.Kid, err)
+			}
+			keys = append(keys, verificationKey{kid: k.Kid, alg: "HS256", key: secret})
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				return nil, fmt.Errorf("invalid RSA key '%s'", k.Kid)
+			}
+			pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			keys = append(keys, verificationKey{kid: k.Kid, alg: "RS256", key: pub})
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				return nil, fmt.Errorf("invalid EC key '%s'", k.Kid)
+			}
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			keys = append(keys, verificationKey{kid: k.Kid, alg: "ES256", key: pub})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no usable keys in JWKS")
+	}
+	return keys, nil
+}
+
+// Authenticate verifies the bearer token signature and its claims.
+func (a *jwtAuth) Authenticate(r *http.Request) error {
+	token, ok := strings.CutPrefix(r.Header.Get(a.header), "Bearer ")
+	if !ok || token == "" {
+		return ErrUnauthorized
+	}
+	claims, err := a.verify(token)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+	return a.checkClaims(claims)
+}
+
+func (a *jwtAuth) Header() string { return a.header }
+
+func (a *jwtAuth) Challenge() string { return "Bearer" }
+
+// verify checks the token signature and returns the decoded claims.
+func (a *jwtAuth) verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if !slices.Contains(a.algorithms, header.Alg) {
+		return nil, fmt.Errorf("algorithm '%s' not allowed", header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	verified := false
+	for _, k := range a.keys {
+		if k.alg != header.Alg || (header.Kid != "" && k.kid != header.Kid) {
+			continue
+		}
+		if verifySignature(k, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verifySignature verifies sig over signed with the given key.
+func verifySignature(k verificationKey, signed, sig []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch key := k.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signed)
+		return hmac.Equal(sig, mac.Sum(nil))
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if len(sig) != 64 {
+			return false
+		}
+		return ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	}
+	return false
+}
+
+// checkClaims validates the registered time, issuer and audience claims and the configured claim values.
+func (a *jwtAuth) checkClaims(claims map[string]any) error {
+	now := a.now()
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(a.leeway)) {
+		return fmt.Errorf("%w: token expired", ErrUnauthorized)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.leeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: token not yet valid", ErrUnauthorized)
+	}
+	if a.issuer != "" && !claimMatches(claims["iss"], a.issuer) {
+		return fmt.Errorf("%w: unexpected issuer", ErrUnauthorized)
+	}
+	if a.audience != "" && !claimMatches(claims["aud"], a.audience) {
+		return fmt.Errorf("%w: unexpected audience", ErrUnauthorized)
+	}
+	for name, expected := range a.claims {
+		if !claimMatches(claims[name], expected) {
+			return fmt.Errorf("%w: claim '%s' mismatch", ErrUnauthorized, name)
+		}
+	}
+	return nil
+}
+
+// claimMatches reports whether the claim equals expected, or contains it if the claim is an array.
+func claimMatches(claim any, expected string) bool {
+	switch v := claim.(type) {
+	case nil:
+		return false
+	case []any:
+		for _, item := range v {
+			if fmt.Sprint(item) == expected {
+				return true
+			}
+		}
+		return false
+	default:
+		return fmt.Sprint(v) == expected
+	}
+}
+
+// decodeSegment decodes a base64url JSON segment of the token into v.
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errors.New("malformed token segment")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token segment")
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+var b64 = base64.RawURLEncoding
+
+// signToken builds a compact JWT signed with key for the given algorithm.
+func signToken(t *testing.T, alg, kid string, claims map[string]any, key any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		s, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = s
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+// writeJWKS writes a JWKS file with one key of each supported type.
+func writeJWKS(t *testing.T, secret []byte, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	t.Helper()
+	jwks := fmt.Sprintf(`{"keys":[
+		{"kty":"oct","kid":"hs","k":%q},
+		{"kty":"RSA","kid":"rs","n":%q,"e":%q},
+		{"kty":"EC","kid":"es","crv":"P-256","x":%q,"y":%q}
+	]}`,
+		b64.EncodeToString(secret),
+		b64.EncodeToString(rsaKey.N.Bytes()), b64.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		b64.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))), b64.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+	)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, []byte(jwks), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJWT_Algorithms(t *testing.T) {
+	secret := []byte("super-secret-hmac-key")
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	path := writeJWKS(t, secret, rsaKey, ecKey)
+
+	a, err := New(config.AuthConfig{Type: "jwt", JWKSFile: path, Issuer: "issuer", Audience: "proxy", Claims: map[string]string{"tier": "paid"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	claims := map[string]any{
+		"iss":  "issuer",
+		"aud":  []string{"other", "proxy"},
+		"exp":  time.Now().Add(time.Minute).Unix(),
+		"tier": "paid",
+	}
+	tokens := map[string]string{
+		"HS256": signToken(t, "HS256", "hs", claims, secret),
+		"RS256": signToken(t, "RS256", "rs", claims, rsaKey),
+		"ES256": signToken(t, "ES256", "es", claims, ecKey),
+	}
+	for alg, token := range tokens {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if err := a.Authenticate(req); err != nil {
+			t.Errorf("%s: expected token to be accepted, got %v", alg, err)
+		}
+	}
+}
+
+func TestJWT_Rejections(t *testing.T) {
+	secret := []byte("super-secret-hmac-key")
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	path := writeJWKS(t, secret, rsaKey, ecKey)
+
+	a, err := New(config.AuthConfig{Type: "jwt", JWKSFile: path, Algorithms: []string{"HS256", "ES256"}, Audience: "proxy", Claims: map[string]string{"tier": "paid"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	valid := map[string]any{"aud": "proxy", "tier": "paid", "exp": time.Now().Add(time.Minute).Unix()}
+	with := func(key string, value any) map[string]any {
+		c := map[string]any{}
+		for k, v := range valid {
+			c[k] = v
+		}
+		c[key] = value
+		return c
+	}
+
+	tests := map[string]string{
+		"expired":           signToken(t, "HS256", "hs", with("exp", time.Now().Add(-time.Minute).Unix()), secret),
+		"not yet valid":     signToken(t, "HS256", "hs", with("nbf", time.Now().Add(time.Minute).Unix()), secret),
+		"wrong audience":    signToken(t, "HS256", "hs", with("aud", "someone-else"), secret),
+		"claim mismatch":    signToken(t, "HS256", "hs", with("tier", "free"), secret),
+		"wrong secret":      signToken(t, "HS256", "hs", valid, []byte("other")),
+		"disallowed alg":    signToken(t, "RS256", "rs", valid, rsaKey),
+		"unknown kid":       signToken(t, "ES256", "missing", valid, ecKey),
+		"malformed":         "not-a-jwt",
+		"missing signature": signToken(t, "HS256", "hs", valid, secret)[:20],
+	}
+	for name, token := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if err := a.Authenticate(req); err == nil {
+			t.Errorf("%s: expected token to be rejected", name)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if err := a.Authenticate(req); err == nil {
+		t.Error("expected request without token to be rejected")
+	}
+}
+
+func TestJWT_UnsupportedAlgorithm(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, []byte(`{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(config.AuthConfig{Type: "jwt", JWKSFile: path, Algorithms: []string{"none"}}); err == nil {
+		t.Error("expected error for unsupported algorithm")
+	}
+}
@@ -0,0 +1,352 @@
+// HTTP cache answering repeatable GET and HEAD requests of an endpoint without selecting a backend.
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/forward"
+	"github.com/abswn/revproxy-go/internal/metrics"
+	"github.com/abswn/revproxy-go/internal/requestid"
+)
+
+// Cache statuses reported in the X-Cache header and the metrics
+const (
+	statusHit         = "HIT"         // served fresh from the cache
+	statusStale       = "STALE"       // served stale while revalidating or while the backends fail
+	statusRevalidated = "REVALIDATED" // the backend confirmed the cached response is still valid
+	statusMiss        = "MISS"        // served by a backend
+	statusBypass      = "BYPASS"      // the client asked not to use the cache
+)
+
+var cacheRequests = metrics.NewCounter("revproxy_cache_requests_total",
+	"Cacheable requests by endpoint and cache status (HIT, STALE, REVALIDATED, MISS, BYPASS).", "endpoint", "status")
+
+// hopHeaders are not stored with a response.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+	"Age", "X-Cache",
+}
+
+// Cache stores the responses of one endpoint.
+type Cache struct {
+	endpoint     string
+	ttl          time.Duration
+	maxTTL       time.Duration
+	swr          time.Duration
+	sie          time.Duration
+	maxEntrySize int64
+	store        *store
+	now          func() time.Time
+
+	mu           sync.Mutex
+	revalidating map[string]bool
+}
+
+// New validates cfg and creates the cache of an endpoint.
+func New(endpoint string, cfg config.CacheConfig) (*Cache, error) {
+	if cfg.TTL < 0 || cfg.MaxTTL < 0 || cfg.StaleWhileRevalidate < 0 || cfg.StaleIfError < 0 {
+		return nil, fmt.Errorf("cache durations must not be negative")
+	}
+	maxSize := cfg.MaxSize
+	if maxSize <= 0 {
+		maxSize = 64 << 20
+	}
+	maxEntrySize := cfg.MaxEntrySize
+	if maxEntrySize <= 0 {
+		maxEntrySize = 1 << 20
+	}
+	var disk *diskStore
+	if cfg.Dir != "" {
+		maxDiskSize := cfg.MaxDiskSize
+		if maxDiskSize <= 0 {
+			maxDiskSize = 1 << 30
+		}
+		var err error
+		if disk, err = newDiskStore(cfg.Dir, maxDiskSize); err != nil {
+			return nil, fmt.Errorf("failed to open cache dir %s: %v", cfg.Dir, err)
+		}
+	}
+	return &Cache{
+		endpoint:     endpoint,
+		ttl:          time.Duration(cfg.TTL) * time.Second,
+		maxTTL:       time.Duration(cfg.MaxTTL) * time.Second,
+		swr:          time.Duration(cfg.StaleWhileRevalidate) * time.Second,
+		sie:          time.Duration(cfg.StaleIfError) * time.Second,
+		maxEntrySize: maxEntrySize,
+		store:        newStore(maxSize, disk),
+		now:          time.Now,
+		revalidating: make(map[string]bool),
+	}, nil
+}
+
+// key identifies the cached responses of a request; GET and HEAD share entries.
+func key(r *http.Request) string {
+	return strings.ToLower(r.Host) + r.URL.RequestURI()
+}
+
+// Middleware answers GET and HEAD requests from the cache when possible and stores the responses
+// of next. Successful unsafe requests invalidate the cached responses of their URL.
+func (c *Cache) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		k := key(r)
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			rec := &recorder{w: w, header: make(http.Header)}
+			next(rec, r)
+			rec.finish()
+			if rec.status < 400 {
+				c.store.put(k, nil, requestid.Logger(r.Context()))
+			}
+			return
+		}
+
+		noStore, noCache := requestDirectives(r)
+		if noStore {
+			cacheRequests.Inc(c.endpoint, statusBypass)
+			w.Header().Set("X-Cache", statusBypass)
+			next(w, r)
+			return
+		}
+		var cached *entry
+		for _, e := range c.store.get(k, requestid.Logger(r.Context())) {
+			if e.matches(r) {
+				cached = e
+				break
+			}
+		}
+		if cached != nil && !noCache {
+			stale := cached.staleness(c.now())
+			if stale < 0 {
+				c.serve(w, r, cached, statusHit)
+				return
+			}
+			if !cached.MustRevalidate && stale < cached.SWR {
+				c.serve(w, r, cached, statusStale)
+				c.revalidateInBackground(next, r, k, cached)
+				return
+			}
+		}
+		c.fetch(next, w, r, k, cached)
+	}
+}
+
+// conditional returns a copy of r that revalidates cached, or nil if cached has no validators.
+func conditional(ctx context.Context, r *http.Request, cached *entry) *http.Request {
+	etag, lastModified := cached.Header.Get("ETag"), cached.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return nil
+	}
+	req := r.Clone(ctx)
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	return req
+}
+
+// usableOnError reports whether cached may be served instead of a failed backend response.
+func (c *Cache) usableOnError(cached *entry) bool {
+	return cached != nil && !cached.MustRevalidate && cached.staleness(c.now()) < cached.SIE
+}
+
+// fetch asks next for the response, revalidating cached if it can, and stores the result.
+func (c *Cache) fetch(next http.HandlerFunc, w http.ResponseWriter, r *http.Request, k string, cached *entry) {
+	req := r
+	if cached != nil && r.Method == http.MethodGet {
+		if cr := conditional(r.Context(), r, cached); cr != nil {
+			req = cr
+		}
+	}
+	rec := &recorder{
+		w:      w,
+		header: make(http.Header),
+		limit:  c.maxEntrySize,
+		hold: func(status int) bool {
+			if status == http.StatusNotModified && req != r {
+				return true
+			}
+			return status >= 500 && c.usableOnError(cached)
+		},
+	}
+	next(rec, req)
+	rec.finish()
+
+	if rec.held {
+		if rec.status == http.StatusNotModified {
+			c.serve(w, r, c.refresh(r, k, cached, rec.header), statusRevalidated)
+			return
+		}
+		requestid.Logger(r.Context()).Warnf("Serving stale response for %s after backend status %d", r.URL.Path, rec.status)
+		c.serve(w, r, cached, statusStale)
+		return
+	}
+	cacheRequests.Inc(c.endpoint, statusMiss)
+	if r.Method == http.MethodGet {
+		c.save(r, k, rec)
+	}
+}
+
+// revalidateInBackground refreshes cached with a detached copy of r, once per key at a time.
+func (c *Cache) revalidateInBackground(next http.HandlerFunc, r *http.Request, k string, cached *entry) {
+	c.mu.Lock()
+	if c.revalidating[k] {
+		c.mu.Unlock()
+		return
+	}
+	c.revalidating[k] = true
+	c.mu.Unlock()
+
+	// Keep the request ID for the log lines and the endpoint's limits, but not the client's cancellation
+	ctx := requestid.WithID(context.Background(), requestid.FromContext(r.Context()))
+	ctx = forward.WithLimits(ctx, forward.LimitsFrom(r.Context()))
+	req := conditional(ctx, r, cached)
+	if req == nil || r.Method != http.MethodGet {
+		req = r.Clone(ctx)
+		req.Method = http.MethodGet
+	}
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.revalidating, k)
+			c.mu.Unlock()
+		}()
+		rec := &recorder{header: make(http.Header), limit: c.maxEntrySize}
+		next(rec, req)
+		rec.finish()
+		switch {
+		case rec.status == http.StatusNotModified:
+			c.refresh(req, k, cached, rec.header)
+		case rec.status < 500:
+			c.save(req, k, rec)
+		default:
+			requestid.Logger(ctx).Debugf("Background revalidation of %s failed with status %d", req.URL.Path, rec.status)
+		}
+	}()
+}
+
+// refresh stores cached updated with the headers of a 304 response and returns the new entry.
+func (c *Cache) refresh(r *http.Request, k string, cached *entry, h http.Header) *entry {
+	header := cached.Header.Clone()
+	for name, values := range h {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Content-Type", "Transfer-Encoding":
+			continue
+		}
+		header[name] = values
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+	now := c.now()
+	f := c.policy(r, cached.Status, header, now)
+	e := *cached
+	e.Header = header
+	e.Stored, e.Age, e.Lifetime, e.SWR, e.SIE, e.MustRevalidate = now, f.age, f.lifetime, f.swr, f.sie, f.mustRevalidate
+	c.replace(r, k, &e, f.storable)
+	return &e
+}
+
+// save stores the response captured by rec if it may be cached, or drops the variant of r otherwise.
+func (c *Cache) save(r *http.Request, k string, rec *recorder) {
+	now := c.now()
+	f := c.policy(r, rec.status, rec.header, now)
+	if rec.overflow {
+		f.storable = false
+	}
+	header := rec.header.Clone()
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+	e := &entry{
+		Key:            k,
+		Vary:           make(map[string]string),
+		Status:         rec.status,
+		Header:         header,
+		Body:           rec.body.Bytes(),
+		Stored:         now,
+		Age:            f.age,
+		Lifetime:       f.lifetime,
+		SWR:            f.swr,
+		SIE:            f.sie,
+		MustRevalidate: f.mustRevalidate,
+	}
+	for _, line := range header.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				e.Vary[name] = strings.Join(r.Header.Values(name), ", ")
+			}
+		}
+	}
+	c.replace(r, k, e, f.storable)
+}
+
+// replace swaps the variant of k matching r for e, or only removes it if e is not storable.
+func (c *Cache) replace(r *http.Request, k string, e *entry, storable bool) {
+	logger := requestid.Logger(r.Context())
+	var vs variants
+	for _, v := range c.store.get(k, logger) {
+		if !v.matches(r) {
+			vs = append(vs, v)
+		}
+	}
+	if storable {
+		vs = append(vs, e)
+	}
+	c.store.put(k, vs, logger)
+}
+
+// serve writes the cached response, or 304 if the client's validators match it.
+func (c *Cache) serve(w http.ResponseWriter, r *http.Request, e *entry, status string) {
+	cacheRequests.Inc(c.endpoint, status)
+	h := w.Header()
+	for name, values := range e.Header {
+		h[name] = append([]string(nil), values...)
+	}
+	h.Set("Age", strconv.Itoa(int(e.currentAge(c.now()).Seconds())))
+	h.Set("X-Cache", status)
+	if notModified(r, e) {
+		h.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		w.Write(e.Body)
+	}
+}
+
+// notModified evaluates the client's If-None-Match, or If-Modified-Since, against e.
+func notModified(r *http.Request, e *entry) bool {
+	if e.Status != http.StatusOK {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
@@ -0,0 +1,340 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/ban"
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/forward"
+)
+
+// clock is a manually advanced time source.
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// newTestCache returns a cache on a fake clock.
+func newTestCache(t *testing.T, cfg config.CacheConfig) (*Cache, *clock) {
+	c, err := New("/api", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := &clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c.now = clk.Now
+	return c, clk
+}
+
+// backend counts the calls reaching it, standing in for backend selection and forwarding.
+type backend struct {
+	calls   atomic.Int32
+	handler http.HandlerFunc
+}
+
+func (b *backend) serve(w http.ResponseWriter, r *http.Request) {
+	b.calls.Add(1)
+	b.handler(w, r)
+}
+
+func do(h http.HandlerFunc, method, target string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	rw := httptest.NewRecorder()
+	h(rw, r)
+	return rw
+}
+
+func TestCache_HitAfterMiss(t *testing.T) {
+	c, clk := newTestCache(t, config.CacheConfig{})
+	b := &backend{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("hello"))
+	}}
+	h := c.Middleware(b.serve)
+
+	if rw := do(h, http.MethodGet, "/api/x", nil); rw.Header().Get("X-Cache") != statusMiss || rw.Body.String() != "hello" {
+		t.Fatalf("expected MISS with body, got %s %q", rw.Header().Get("X-Cache"), rw.Body.String())
+	}
+	clk.Advance(10 * time.Second)
+	rw := do(h, http.MethodGet, "/api/x", nil)
+	if rw.Header().Get("X-Cache") != statusHit || rw.Body.String() != "hello" || rw.Header().Get("Age") != "10" {
+		t.Errorf("expected HIT with age 10, got %s %q age %s", rw.Header().Get("X-Cache"), rw.Body.String(), rw.Header().Get("Age"))
+	}
+	if rw := do(h, http.MethodHead, "/api/x", nil); rw.Header().Get("X-Cache") != statusHit || rw.Body.Len() != 0 {
+		t.Errorf("expected HEAD to be served from the GET entry without body")
+	}
+	if n := b.calls.Load(); n != 1 {
+		t.Errorf("expected one backend call, got %d", n)
+	}
+
+	clk.Advance(time.Minute)
+	if rw := do(h, http.MethodGet, "/api/x", nil); rw.Header().Get("X-Cache") != statusMiss {
+		t.Errorf("expected expired entry to be fetched again, got %s", rw.Header().Get("X-Cache"))
+	}
+}
+
+func TestCache_NotStored(t *testing.T) {
+	tests := map[string]func(w http.ResponseWriter){
+		"no-store": func(w http.ResponseWriter) { w.Header().Set("Cache-Control", "no-store, max-age=60") },
+		"private":  func(w http.ResponseWriter) { w.Header().Set("Cache-Control", "private, max-age=60") },
+		"cookie": func(w http.ResponseWriter) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Set-Cookie", "a=b")
+		},
+		"no freshness": func(w http.ResponseWriter) {},
+		"status": func(w http.ResponseWriter) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+	}
+	for name, respond := range tests {
+		c, _ := newTestCache(t, config.CacheConfig{})
+		b := &backend{handler: func(w http.ResponseWriter, r *http.Request) { respond(w) }}
+		h := c.Middleware(b.serve)
+		do(h, http.MethodGet, "/api", nil)
+		do(h, http.MethodGet, "/api", nil)
+		if n := b.calls.Load(); n != 2 {
+			t.Errorf("%s: expected response not to be cached, got %d backend calls", name, n)
+		}
+	}
+}
+
+func TestCache_EndpointTTL(t *testing.T) {
+	c, clk := newTestCache(t, config.CacheConfig{TTL: 30, MaxTTL: 60})
+	b := &backend{handler: func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/long" {
+			w.Header().Set("Cache-Control", "max-age=3600")
+		}
+	}}
+	h := c.Middleware(b.serve)
+	do(h, http.MethodGet, "/short", nil)
+	do(h, http.MethodGet, "/long", nil)
+	clk.Advance(20 * time.Second)
+	if rw := do(h, http.MethodGet, "/short", nil); rw.Header().Get("X-Cache") != statusHit {
+		t.Errorf("expected endpoint TTL to apply, got %s", rw.Header().Get("X-Cache"))
+	}
+	clk.Advance(50 * time.Second)
+	if rw := do(h, http.MethodGet, "/long", nil); rw.Header().Get("X-Cache") != statusMiss {
+		t.Errorf("expected max_ttl to cap max-age, got %s", rw.Header().Get("X-Cache"))
+	}
+}
+
+func TestCache_Vary(t *testing.T) {
+	c, _ := newTestCache(t, config.CacheConfig{})
+	b := &backend{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte(r.Header.Get("Accept-Language")))
+	}}
+	h := c.Middleware(b.serve)
+	do(h, http.MethodGet, "/api", map[string]string{"Accept-Language": "en"})
+	do(h, http.MethodGet, "/api", map[string]string{"Accept-Language": "de"})
+	for _, lang := range []string{"en", "de"} {
+		rw := do(h, http.MethodGet, "/api", map[string]string{"Accept-Language": lang})
+		if rw.Header().Get("X-Cache") != statusHit || rw.Body.String() != lang {
+			t.Errorf("%s: expected HIT of its own variant, got %s %q", lang, rw.Header().Get("X-Cache"), rw.Body.String())
+		}
+	}
+	if n := b.calls.Load(); n != 2 {
+		t.Errorf("expected one backend call per variant, got %d", n)
+	}
+}
+
+func TestCache_Revalidation(t *testing.T) {
+	c, _ := newTestCache(t, config.CacheConfig{})
+	var gotINM string
+	b := &backend{handler: func(w http.ResponseWriter, r *http.Request) {
+		gotINM = r.Header.Get("If-None-Match")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", `"v1"`)
+		if gotINM == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("body"))
+	}}
+	h := c.Middleware(b.serve)
+	do(h, http.MethodGet, "/api", nil)
+	rw := do(h, http.MethodGet, "/api", nil)
+	if gotINM != `"v1"` {
+		t.Errorf("expected conditional request upstream, got If-None-Match %q", gotINM)
+	}
+	if rw.Code != http.StatusOK || rw.Header().Get("X-Cache") != statusRevalidated || rw.Body.String() != "body" {
+		t.Errorf("expected REVALIDATED cached body, got %d %s %q", rw.Code, rw.Header().Get("X-Cache"), rw.Body.String())
+	}
+	// The client's own validators are answered from the cache
+	rw = do(h, http.MethodGet, "/api", map[string]string{"If-None-Match": `W/"v1"`})
+	if rw.Code != http.StatusNotModified || rw.Body.Len() != 0 {
+		t.Errorf("expected 304 for matching client validator, got %d", rw.Code)
+	}
+}
+
+func TestCache_StaleWhileRevalidate(t *testing.T) {
+	c, clk := newTestCache(t, config.CacheConfig{StaleWhileRevalidate: 30})
+	var version atomic.Int32
+	version.Store(1)
+	b := &backend{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=10")
+		if version.Load() == 1 {
+			w.Write([]byte("v1"))
+		} else {
+			w.Write([]byte("v2"))
+		}
+	}}
+	h := c.Middleware(b.serve)
+	do(h, http.MethodGet, "/api", nil)
+	version.Store(2)
+	clk.Advance(20 * time.Second)
+
+	rw := do(h, http.MethodGet, "/api", nil)
+	if rw.Header().Get("X-Cache") != statusStale || rw.Body.String() != "v1" {
+		t.Fatalf("expected stale v1 while revalidating, got %s %q", rw.Header().Get("X-Cache"), rw.Body.String())
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rw = do(h, http.MethodGet, "/api", nil)
+		if rw.Body.String() == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected background revalidation to refresh the entry")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if rw.Header().Get("X-Cache") != statusHit {
+		t.Errorf("expected refreshed entry to be a HIT, got %s", rw.Header().Get("X-Cache"))
+	}
+
+	// Beyond the stale-while-revalidate window the client waits for the backend
+	clk.Advance(time.Minute)
+	if rw := do(h, http.MethodGet, "/api", nil); rw.Header().Get("X-Cache") != statusMiss {
+		t.Errorf("expected MISS beyond the window, got %s", rw.Header().Get("X-Cache"))
+	}
+}
+
+func TestCache_RevalidationKeepsLimits(t *testing.T) {
+	c, clk := newTestCache(t, config.CacheConfig{StaleWhileRevalidate: 30})
+	var slow atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slow.Load() {
+			select {
+			case <-time.After(5 * time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Write([]byte("v1"))
+	}))
+	defer backend.Close()
+	next := func(w http.ResponseWriter, r *http.Request) {
+		forward.ForwardRequest(w, r, config.URLConfig{URL: backend.URL}, nil, ban.NewManager())
+	}
+	h := forward.Limit(config.LimitsConfig{Timeout: 0.2}, c.Middleware(next))
+	do(h, http.MethodGet, "/api", nil)
+	slow.Store(true)
+	clk.Advance(20 * time.Second)
+
+	if rw := do(h, http.MethodGet, "/api", nil); rw.Header().Get("X-Cache") != statusStale {
+		t.Fatalf("expected a stale response, got %s", rw.Header().Get("X-Cache"))
+	}
+	// The background revalidation gives up after the endpoint's timeout, not the default one
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c.mu.Lock()
+		revalidating := len(c.revalidating)
+		c.mu.Unlock()
+		if revalidating == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the revalidation to end at the endpoint's timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCache_StaleIfError(t *testing.T) {
+	c, clk := newTestCache(t, config.CacheConfig{})
+	var failing atomic.Bool
+	b := &backend{handler: func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			// All backends banned
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=10, stale-if-error=60")
+		w.Write([]byte("cached"))
+	}}
+	h := c.Middleware(b.serve)
+	do(h, http.MethodGet, "/api", nil)
+	failing.Store(true)
+
+	clk.Advance(30 * time.Second)
+	rw := do(h, http.MethodGet, "/api", nil)
+	if rw.Code != http.StatusOK || rw.Header().Get("X-Cache") != statusStale || rw.Body.String() != "cached" {
+		t.Errorf("expected stale response on backend failure, got %d %s %q", rw.Code, rw.Header().Get("X-Cache"), rw.Body.String())
+	}
+	clk.Advance(time.Minute)
+	if rw := do(h, http.MethodGet, "/api", nil); rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the error beyond stale-if-error, got %d", rw.Code)
+	}
+}
+
+func TestCache_RequestDirectivesAndInvalidation(t *testing.T) {
+	c, _ := newTestCache(t, config.CacheConfig{})
+	b := &backend{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+	}}
+	h := c.Middleware(b.serve)
+	do(h, http.MethodGet, "/api", nil)
+
+	if rw := do(h, http.MethodGet, "/api", map[string]string{"Cache-Control": "no-store"}); rw.Header().Get("X-Cache") != statusBypass {
+		t.Errorf("expected BYPASS for no-store request, got %s", rw.Header().Get("X-Cache"))
+	}
+	if rw := do(h, http.MethodGet, "/api", map[string]string{"Cache-Control": "no-cache"}); rw.Header().Get("X-Cache") != statusMiss {
+		t.Errorf("expected no-cache request to reach the backend, got %s", rw.Header().Get("X-Cache"))
+	}
+	if rw := do(h, http.MethodGet, "/api", nil); rw.Header().Get("X-Cache") != statusHit {
+		t.Errorf("expected HIT, got %s", rw.Header().Get("X-Cache"))
+	}
+	do(h, http.MethodPost, "/api", nil)
+	if rw := do(h, http.MethodGet, "/api", nil); rw.Header().Get("X-Cache") != statusMiss {
+		t.Errorf("expected POST to invalidate the entry, got %s", rw.Header().Get("X-Cache"))
+	}
+}
+
+func TestCache_MaxEntrySize(t *testing.T) {
+	c, _ := newTestCache(t, config.CacheConfig{MaxEntrySize: 4})
+	b := &backend{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("too large"))
+	}}
+	h := c.Middleware(b.serve)
+	if rw := do(h, http.MethodGet, "/api", nil); rw.Body.String() != "too large" {
+		t.Errorf("expected the full body to reach the client, got %q", rw.Body.String())
+	}
+	do(h, http.MethodGet, "/api", nil)
+	if n := b.calls.Load(); n != 2 {
+		t.Errorf("expected oversized response not to be cached, got %d backend calls", n)
+	}
+}
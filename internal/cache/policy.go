@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// directives parses a Cache-Control header into lower-case directive names and their values.
+func directives(h http.Header) map[string]string {
+	d := make(map[string]string)
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name == "" {
+				continue
+			}
+			d[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return d
+}
+
+// seconds returns the duration of a delta-seconds directive and whether it is present and valid.
+func seconds(d map[string]string, name string) (time.Duration, bool) {
+	v, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// storableStatus lists the status codes cached by default (RFC 9110 section 15.1), minus partial content.
+var storableStatus = map[int]bool{
+	http.StatusOK: true, http.StatusNonAuthoritativeInfo: true, http.StatusNoContent: true,
+	http.StatusMultipleChoices: true, http.StatusMovedPermanently: true, http.StatusPermanentRedirect: true,
+	http.StatusNotFound: true, http.StatusMethodNotAllowed: true, http.StatusGone: true,
+	http.StatusRequestURITooLong: true, http.StatusNotImplemented: true,
+}
+
+// freshness computes how long a response stays fresh and how long it may then be served stale.
+type freshness struct {
+	storable       bool
+	lifetime       time.Duration
+	age            time.Duration // age of the response when it was received
+	swr            time.Duration // stale-while-revalidate
+	sie            time.Duration // stale-if-error
+	mustRevalidate bool
+}
+
+// policy decides whether the response to req may be stored by a shared cache and for how long.
+func (c *Cache) policy(req *http.Request, status int, h http.Header, now time.Time) freshness {
+	d := directives(h)
+	f := freshness{swr: c.swr, sie: c.sie}
+	if _, ok := d["no-store"]; ok {
+		return f
+	}
+	if _, ok := d["private"]; ok {
+		return f
+	}
+	if !storableStatus[status] || h.Get("Vary") == "*" || len(h.Values("Set-Cookie")) > 0 {
+		return f
+	}
+	_, public := d["public"]
+	_, mustRevalidate := d["must-revalidate"]
+	_, proxyRevalidate := d["proxy-revalidate"]
+	sMaxAge, hasSMaxAge := seconds(d, "s-maxage")
+	// A shared cache only stores responses to authenticated requests that explicitly allow it. This
+	// covers credentials passed through to the backend: on endpoints with auth, the middleware has
+	// removed them by now and all authenticated clients share the cache
+	if req.Header.Get("Authorization") != "" && !public && !hasSMaxAge && !mustRevalidate {
+		return f
+	}
+	f.mustRevalidate = mustRevalidate || proxyRevalidate || hasSMaxAge
+
+	explicit := true
+	if maxAge, ok := seconds(d, "max-age"); hasSMaxAge {
+		f.lifetime = sMaxAge
+	} else if ok {
+		f.lifetime = maxAge
+	} else if expires := h.Get("Expires"); expires != "" {
+		// Invalid dates such as "0" mean already expired
+		if t, err := http.ParseTime(expires); err == nil {
+			date, err := http.ParseTime(h.Get("Date"))
+			if err != nil {
+				date = now
+			}
+			f.lifetime = max(t.Sub(date), 0)
+		}
+	} else {
+		explicit = false
+		f.lifetime = c.ttl
+	}
+	if c.maxTTL > 0 && f.lifetime > c.maxTTL {
+		f.lifetime = c.maxTTL
+	}
+	// no-cache responses may be stored but must be revalidated before every use
+	_, noCache := d["no-cache"]
+	if noCache {
+		f.lifetime = 0
+	}
+	if age, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && age > 0 {
+		f.age = time.Duration(age) * time.Second
+	}
+	if v, ok := seconds(d, "stale-while-revalidate"); ok {
+		f.swr = v
+	}
+	if v, ok := seconds(d, "stale-if-error"); ok {
+		f.sie = v
+	}
+	if f.mustRevalidate {
+		f.swr, f.sie = 0, 0
+	}
+	if noCache {
+		f.swr = 0
+	}
+	// Without freshness information a response is only worth keeping if it can be revalidated
+	f.storable = explicit || f.lifetime > 0 || h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+	return f
+}
+
+// requestDirectives returns whether the client forbids storing the response and whether it
+// requires the cached response to be revalidated.
+func requestDirectives(r *http.Request) (noStore, noCache bool) {
+	d := directives(r.Header)
+	_, noStore = d["no-store"]
+	_, noCache = d["no-cache"]
+	if maxAge, ok := seconds(d, "max-age"); ok && maxAge == 0 {
+		noCache = true
+	}
+	// Pragma only applies when Cache-Control is absent
+	if len(d) == 0 && strings.EqualFold(r.Header.Get("Pragma"), "no-cache") {
+		noCache = true
+	}
+	return noStore, noCache
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// recorder captures a response of the next handler while passing it through to the client.
+// Responses for which hold returns true are kept from the client so that the cache can answer
+// instead; without a client writer every response is held.
+type recorder struct {
+	w      http.ResponseWriter
+	hold   func(status int) bool
+	limit  int64 // largest body captured, 0 captures nothing
+	header http.Header
+
+	status   int
+	held     bool
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rec *recorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *recorder) WriteHeader(code int) {
+	if rec.status != 0 {
+		return
+	}
+	rec.status = code
+	if rec.w == nil || (rec.hold != nil && rec.hold(code)) {
+		rec.held = true
+		return
+	}
+	dst := rec.w.Header()
+	for name, values := range rec.header {
+		dst[name] = values
+	}
+	if rec.limit > 0 {
+		dst.Set("X-Cache", statusMiss)
+	}
+	rec.w.WriteHeader(code)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.overflow {
+		if int64(rec.body.Len()+len(b)) > rec.limit {
+			rec.overflow = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	if rec.held {
+		return len(b), nil
+	}
+	return rec.w.Write(b)
+}
+
+// finish sends the status if next returned without writing anything.
+func (rec *recorder) finish() {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+}
+
+// Flush lets streamed responses reach the client through the wrapper.
+func (rec *recorder) Flush() {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if f, ok := rec.w.(http.Flusher); ok && !rec.held {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController.
+func (rec *recorder) Unwrap() http.ResponseWriter {
+	return rec.w
+}
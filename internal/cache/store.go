@@ -0,0 +1,266 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// entry is a stored response. Entries are never modified once stored; revalidation stores a copy.
+type entry struct {
+	Key    string
+	Vary   map[string]string // request values of the headers named by the response's Vary header
+	Status int
+	Header http.Header
+	Body   []byte
+	// Stored is when the response was received, Age its age at that time
+	Stored         time.Time
+	Age            time.Duration
+	Lifetime       time.Duration
+	SWR            time.Duration
+	SIE            time.Duration
+	MustRevalidate bool
+}
+
+// size approximates the memory used by e.
+func (e *entry) size() int64 {
+	n := int64(len(e.Key) + len(e.Body))
+	for k, vs := range e.Header {
+		for _, v := range vs {
+			n += int64(len(k) + len(v))
+		}
+	}
+	for k, v := range e.Vary {
+		n += int64(len(k) + len(v))
+	}
+	return n
+}
+
+// currentAge returns the age of e at now.
+func (e *entry) currentAge(now time.Time) time.Duration {
+	return e.Age + now.Sub(e.Stored)
+}
+
+// staleness returns how long e has been stale at now, negative while it is fresh.
+func (e *entry) staleness(now time.Time) time.Duration {
+	return e.currentAge(now) - e.Lifetime
+}
+
+// matches reports whether e was stored for a request with the same values of the Vary headers as r.
+func (e *entry) matches(r *http.Request) bool {
+	for name, value := range e.Vary {
+		if strings.Join(r.Header.Values(name), ", ") != value {
+			return false
+		}
+	}
+	return true
+}
+
+// variants are the entries of one key, one per combination of Vary header values.
+type variants []*entry
+
+func (vs variants) size() int64 {
+	var n int64
+	for _, e := range vs {
+		n += e.size()
+	}
+	return n
+}
+
+// store keeps the variants of each key in a size-bounded in-memory LRU and, optionally, on disk.
+type store struct {
+	maxSize int64
+
+	mu    sync.Mutex
+	lru   *list.List // of *lruItem, most recently used first
+	items map[string]*list.Element
+	size  int64
+
+	disk *diskStore
+}
+
+type lruItem struct {
+	key      string
+	variants variants
+	size     int64
+}
+
+func newStore(maxSize int64, disk *diskStore) *store {
+	return &store{maxSize: maxSize, lru: list.New(), items: make(map[string]*list.Element), disk: disk}
+}
+
+// get returns the variants of key, loading them from disk if they were evicted from memory.
+// Disk errors are logged to logger, the logger of the request being served.
+func (s *store) get(key string, logger *log.Entry) variants {
+	s.mu.Lock()
+	if el, ok := s.items[key]; ok {
+		s.lru.MoveToFront(el)
+		vs := el.Value.(*lruItem).variants
+		s.mu.Unlock()
+		return vs
+	}
+	s.mu.Unlock()
+	if s.disk == nil {
+		return nil
+	}
+	vs := s.disk.get(key, logger)
+	if vs != nil {
+		s.remember(key, vs)
+	}
+	return vs
+}
+
+// put replaces the variants of key. An empty list removes the key. Disk errors are logged to logger.
+func (s *store) put(key string, vs variants, logger *log.Entry) {
+	s.remember(key, vs)
+	if s.disk != nil {
+		s.disk.put(key, vs, logger)
+	}
+}
+
+// remember stores vs in memory only, evicting the least recently used keys beyond maxSize.
+func (s *store) remember(key string, vs variants) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.size -= el.Value.(*lruItem).size
+		s.lru.Remove(el)
+		delete(s.items, key)
+	}
+	if len(vs) == 0 {
+		return
+	}
+	item := &lruItem{key: key, variants: vs, size: vs.size()}
+	s.items[key] = s.lru.PushFront(item)
+	s.size += item.size
+	for s.size > s.maxSize && s.lru.Len() > 0 {
+		oldest := s.lru.Back()
+		evicted := oldest.Value.(*lruItem)
+		s.lru.Remove(oldest)
+		delete(s.items, evicted.key)
+		s.size -= evicted.size
+	}
+}
+
+// diskStore keeps one gob file per key in dir, removing the oldest files beyond maxSize.
+type diskStore struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	files map[string]diskFile // file name -> size and modification time
+	size  int64
+}
+
+type diskFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// newDiskStore creates dir if needed and indexes the files already in it.
+func newDiskStore(dir string, maxSize int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	d := &diskStore{dir: dir, maxSize: maxSize, files: make(map[string]diskFile)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, de := range entries {
+		if de.IsDir() || filepath.Ext(de.Name()) != ".cache" {
+			continue
+		}
+		if info, err := de.Info(); err == nil {
+			d.files[de.Name()] = diskFile{size: info.Size(), modTime: info.ModTime()}
+			d.size += info.Size()
+		}
+	}
+	return d, nil
+}
+
+// fileName hashes key so that any key maps to a safe file name.
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + ".cache"
+}
+
+func (d *diskStore) get(key string, logger *log.Entry) variants {
+	data, err := os.ReadFile(filepath.Join(d.dir, fileName(key)))
+	if err != nil {
+		return nil
+	}
+	var vs variants
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&vs); err != nil {
+		logger.Warnf("Ignoring unreadable cache file for %s: %v", key, err)
+		return nil
+	}
+	if len(vs) == 0 || vs[0].Key != key {
+		return nil
+	}
+	return vs
+}
+
+func (d *diskStore) put(key string, vs variants, logger *log.Entry) {
+	name := fileName(key)
+	path := filepath.Join(d.dir, name)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if old, ok := d.files[name]; ok {
+		d.size -= old.size
+		delete(d.files, name)
+	}
+	if len(vs) == 0 {
+		os.Remove(path)
+		return
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(vs); err != nil {
+		logger.Warnf("Failed to encode cache entry for %s: %v", key, err)
+		return
+	}
+	// Write to a temporary file first so that readers never see a partial file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		logger.Warnf("Failed to write cache file: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		logger.Warnf("Failed to write cache file: %v", err)
+		os.Remove(tmp)
+		return
+	}
+	d.files[name] = diskFile{size: int64(buf.Len()), modTime: time.Now()}
+	d.size += int64(buf.Len())
+	if d.size > d.maxSize {
+		d.prune()
+	}
+}
+
+// prune removes the oldest files until the total size is within maxSize. Callers hold d.mu.
+func (d *diskStore) prune() {
+	names := make([]string, 0, len(d.files))
+	for name := range d.files {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return d.files[names[i]].modTime.Before(d.files[names[j]].modTime) })
+	for _, name := range names {
+		if d.size <= d.maxSize {
+			break
+		}
+		os.Remove(filepath.Join(d.dir, name))
+		d.size -= d.files[name].size
+		delete(d.files, name)
+	}
+}
@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+var testLogger = log.NewEntry(log.StandardLogger())
+
+func testEntry(key string, size int) variants {
+	return variants{{Key: key, Status: http.StatusOK, Header: http.Header{}, Body: make([]byte, size), Stored: time.Now()}}
+}
+
+func TestStore_LRUEviction(t *testing.T) {
+	s := newStore(250, nil)
+	s.put("a", testEntry("a", 100), testLogger)
+	s.put("b", testEntry("b", 100), testLogger)
+	s.get("a", testLogger) // a becomes the most recently used
+	s.put("c", testEntry("c", 100), testLogger)
+
+	if s.get("b", testLogger) != nil {
+		t.Error("expected least recently used key to be evicted")
+	}
+	if s.get("a", testLogger) == nil || s.get("c", testLogger) == nil {
+		t.Error("expected recently used keys to be kept")
+	}
+	s.put("a", nil, testLogger)
+	if s.get("a", testLogger) != nil {
+		t.Error("expected empty put to remove the key")
+	}
+}
+
+func TestStore_Disk(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.CacheConfig{Dir: dir, MaxSize: 1}
+	c, err := New("/api", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := c.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("from disk"))
+	})
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api", nil))
+
+	// A new cache on the same directory, and entries too large for memory, are served from disk
+	c, err = New("/api", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := httptest.NewRecorder()
+	c.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected no backend call")
+	})(rw, httptest.NewRequest(http.MethodGet, "/api", nil))
+	if rw.Header().Get("X-Cache") != statusHit || rw.Body.String() != "from disk" {
+		t.Errorf("expected HIT from disk, got %s %q", rw.Header().Get("X-Cache"), rw.Body.String())
+	}
+}
+
+func TestDiskStore_Prune(t *testing.T) {
+	d, err := newDiskStore(t.TempDir(), 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.put("old", testEntry("old", 1000), testLogger)
+	time.Sleep(10 * time.Millisecond)
+	d.put("new", testEntry("new", 1000), testLogger)
+	if d.get("old", testLogger) != nil {
+		t.Error("expected the oldest file to be pruned")
+	}
+	if d.get("new", testLogger) == nil {
+		t.Error("expected the newest file to be kept")
+	}
+}
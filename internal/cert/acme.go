@@ -0,0 +1,205 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/metrics"
+)
+
+var acmeErrors = metrics.NewCounter("revproxy_acme_errors_total",
+	"Failed attempts to obtain an ACME certificate.", "host")
+
+// ACME obtains and renews certificates from an ACME CA for a set of hosts. Other names, clients
+// without SNI and hosts whose issuance failed are served from the fallback store.
+type ACME struct {
+	manager    *autocert.Manager
+	fallback   *Store
+	hosts      []string
+	retryAfter time.Duration
+
+	mu     sync.Mutex
+	failed map[string]time.Time // host -> time of the last failed issuance
+}
+
+// NewACME configures ACME for hosts, storing account and certificates in cfg.CacheDir.
+func NewACME(cfg config.ACMEConfig, hosts []string, fallback *Store) (*ACME, error) {
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no hosts to request certificates for")
+	}
+	cacheDir := cfg.CacheDir
+	if cacheDir == "" {
+		cacheDir = filepath.Join("certs", "acme")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ACME CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ACME CA file %s", cfg.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	client := &acme.Client{
+		DirectoryURL: cfg.DirectoryURL,
+		HTTPClient:   &http.Client{Transport: &orderLocations{next: transport, orders: make(map[string]string)}},
+	}
+	renewBefore := cfg.RenewBefore
+	if renewBefore == 0 {
+		renewBefore = 30
+	}
+	retryAfter := cfg.RetryAfter
+	if retryAfter == 0 {
+		retryAfter = 600
+	}
+	return &ACME{
+		manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       autocert.DirCache(cacheDir),
+			HostPolicy:  autocert.HostWhitelist(hosts...),
+			RenewBefore: time.Duration(renewBefore) * 24 * time.Hour,
+			Email:       cfg.Email,
+			Client:      client,
+		},
+		fallback:   fallback,
+		hosts:      hosts,
+		retryAfter: time.Duration(retryAfter) * time.Second,
+		failed:     make(map[string]time.Time),
+	}, nil
+}
+
+// GetCertificate answers TLS-ALPN-01 challenges and returns the ACME certificate for the client's SNI
+// name, obtaining it if needed, or the fallback certificate. For use as tls.Config.GetCertificate.
+func (a *ACME) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if !a.managed(name) {
+		return a.fallback.GetCertificate(hello)
+	}
+	// Challenge handshakes must be answered by the manager, whatever happened before
+	isChallenge := len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+	if !isChallenge && a.backingOff(name) {
+		return a.fallback.GetCertificate(hello)
+	}
+	cert, err := a.manager.GetCertificate(hello)
+	if isChallenge {
+		return cert, err
+	}
+	if err != nil {
+		a.mu.Lock()
+		a.failed[name] = time.Now()
+		a.mu.Unlock()
+		acmeErrors.Inc(name)
+		log.Errorf("ACME certificate for %s unavailable, serving the fallback certificate for the next %s: %v", name, a.retryAfter, err)
+		return a.fallback.GetCertificate(hello)
+	}
+	a.mu.Lock()
+	if _, ok := a.failed[name]; ok {
+		delete(a.failed, name)
+		log.Infof("ACME certificate for %s obtained", name)
+	}
+	a.mu.Unlock()
+	if cert.Leaf != nil {
+		certExpiry.Set(float64(cert.Leaf.NotAfter.Unix()), "acme:"+name)
+	}
+	return cert, nil
+}
+
+// HTTPHandler answers HTTP-01 challenges and passes other requests to fallback, or redirects them to
+// HTTPS if fallback is nil.
+func (a *ACME) HTTPHandler(fallback http.Handler) http.Handler {
+	return a.manager.HTTPHandler(fallback)
+}
+
+// Prefetch obtains the certificates of all hosts in the background, so that the first clients do not
+// wait for issuance. It needs the listeners answering challenges to be up.
+func (a *ACME) Prefetch() {
+	for _, host := range a.hosts {
+		// Ask like a modern client, so that the ECDSA certificate most clients get is obtained
+		go a.GetCertificate(&tls.ClientHelloInfo{
+			ServerName:        host,
+			CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:   []tls.CurveID{tls.CurveP256},
+			SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+		})
+	}
+}
+
+// managed reports whether certificates for name are obtained through ACME.
+func (a *ACME) managed(name string) bool {
+	for _, h := range a.hosts {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+// backingOff reports whether issuance for name failed less than retryAfter ago.
+func (a *ACME) backingOff(name string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	failedAt, ok := a.failed[name]
+	return ok && time.Since(failedAt) < a.retryAfter
+}
+
+// orderLocations adds the order URL to finalize responses that lack it. x/crypto/acme polls an order
+// that is still being processed at the Location of the finalize response, which CAs finalizing
+// asynchronously, like Pebble, leave out.
+type orderLocations struct {
+	next http.RoundTripper
+
+	mu     sync.Mutex
+	orders map[string]string // finalize URL -> order URL
+}
+
+func (t *orderLocations) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || req.Method != http.MethodPost {
+		return resp, err
+	}
+	t.mu.Lock()
+	orderURL, isFinalize := t.orders[req.URL.String()]
+	t.mu.Unlock()
+	location := resp.Header.Get("Location")
+	if isFinalize {
+		if location == "" {
+			resp.Header.Set("Location", orderURL)
+		}
+		return resp, nil
+	}
+	// Remember the finalize URL of new orders, which are returned with their Location
+	if location == "" || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return resp, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	var order struct {
+		Finalize string `json:"finalize"`
+	}
+	if err == nil && json.Unmarshal(body, &order) == nil && order.Finalize != "" {
+		t.mu.Lock()
+		t.orders[order.Finalize] = location
+		t.mu.Unlock()
+	}
+	return resp, nil
+}
@@ -9,13 +9,15 @@ import (
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"math/big"
+	"net"
 	"os"
 	"path/filepath"
 	"time"
 )
 
-// EnsureCert checks if cert and key exist, otherwise generates a self-signed certificate.
-func EnsureCert(certPath, keyPath string) (string, string, error) {
+// EnsureCert checks if cert and key exist, otherwise generates a self-signed certificate valid for hosts,
+// which may be DNS names (wildcards included) or IP addresses.
+func EnsureCert(certPath, keyPath string, hosts []string) (string, string, error) {
 	if certPath != "" && keyPath != "" {
 		if fileExists(certPath) && fileExists(keyPath) {
 			return certPath, keyPath, nil
@@ -57,7 +59,16 @@ func EnsureCert(certPath, keyPath string) (string, string, error) {
 		NotAfter:    notAfter,
 		KeyUsage:    x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		DNSNames:    []string{"*"},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if h != "" {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	if len(template.DNSNames) > 0 {
+		template.Subject.CommonName = template.DNSNames[0]
 	}
 
 	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
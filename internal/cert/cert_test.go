@@ -1,22 +1,26 @@
 package cert
 
 import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/config"
 )
 
 func TestEnsureCert(t *testing.T) {
-	certPath := "certs/test.crt"
-	keyPath := "certs/test.key"
-
-	// Cleanup before and after
-	os.Remove(certPath)
-	os.Remove(keyPath)
-	// defer os.Remove(certPath)
-	// defer os.Remove(keyPath)
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "test.crt")
+	keyPath := filepath.Join(dir, "test.key")
 
 	// Run
-	c, k, err := EnsureCert(certPath, keyPath)
+	c, k, err := EnsureCert(certPath, keyPath, []string{"example.com", "*.example.com", "127.0.0.1", "::1"})
 	if err != nil {
 		t.Fatalf("EnsureCert failed: %v", err)
 	}
@@ -28,4 +32,211 @@ func TestEnsureCert(t *testing.T) {
 	if _, err := os.Stat(k); err != nil {
 		t.Errorf("Key file not created: %s", k)
 	}
+
+	// Check SANs
+	pair, err := tls.LoadX509KeyPair(c, k)
+	if err != nil {
+		t.Fatalf("Generated pair does not load: %v", err)
+	}
+	leaf := pair.Leaf
+	for _, host := range []string{"example.com", "api.example.com", "127.0.0.1", "::1"} {
+		if err := leaf.VerifyHostname(host); err != nil {
+			t.Errorf("Certificate not valid for %s: %v", host, err)
+		}
+	}
+	if err := leaf.VerifyHostname("other.test"); err == nil {
+		t.Error("Certificate should not be valid for other.test")
+	}
+	if len(leaf.IPAddresses) != 2 || !leaf.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")) || leaf.Subject.CommonName != "example.com" {
+		t.Errorf("Unexpected SANs: %v %v", leaf.DNSNames, leaf.IPAddresses)
+	}
+
+	// Existing files are kept
+	before, _ := os.ReadFile(c)
+	if _, _, err := EnsureCert(certPath, keyPath, []string{"other.test"}); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(c); string(after) != string(before) {
+		t.Error("Existing certificate was replaced")
+	}
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "server.crt")
+	keyPath := filepath.Join(dir, "server.key")
+	if _, _, err := EnsureCert(certPath, keyPath, []string{"one.test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A warning window longer than the one year validity exercises the expiry check
+	r, err := NewReloader(certPath, keyPath, 400*24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewReloader failed: %v", err)
+	}
+	cert, _ := r.GetCertificate(nil)
+	if cert.Leaf.DNSNames[0] != "one.test" {
+		t.Fatalf("Unexpected certificate %v", cert.Leaf.DNSNames)
+	}
+	if certExpiry.Value(certPath) != float64(cert.Leaf.NotAfter.Unix()) {
+		t.Errorf("Expiry metric not set")
+	}
+	if r.lastWarning.IsZero() {
+		t.Errorf("Expected an expiry warning")
+	}
+
+	// Replace the files with a new certificate
+	os.Remove(certPath)
+	os.Remove(keyPath)
+	if _, _, err := EnsureCert(certPath, keyPath, []string{"two.test"}); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, future, future)
+	if !r.changed() {
+		t.Fatal("Expected the change to be detected")
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if cert, _ := r.GetCertificate(nil); cert.Leaf.DNSNames[0] != "two.test" {
+		t.Errorf("Certificate not reloaded: %v", cert.Leaf.DNSNames)
+	}
+
+	// An invalid file keeps the current certificate
+	os.WriteFile(certPath, []byte("garbage"), 0600)
+	if err := r.Reload(); err == nil {
+		t.Error("Expected reload of an invalid certificate to fail")
+	}
+	if cert, _ := r.GetCertificate(nil); cert.Leaf.DNSNames[0] != "two.test" {
+		t.Errorf("Certificate replaced by an invalid one")
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	certsDir := filepath.Join(dir, "certs")
+	pair := func(base string, hosts ...string) config.CertificateConfig {
+		c, k, err := EnsureCert(base+".crt", base+".key", hosts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config.CertificateConfig{CertFile: c, KeyFile: k}
+	}
+	def := pair(filepath.Join(dir, "default"), "default.test")
+	pair(filepath.Join(certsDir, "wildcard"), "*.example.com")
+	pair(filepath.Join(certsDir, "api"), "api.example.com")
+
+	s, err := NewStore([]config.CertificateConfig{def}, certsDir, time.Hour)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	if s.Len() != 3 {
+		t.Fatalf("Expected 3 certificates, got %d", s.Len())
+	}
+	tests := map[string]string{
+		"api.example.com":     "api.example.com",
+		"API.example.com.":    "api.example.com",
+		"www.example.com":     "*.example.com",
+		"a.b.example.com":     "default.test",
+		"example.com":         "default.test",
+		"default.test":        "default.test",
+		"":                    "default.test",
+		"unknown.example.org": "default.test",
+	}
+	for sni, want := range tests {
+		c, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: sni})
+		if err != nil || c.Leaf.DNSNames[0] != want {
+			t.Errorf("SNI %q: expected %s, got %v (%v)", sni, want, c.Leaf.DNSNames, err)
+		}
+	}
+	if !s.Covers("www.example.com") || s.Covers("example.org") {
+		t.Error("Unexpected coverage")
+	}
+
+	// Pairs added to or removed from the directory are picked up by a rescan
+	os.Remove(filepath.Join(certsDir, "api.crt"))
+	pair(filepath.Join(certsDir, "shop"), "shop.test")
+	s.scanDir()
+	if c, _ := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.example.com"}); c.Leaf.DNSNames[0] != "*.example.com" {
+		t.Errorf("Removed certificate still served: %v", c.Leaf.DNSNames)
+	}
+	if !s.Covers("shop.test") || s.Len() != 3 {
+		t.Errorf("Added certificate not served")
+	}
+}
+
+func TestACME_Fallback(t *testing.T) {
+	dir := t.TempDir()
+	c, k, err := EnsureCert(filepath.Join(dir, "selfsigned.crt"), filepath.Join(dir, "selfsigned.key"), []string{"acme.test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback, err := NewStore([]config.CertificateConfig{{CertFile: c, KeyFile: k}}, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A CA that cannot be reached
+	ca := httptest.NewServer(http.NotFoundHandler())
+	ca.Close()
+	a, err := NewACME(config.ACMEConfig{DirectoryURL: ca.URL + "/dir", CacheDir: filepath.Join(dir, "acme")}, []string{"acme.test"}, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		cert, err := a.GetCertificate(&tls.ClientHelloInfo{ServerName: "acme.test"})
+		if err != nil || cert.Leaf.DNSNames[0] != "acme.test" || cert.Leaf.Subject.Organization[0] != "Revproxy" {
+			t.Fatalf("Expected the self-signed fallback, got %v", err)
+		}
+	}
+	// The second handshake backs off instead of contacting the CA again
+	if n := acmeErrors.Value("acme.test"); n != 1 {
+		t.Errorf("Expected one failed issuance, got %v", n)
+	}
+	if cert, _ := a.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.test"}); cert == nil {
+		t.Error("Expected the fallback certificate for a host outside the ACME hosts")
+	}
+
+	// HTTP-01: unknown tokens are not found, other requests are redirected to HTTPS
+	h := a.HTTPHandler(nil)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://acme.test/.well-known/acme-challenge/unknown", nil))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown challenge token, got %d", rw.Code)
+	}
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://acme.test/api", nil))
+	if rw.Code != http.StatusFound || rw.Header().Get("Location") != "https://acme.test/api" {
+		t.Errorf("Expected a redirect to HTTPS, got %d %s", rw.Code, rw.Header().Get("Location"))
+	}
+}
+
+// TestACME_Pebble obtains a certificate from a local Pebble server started with PEBBLE_VA_ALWAYS_VALID=1,
+// e.g. REVPROXY_PEBBLE_DIRECTORY=https://localhost:14000/dir REVPROXY_PEBBLE_CA=test/certs/pebble.minica.pem
+func TestACME_Pebble(t *testing.T) {
+	directory, caFile := os.Getenv("REVPROXY_PEBBLE_DIRECTORY"), os.Getenv("REVPROXY_PEBBLE_CA")
+	if directory == "" || caFile == "" {
+		t.Skip("REVPROXY_PEBBLE_DIRECTORY and REVPROXY_PEBBLE_CA not set")
+	}
+	dir := t.TempDir()
+	fallback, err := NewStore(nil, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.ACMEConfig{DirectoryURL: directory, CAFile: caFile, CacheDir: dir, Email: "admin@acme.test"}
+	a, err := NewACME(cfg, []string{"acme.test"}, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := a.GetCertificate(&tls.ClientHelloInfo{ServerName: "acme.test"})
+	if err != nil || cert == nil || cert.Leaf == nil {
+		t.Fatalf("Expected a certificate from Pebble, got %v", err)
+	}
+	if cert.Leaf.DNSNames[0] != "acme.test" || !strings.Contains(cert.Leaf.Issuer.CommonName, "Pebble") {
+		t.Errorf("Unexpected certificate %v issued by %s", cert.Leaf.DNSNames, cert.Leaf.Issuer)
+	}
+	if stored, _ := filepath.Glob(filepath.Join(dir, "acme.test*")); len(stored) == 0 {
+		t.Errorf("Certificate not stored in the cache directory")
+	}
 }
@@ -0,0 +1,120 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abswn/revproxy-go/internal/metrics"
+)
+
+var certExpiry = metrics.NewGauge("revproxy_tls_certificate_expiry_timestamp_seconds",
+	"Unix time at which the served certificate expires.", "path")
+
+// Reloader serves a certificate loaded from files and reloads it when they change on disk.
+type Reloader struct {
+	certPath, keyPath string
+	expiryWarning     time.Duration
+
+	cert atomic.Pointer[tls.Certificate]
+
+	mu          sync.Mutex
+	modTimes    map[string]time.Time
+	lastWarning time.Time
+}
+
+// NewReloader loads the certificate pair, warning once it is within expiryWarning of its expiry.
+func NewReloader(certPath, keyPath string, expiryWarning time.Duration) (*Reloader, error) {
+	r := &Reloader{certPath: certPath, keyPath: keyPath, expiryWarning: expiryWarning}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate files, keeping the current certificate if they are invalid.
+func (r *Reloader) Reload() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range []string{r.certPath, r.keyPath} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("failed to parse certificate: %v", err)
+		}
+	}
+	r.cert.Store(&cert)
+
+	r.mu.Lock()
+	r.modTimes = modTimes
+	r.lastWarning = time.Time{}
+	r.mu.Unlock()
+	certExpiry.Set(float64(cert.Leaf.NotAfter.Unix()), r.certPath)
+	r.checkExpiry()
+	return nil
+}
+
+// GetCertificate returns the current certificate, for use as tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// reloadIfChanged reloads the certificate if its files changed, and checks its expiry otherwise.
+func (r *Reloader) reloadIfChanged() {
+	if !r.changed() {
+		r.checkExpiry()
+		return
+	}
+	if err := r.Reload(); err != nil {
+		log.Errorf("Failed to reload TLS certificate %s, keeping previous: %v", r.certPath, err)
+		return
+	}
+	log.Infof("Reloaded TLS certificate %s", r.certPath)
+}
+
+// changed reports whether a certificate file has a different modification time than at the last load.
+func (r *Reloader) changed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, file := range []string{r.certPath, r.keyPath} {
+		info, err := os.Stat(file)
+		if err == nil && !info.ModTime().Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkExpiry logs a warning, at most daily, once the certificate is close to or past its expiry.
+func (r *Reloader) checkExpiry() {
+	leaf := r.cert.Load().Leaf
+	left := time.Until(leaf.NotAfter)
+	if left > r.expiryWarning {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.lastWarning) < 24*time.Hour {
+		return
+	}
+	r.lastWarning = time.Now()
+	if left <= 0 {
+		log.Errorf("TLS certificate %s expired on %s", r.certPath, leaf.NotAfter.Format(time.RFC3339))
+		return
+	}
+	log.Warnf("TLS certificate %s expires on %s, in %d day(s)", r.certPath, leaf.NotAfter.Format(time.RFC3339), int(left.Hours()/24))
+}
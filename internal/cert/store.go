@@ -0,0 +1,174 @@
+package cert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+// Store serves several certificates, selected by the SNI name of the client.
+type Store struct {
+	pairs         []config.CertificateConfig // configured explicitly, always loaded
+	dir           string                     // scanned for <name>.crt/<name>.key pairs
+	expiryWarning time.Duration
+
+	mu        sync.RWMutex
+	reloaders []*Reloader // explicit pairs first, then the directory's in name order
+}
+
+// NewStore loads the given pairs and those found in dir. The first certificate is served to clients
+// without SNI or with a name no certificate covers.
+func NewStore(pairs []config.CertificateConfig, dir string, expiryWarning time.Duration) (*Store, error) {
+	s := &Store{pairs: pairs, dir: dir, expiryWarning: expiryWarning}
+	for _, p := range pairs {
+		r, err := NewReloader(p.CertFile, p.KeyFile, expiryWarning)
+		if err != nil {
+			return nil, err
+		}
+		s.reloaders = append(s.reloaders, r)
+	}
+	s.scanDir()
+	return s, nil
+}
+
+// Len returns the number of certificates served.
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.reloaders)
+}
+
+// dirPairs returns the certificate pairs in the store's directory, sorted by name.
+func (s *Store) dirPairs() []config.CertificateConfig {
+	if s.dir == "" {
+		return nil
+	}
+	certs, err := filepath.Glob(filepath.Join(s.dir, "*.crt"))
+	if err != nil {
+		return nil
+	}
+	sort.Strings(certs)
+	var pairs []config.CertificateConfig
+	for _, c := range certs {
+		key := strings.TrimSuffix(c, ".crt") + ".key"
+		if fileExists(key) {
+			pairs = append(pairs, config.CertificateConfig{CertFile: c, KeyFile: key})
+		}
+	}
+	return pairs
+}
+
+// scanDir loads pairs added to the directory and drops removed ones, keeping the explicit pairs.
+func (s *Store) scanDir() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := make(map[string]*Reloader)
+	for _, r := range s.reloaders[len(s.pairs):] {
+		current[r.certPath] = r
+	}
+	reloaders := s.reloaders[:len(s.pairs):len(s.pairs)]
+	for _, p := range s.dirPairs() {
+		if r, ok := current[p.CertFile]; ok {
+			reloaders = append(reloaders, r)
+			continue
+		}
+		r, err := NewReloader(p.CertFile, p.KeyFile, s.expiryWarning)
+		if err != nil {
+			log.Errorf("Failed to load TLS certificate %s: %v", p.CertFile, err)
+			continue
+		}
+		log.Infof("Loaded TLS certificate %s for %s", p.CertFile, strings.Join(names(r.cert.Load().Leaf), ", "))
+		reloaders = append(reloaders, r)
+	}
+	s.reloaders = reloaders
+}
+
+// StartReloadLoop starts a background goroutine that reloads changed certificates and rescans the directory.
+func (s *Store) StartReloadLoop(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.mu.RLock()
+			reloaders := s.reloaders
+			s.mu.RUnlock()
+			for _, r := range reloaders {
+				r.reloadIfChanged()
+			}
+			s.scanDir()
+		}
+	}()
+}
+
+// GetCertificate returns the certificate for the client's SNI name, for use as tls.Config.GetCertificate.
+// Exact names win over wildcards, and unknown names get the default certificate.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c := s.lookup(hello.ServerName); c != nil {
+		return c, nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.reloaders) == 0 {
+		return nil, nil
+	}
+	return s.reloaders[0].cert.Load(), nil
+}
+
+// Covers reports whether a certificate other than the default fallback is valid for host.
+func (s *Store) Covers(host string) bool {
+	return s.lookup(host) != nil
+}
+
+// lookup returns the certificate valid for name, or nil.
+func (s *Store) lookup(name string) *tls.Certificate {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var wildcard *tls.Certificate
+	for _, r := range s.reloaders {
+		c := r.cert.Load()
+		for _, n := range names(c.Leaf) {
+			n = strings.ToLower(n)
+			if n == name {
+				return c
+			}
+			if wildcard == nil && matchWildcard(n, name) {
+				wildcard = c
+			}
+		}
+	}
+	return wildcard
+}
+
+// matchWildcard reports whether pattern, like *.example.com, covers name with exactly one label.
+func matchWildcard(pattern, name string) bool {
+	suffix, ok := strings.CutPrefix(pattern, "*")
+	if !ok || !strings.HasPrefix(suffix, ".") {
+		return false
+	}
+	label, ok := strings.CutSuffix(name, suffix)
+	return ok && label != "" && !strings.Contains(label, ".")
+}
+
+// names returns the DNS names and IPs of a certificate, or its common name when it has no SANs.
+func names(leaf *x509.Certificate) []string {
+	names := append([]string{}, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = append(names, leaf.Subject.CommonName)
+	}
+	return names
+}
@@ -0,0 +1,222 @@
+// Shares one upstream call between identical in-flight GET requests of an endpoint.
+package coalesce
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/metrics"
+	"github.com/abswn/revproxy-go/internal/requestid"
+)
+
+var coalesceRequests = metrics.NewCounter("revproxy_coalesce_requests_total",
+	"Coalescable requests by endpoint and role (leader, follower, timeout, unshared).", "endpoint", "role")
+
+// Group tracks the in-flight calls of an endpoint.
+type Group struct {
+	endpoint    string
+	headers     []string
+	maxWait     time.Duration
+	maxBodySize int64
+
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// call is an upstream call whose response is shared once done is closed.
+type call struct {
+	done   chan struct{}
+	shared bool // the response is complete and may be sent to followers
+	status int
+	header http.Header
+	body   []byte
+}
+
+// New validates cfg and creates the coalescing group of an endpoint.
+func New(endpoint string, cfg config.CoalesceConfig) (*Group, error) {
+	if cfg.MaxWait < 0 || cfg.MaxBodySize < 0 {
+		return nil, fmt.Errorf("coalesce max_wait and max_body_size must not be negative")
+	}
+	g := &Group{
+		endpoint:    endpoint,
+		maxWait:     time.Duration(cfg.MaxWait * float64(time.Second)),
+		maxBodySize: cfg.MaxBodySize,
+		calls:       make(map[string]*call),
+	}
+	for _, h := range cfg.Headers {
+		g.headers = append(g.headers, http.CanonicalHeaderKey(h))
+	}
+	if g.maxWait == 0 {
+		g.maxWait = 10 * time.Second
+	}
+	if g.maxBodySize == 0 {
+		g.maxBodySize = 1 << 20
+	}
+	return g, nil
+}
+
+// key identifies identical requests by method, host, path, query and the configured headers.
+func (g *Group) key(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method + " " + strings.ToLower(r.Host) + r.URL.RequestURI())
+	for _, h := range g.headers {
+		b.WriteString("\n" + h + ": " + strings.Join(r.Header.Values(h), ", "))
+	}
+	return b.String()
+}
+
+// Middleware lets the first of identical GET requests call next and fans its response out to the
+// requests arriving while it is in flight. Followers that wait longer than max_wait, or whose
+// leader's response cannot be shared, call next themselves.
+func (g *Group) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next(w, r)
+			return
+		}
+		k := g.key(r)
+		g.mu.Lock()
+		if c, ok := g.calls[k]; ok {
+			g.mu.Unlock()
+			g.follow(c, next, w, r)
+			return
+		}
+		c := &call{done: make(chan struct{})}
+		g.calls[k] = c
+		g.mu.Unlock()
+
+		coalesceRequests.Inc(g.endpoint, "leader")
+		defer func() {
+			g.mu.Lock()
+			delete(g.calls, k)
+			g.mu.Unlock()
+			close(c.done)
+		}()
+		rec := &recorder{ResponseWriter: w, limit: g.maxBodySize, header: make(http.Header)}
+		next(rec, r)
+		rec.finish()
+
+		// A response cut short by the leader's client, too large or setting cookies is not shared
+		if r.Context().Err() != nil || rec.overflow || len(rec.header.Values("Set-Cookie")) > 0 {
+			return
+		}
+		c.status = rec.status
+		c.header = rec.header.Clone()
+		c.body = rec.body.Bytes()
+		c.shared = true
+	}
+}
+
+// follow waits for the leader's response and writes it, or calls next if it cannot be used.
+func (g *Group) follow(c *call, next http.HandlerFunc, w http.ResponseWriter, r *http.Request) {
+	timer := time.NewTimer(g.maxWait)
+	defer timer.Stop()
+	select {
+	case <-c.done:
+	case <-timer.C:
+		coalesceRequests.Inc(g.endpoint, "timeout")
+		requestid.Logger(r.Context()).Debugf("Gave up waiting for in-flight request to %s after %s", r.URL.Path, g.maxWait)
+		next(w, r)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	if !c.shared {
+		coalesceRequests.Inc(g.endpoint, "unshared")
+		next(w, r)
+		return
+	}
+	coalesceRequests.Inc(g.endpoint, "follower")
+	h := w.Header()
+	for name, values := range c.header {
+		h[name] = append([]string(nil), values...)
+	}
+	w.WriteHeader(c.status)
+	w.Write(c.body)
+}
+
+// recorder passes the leader's response through while keeping a copy of up to limit bytes. It
+// keeps the header next wrote in its own map, so that what outer middlewares change on the way
+// to the leader's client, such as a Content-Encoding, is not shared with followers.
+type recorder struct {
+	http.ResponseWriter
+	limit    int64
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rec *recorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *recorder) WriteHeader(code int) {
+	if rec.status != 0 {
+		return
+	}
+	rec.status = code
+	dst := rec.ResponseWriter.Header()
+	for name, values := range rec.header {
+		dst[name] = values
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.overflow {
+		if int64(rec.body.Len()+len(b)) > rec.limit {
+			rec.overflow = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// finish sends the status if next returned without writing anything, and passes on the trailers
+// next set after the body.
+func (rec *recorder) finish() {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+		return
+	}
+	dst := rec.ResponseWriter.Header()
+	for name, values := range rec.header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			dst[name] = values
+		}
+	}
+	for _, line := range rec.header.Values("Trailer") {
+		for _, name := range strings.Split(line, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if values, ok := rec.header[name]; ok {
+				dst[name] = values
+			}
+		}
+	}
+}
+
+// Flush lets streamed responses reach the client through the wrapper.
+func (rec *recorder) Flush() {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController.
+func (rec *recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
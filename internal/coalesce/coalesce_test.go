@@ -0,0 +1,209 @@
+package coalesce
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/compression"
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+// blockingBackend holds every call until release is closed.
+type blockingBackend struct {
+	calls   atomic.Int32
+	entered chan struct{}
+	release chan struct{}
+	respond func(w http.ResponseWriter, r *http.Request)
+}
+
+func newBlockingBackend() *blockingBackend {
+	return &blockingBackend{
+		entered: make(chan struct{}, 100),
+		release: make(chan struct{}),
+		respond: func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Backend", "1")
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte("shared"))
+		},
+	}
+}
+
+func (b *blockingBackend) serve(w http.ResponseWriter, r *http.Request) {
+	b.calls.Add(1)
+	b.entered <- struct{}{}
+	<-b.release
+	b.respond(w, r)
+}
+
+// start runs n requests built by newReq concurrently, the first alone until it reaches the backend.
+func start(t *testing.T, h http.HandlerFunc, b *blockingBackend, n int, newReq func(i int) *http.Request) ([]*httptest.ResponseRecorder, *sync.WaitGroup) {
+	recs := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			h(recs[i], newReq(i))
+		}(i)
+		if i == 0 {
+			<-b.entered
+		}
+	}
+	// Give the followers time to join the in-flight call
+	time.Sleep(50 * time.Millisecond)
+	return recs, &wg
+}
+
+func TestGroup_SharesInFlightCall(t *testing.T) {
+	g, err := New("/api", config.CoalesceConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newBlockingBackend()
+	recs, wg := start(t, g.Middleware(b.serve), b, 5, func(int) *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/api?q=1", nil)
+	})
+	close(b.release)
+	wg.Wait()
+
+	if n := b.calls.Load(); n != 1 {
+		t.Errorf("expected one upstream call, got %d", n)
+	}
+	for i, rw := range recs {
+		if rw.Code != http.StatusAccepted || rw.Body.String() != "shared" || rw.Header().Get("X-Backend") != "1" {
+			t.Errorf("request %d: unexpected response %d %q", i, rw.Code, rw.Body.String())
+		}
+	}
+}
+
+func TestGroup_KeyIncludesQueryAndHeaders(t *testing.T) {
+	g, _ := New("/api", config.CoalesceConfig{Headers: []string{"authorization"}})
+	b := newBlockingBackend()
+	_, wg := start(t, g.Middleware(b.serve), b, 4, func(i int) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/api", nil)
+		switch i {
+		case 1:
+			r.URL.RawQuery = "page=2"
+		case 2:
+			r.Header.Set("Authorization", "Bearer other")
+		case 3:
+			r.Header.Set("Accept", "text/plain") // not part of the key
+		}
+		return r
+	})
+	close(b.release)
+	wg.Wait()
+	if n := b.calls.Load(); n != 3 {
+		t.Errorf("expected three distinct upstream calls, got %d", n)
+	}
+}
+
+func TestGroup_FollowerGivesUpAfterMaxWait(t *testing.T) {
+	g, _ := New("/api", config.CoalesceConfig{MaxWait: 0.01})
+	b := newBlockingBackend()
+	h := g.Middleware(b.serve)
+	_, wg := start(t, h, b, 2, func(int) *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/api", nil)
+	})
+	close(b.release)
+	wg.Wait()
+	if n := b.calls.Load(); n != 2 {
+		t.Errorf("expected the follower to make its own call, got %d calls", n)
+	}
+}
+
+func TestGroup_NotShared(t *testing.T) {
+	tests := map[string]struct {
+		cfg     config.CoalesceConfig
+		respond func(w http.ResponseWriter, r *http.Request)
+	}{
+		"cookie": {config.CoalesceConfig{}, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Set-Cookie", "session=leader")
+		}},
+		"too large": {config.CoalesceConfig{MaxBodySize: 2}, func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("large"))
+		}},
+	}
+	for name, tc := range tests {
+		g, _ := New("/api", tc.cfg)
+		b := newBlockingBackend()
+		b.respond = tc.respond
+		_, wg := start(t, g.Middleware(b.serve), b, 2, func(int) *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/api", nil)
+		})
+		close(b.release)
+		wg.Wait()
+		if n := b.calls.Load(); n != 2 {
+			t.Errorf("%s: expected the follower to make its own call, got %d calls", name, n)
+		}
+	}
+}
+
+func TestGroup_OnlyGET(t *testing.T) {
+	g, _ := New("/api", config.CoalesceConfig{})
+	b := newBlockingBackend()
+	_, wg := start(t, g.Middleware(b.serve), b, 2, func(int) *http.Request {
+		return httptest.NewRequest(http.MethodPost, "/api", nil)
+	})
+	close(b.release)
+	wg.Wait()
+	if n := b.calls.Load(); n != 2 {
+		t.Errorf("expected POST requests not to be coalesced, got %d calls", n)
+	}
+}
+
+func TestGroup_BehindCompression(t *testing.T) {
+	g, _ := New("/api", config.CoalesceConfig{})
+	c, err := compression.New(config.CompressionConfig{Encodings: []string{"gzip"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := strings.Repeat("shared ", 500)
+	b := newBlockingBackend()
+	b.respond = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(large))
+	}
+	// The leader accepts gzip, the first follower does not and the second does
+	recs, wg := start(t, c.Middleware(g.Middleware(b.serve)), b, 3, func(i int) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/api", nil)
+		if i != 1 {
+			r.Header.Set("Accept-Encoding", "gzip")
+		}
+		return r
+	})
+	close(b.release)
+	wg.Wait()
+
+	if n := b.calls.Load(); n != 1 {
+		t.Fatalf("expected one upstream call, got %d", n)
+	}
+	for i, rw := range recs {
+		body := rw.Body.String()
+		if enc := rw.Header().Get("Content-Encoding"); i == 1 && enc != "" {
+			t.Errorf("request %d: expected a plain response, got Content-Encoding %q", i, enc)
+		} else if i != 1 {
+			if enc != "gzip" {
+				t.Errorf("request %d: expected a gzip response, got Content-Encoding %q", i, enc)
+				continue
+			}
+			zr, err := gzip.NewReader(rw.Body)
+			if err != nil {
+				t.Fatalf("request %d: %v", i, err)
+			}
+			plain, _ := io.ReadAll(zr)
+			body = string(plain)
+		}
+		if body != large {
+			t.Errorf("request %d: unexpected body of %d bytes", i, len(body))
+		}
+	}
+}
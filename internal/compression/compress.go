@@ -0,0 +1,251 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+// defaultContentTypes are compressed when no allow-list is configured.
+var defaultContentTypes = []string{
+	"text/*", "application/json", "application/javascript", "application/xml",
+	"application/x-ndjson", "application/graphql-response+json", "image/svg+xml",
+}
+
+// Compressor compresses the responses of an endpoint.
+type Compressor struct {
+	encodings    []string
+	contentTypes []string
+	minSize      int
+}
+
+// New validates cfg and creates the compressor of an endpoint.
+func New(cfg config.CompressionConfig) (*Compressor, error) {
+	c := &Compressor{encodings: cfg.Encodings, contentTypes: cfg.ContentTypes, minSize: cfg.MinSize}
+	if len(c.encodings) == 0 {
+		c.encodings = []string{"zstd", "br", "gzip"}
+	}
+	for i, enc := range c.encodings {
+		enc = strings.ToLower(enc)
+		switch enc {
+		case "zstd", "br", "gzip":
+		default:
+			return nil, fmt.Errorf("unsupported compression encoding '%s'", enc)
+		}
+		c.encodings[i] = enc
+	}
+	if len(c.contentTypes) == 0 {
+		c.contentTypes = defaultContentTypes
+	}
+	if c.minSize < 0 {
+		return nil, fmt.Errorf("compression min_size must not be negative")
+	}
+	if c.minSize == 0 {
+		c.minSize = 1024
+	}
+	return c, nil
+}
+
+// negotiate returns the preferred configured encoding the client accepts, or "".
+func (c *Compressor) negotiate(acceptEncoding string) string {
+	accepted := make(map[string]bool)
+	wildcard := false
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		ok := true
+		if _, q, found := strings.Cut(params, "q="); found {
+			if v, err := strconv.ParseFloat(strings.TrimSpace(q), 64); err == nil && v <= 0 {
+				ok = false
+			}
+		}
+		if name == "*" {
+			wildcard = ok
+			continue
+		}
+		accepted[name] = ok
+	}
+	for _, enc := range c.encodings {
+		if ok, listed := accepted[enc]; ok || (!listed && wildcard) {
+			return enc
+		}
+	}
+	return ""
+}
+
+// allowed reports whether responses of contentType are compressed.
+func (c *Compressor) allowed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.contentTypes {
+		t = strings.ToLower(t)
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware compresses responses that the backend sent uncompressed, when the client accepts
+// one of the configured encodings and the content type and size qualify.
+func (c *Compressor) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encoding := c.negotiate(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, c: c, encoding: encoding}
+		next(cw, r)
+		cw.Close()
+	}
+}
+
+// compressWriter decides at the first write whether to compress. Responses without a known
+// length are buffered up to minSize before the decision.
+type compressWriter struct {
+	http.ResponseWriter
+	c        *Compressor
+	encoding string
+
+	status  int
+	decided bool
+	buf     bytes.Buffer
+	enc     io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.status == 0 {
+		cw.status = code
+	}
+}
+
+// eligible reports whether the response may be compressed, ignoring its size.
+func (cw *compressWriter) eligible() bool {
+	h := cw.Header()
+	switch {
+	case cw.status < 200, cw.status == http.StatusNoContent, cw.status == http.StatusNotModified,
+		cw.status == http.StatusPartialContent:
+		return false
+	case h.Get("Content-Encoding") != "" && !strings.EqualFold(h.Get("Content-Encoding"), "identity"):
+		return false
+	case strings.Contains(strings.ToLower(h.Get("Cache-Control")), "no-transform"):
+		return false
+	}
+	return cw.c.allowed(h.Get("Content-Type"))
+}
+
+// decide starts the response, compressed or not, once enough is known about it.
+func (cw *compressWriter) decide(compress bool) {
+	cw.decided = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	h := cw.Header()
+	if compress || cw.eligible() {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if compress {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", cw.encoding)
+		// The compressed representation is no longer byte-for-byte identical
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		cw.enc = newEncoder(cw.encoding, cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if cw.buf.Len() > 0 {
+		cw.write(cw.buf.Bytes())
+		cw.buf.Reset()
+	}
+}
+
+func (cw *compressWriter) write(b []byte) (int, error) {
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if cw.decided {
+		return cw.write(b)
+	}
+	if !cw.eligible() {
+		cw.decide(false)
+		return cw.write(b)
+	}
+	if n, err := strconv.Atoi(cw.Header().Get("Content-Length")); err == nil {
+		cw.decide(n >= cw.c.minSize)
+		return cw.write(b)
+	}
+	cw.buf.Write(b)
+	if cw.buf.Len() >= cw.c.minSize {
+		cw.decide(true)
+	}
+	return len(b), nil
+}
+
+// Flush sends what has been buffered so far, compressed if the response qualifies by then.
+// Before any body was written there is nothing to send, and the decision is left to the body.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if cw.buf.Len() == 0 {
+			return
+		}
+		cw.decide(cw.eligible() && cw.buf.Len() >= cw.c.minSize)
+	}
+	if f, ok := cw.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the response: short buffered responses are sent uncompressed.
+func (cw *compressWriter) Close() {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		cw.decide(false)
+	}
+	if cw.enc != nil {
+		cw.enc.Close()
+	}
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// newEncoder returns a writer compressing into w with encoding.
+func newEncoder(encoding string, w io.Writer) io.WriteCloser {
+	switch encoding {
+	case "zstd":
+		enc, _ := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return enc
+	case "br":
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression)
+	default:
+		return gzip.NewWriter(w)
+	}
+}
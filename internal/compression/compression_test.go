@@ -0,0 +1,172 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+// encode compresses data with encoding.
+func encode(t *testing.T, encoding string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	default:
+		w = newEncoder(encoding, &buf)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	text := []byte("Please try after some time. " + strings.Repeat("padding ", 100))
+	for _, enc := range []string{"gzip", "br", "zstd", "deflate"} {
+		got := Decode(enc, encode(t, enc, text), 30)
+		if string(got) != string(text[:30]) {
+			t.Errorf("%s: got %q", enc, got)
+		}
+	}
+	// Stacked encodings are undone in reverse order
+	stacked := encode(t, "br", encode(t, "gzip", text))
+	if got := Decode("gzip, br", stacked, 10); string(got) != "Please try" {
+		t.Errorf("stacked: got %q", got)
+	}
+	if got := Decode("", text, 6); string(got) != "Please" {
+		t.Errorf("identity: got %q", got)
+	}
+	if got := Decode("gzip", []byte("not gzip"), 100); string(got) != "not gzip" {
+		t.Errorf("corrupt: expected body as is, got %q", got)
+	}
+}
+
+// decode fully decompresses a response body for assertions.
+func decode(t *testing.T, encoding string, body []byte) string {
+	var r io.Reader
+	var err error
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		r, err = zstd.NewReader(bytes.NewReader(body))
+	default:
+		return string(body)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestMiddleware(t *testing.T) {
+	large := strings.Repeat(`{"message":"hello"}`, 100)
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		contentType    string
+		contentLength  bool
+		contentEnc     string
+		body           string
+		want           string // expected Content-Encoding
+	}{
+		{"preferred zstd", "gzip, br, zstd", "application/json", false, "", large, "zstd"},
+		{"br", "gzip, br", "application/json; charset=utf-8", false, "", large, "br"},
+		{"q zero", "gzip, br;q=0", "text/html", true, "", large, "gzip"},
+		{"wildcard", "*", "text/plain", false, "", large, "zstd"},
+		{"none accepted", "identity", "application/json", false, "", large, ""},
+		{"small", "gzip", "application/json", false, "", `{"a":1}`, ""},
+		{"small known length", "gzip", "application/json", true, "", `{"a":1}`, ""},
+		{"type not allowed", "gzip", "image/png", false, "", large, ""},
+		{"already encoded", "gzip", "application/json", false, "gzip", large, "gzip"},
+	}
+	c, err := New(config.CompressionConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range tests {
+		h := c.Middleware(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tc.contentType)
+			w.Header().Set("ETag", `"abc"`)
+			if tc.contentLength {
+				w.Header().Set("Content-Length", strconv.Itoa(len(tc.body)))
+			}
+			if tc.contentEnc != "" {
+				w.Header().Set("Content-Encoding", tc.contentEnc)
+			}
+			// Write in small chunks like a streamed backend response
+			for i := 0; i < len(tc.body); i += 100 {
+				w.Write([]byte(tc.body[i:min(i+100, len(tc.body))]))
+			}
+		})
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		rw := httptest.NewRecorder()
+		h(rw, r)
+
+		got := rw.Header().Get("Content-Encoding")
+		if got != tc.want {
+			t.Errorf("%s: expected Content-Encoding %q, got %q", tc.name, tc.want, got)
+			continue
+		}
+		if tc.contentEnc == "" && decode(t, got, rw.Body.Bytes()) != tc.body {
+			t.Errorf("%s: body does not round-trip", tc.name)
+		}
+		if tc.contentEnc == "" && got != "" {
+			if rw.Header().Get("Content-Length") != "" || rw.Header().Get("ETag") != `W/"abc"` || rw.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("%s: unexpected headers %v", tc.name, rw.Header())
+			}
+		}
+	}
+}
+
+func TestMiddleware_FlushBeforeBody(t *testing.T) {
+	c, err := New(config.CompressionConfig{Encodings: []string{"gzip"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := strings.Repeat(`{"message":"hello"}`, 100)
+	// A streamed response flushes its header before the body of unknown length
+	h := c.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		w.Write([]byte(large))
+	})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rw := httptest.NewRecorder()
+	h(rw, r)
+	if got := rw.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("expected Content-Encoding gzip, got %q", got)
+	}
+	if decode(t, "gzip", rw.Body.Bytes()) != large {
+		t.Error("body does not round-trip")
+	}
+}
+
+func TestNew_InvalidEncoding(t *testing.T) {
+	if _, err := New(config.CompressionConfig{Encodings: []string{"lzma"}}); err == nil {
+		t.Error("expected error for unsupported encoding")
+	}
+}
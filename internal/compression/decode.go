@@ -0,0 +1,71 @@
+// Decodes compressed response bodies for inspection and compresses responses for clients.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Upper bound on an intermediate layer of a stacked encoding, guarding against decompression bombs
+const maxIntermediate = 1 << 20
+
+// Decode returns up to limit bytes of body decoded according to a Content-Encoding header value.
+// Bodies with an unknown encoding are returned as is; a truncated or corrupt body yields what
+// could be decoded.
+func Decode(contentEncoding string, body []byte, limit int) []byte {
+	encodings := strings.Split(contentEncoding, ",")
+	// Encodings are listed in the order they were applied, so undo them from last to first
+	for i := len(encodings) - 1; i >= 0; i-- {
+		r, closer := decoder(strings.ToLower(strings.TrimSpace(encodings[i])), body)
+		if r == nil {
+			continue
+		}
+		// Outer layers can only be decoded from a complete inner stream
+		n := limit
+		if i > 0 {
+			n = maxIntermediate
+		}
+		decoded, _ := io.ReadAll(io.LimitReader(r, int64(n)))
+		if closer != nil {
+			closer()
+		}
+		body = decoded
+	}
+	if len(body) > limit {
+		body = body[:limit]
+	}
+	return body
+}
+
+// decoder returns a reader decoding body, or nil for identity and unknown encodings.
+func decoder(encoding string, body []byte) (io.Reader, func()) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, nil
+		}
+		return r, func() { r.Close() }
+	case "deflate":
+		r, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, nil
+		}
+		return r, func() { r.Close() }
+	case "br":
+		return brotli.NewReader(bytes.NewReader(body)), nil
+	case "zstd":
+		r, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil
+		}
+		return r, r.Close
+	}
+	return nil, nil
+}
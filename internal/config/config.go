@@ -2,13 +2,23 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
+
+	"github.com/abswn/revproxy-go/internal/grpcstatus"
 )
 
 // LogConfig holds logging settings from the main config.
@@ -18,21 +28,496 @@ type LogConfig struct {
 	Format string `yaml:"format"`
 }
 
+// AccessLogConfig configures the per-request access log, written apart from the application log.
+type AccessLogConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Output  string `yaml:"output,omitempty"` // "stdout" or a file path like "logs/access.log"
+	Format  string `yaml:"format,omitempty"` // "json" (default), "logfmt" or "combined"
+	// Rotation of the output file, defaults to 100 MB, 5 backups, 30 days and compressed backups
+	MaxSize    int   `yaml:"max_size,omitempty"` // megabytes
+	MaxBackups int   `yaml:"max_backups,omitempty"`
+	MaxAge     int   `yaml:"max_age,omitempty"` // days
+	Compress   *bool `yaml:"compress,omitempty"`
+}
+
+// RequestIDConfig controls the ID attached to every request to correlate client errors with log lines.
+type RequestIDConfig struct {
+	Header string `yaml:"header,omitempty"` // defaults to X-Request-ID
+	Format string `yaml:"format,omitempty"` // "uuidv7" (default) or "ulid"
+	// AcceptIncoming keeps a valid ID sent by the client in Header instead of generating one
+	AcceptIncoming bool `yaml:"accept_incoming,omitempty"`
+}
+
+// TracingConfig configures OpenTelemetry tracing exported over OTLP.
+type TracingConfig struct {
+	Enabled     bool              `yaml:"enabled"`
+	Endpoint    string            `yaml:"endpoint,omitempty"` // collector host:port, defaults to the OTLP exporter default
+	Protocol    string            `yaml:"protocol,omitempty"` // "grpc" (default) or "http"
+	Insecure    bool              `yaml:"insecure,omitempty"` // disable TLS to the collector
+	Headers     map[string]string `yaml:"headers,omitempty"`
+	ServiceName string            `yaml:"service_name,omitempty"` // defaults to revproxy-go
+	// SampleRatio of new traces recorded, 0-1, defaults to 1. Requests with a sampled parent are always recorded.
+	SampleRatio *float64 `yaml:"sample_ratio,omitempty"`
+}
+
+// AccessControlConfig defines CIDR based allow and deny lists, evaluated with longest-prefix matching.
+type AccessControlConfig struct {
+	Allow     []string `yaml:"allow,omitempty"`
+	Deny      []string `yaml:"deny,omitempty"`
+	AllowFile string   `yaml:"allow_file,omitempty"` // one CIDR or IP per line
+	DenyFile  string   `yaml:"deny_file,omitempty"`
+	// Status returned to rejected clients, defaults to 403
+	Status int `yaml:"status,omitempty"`
+	// ReloadInterval in seconds between checks of the list files for changes, 0 disables reloading
+	ReloadInterval int `yaml:"reload_interval,omitempty"`
+}
+
+// MetricsConfig controls the Prometheus text format metrics endpoint.
+type MetricsConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path,omitempty"` // defaults to /metrics
+}
+
+// LimitsConfig bounds the size of requests and responses and the time spent on them. In config.yaml
+// it sets the defaults, which an endpoint's limits override field by field. Timeouts are in seconds;
+// zero values leave a limit at its default, which is unlimited unless noted.
+type LimitsConfig struct {
+	// MaxRequestBody in bytes, larger request bodies are rejected with 413
+	MaxRequestBody int64 `yaml:"max_request_body,omitempty"`
+	// MaxResponseBody in bytes, larger backend responses are answered with 502, or cut off once streaming
+	MaxResponseBody int64 `yaml:"max_response_body,omitempty"`
+	// ReadTimeout for reading the request body, a client sending it slower gets 408
+	ReadTimeout float64 `yaml:"read_timeout,omitempty"`
+	// ConnectTimeout for connecting to a backend, SOCKS5 tunnel included. Defaults to 10, 504 beyond
+	ConnectTimeout float64 `yaml:"connect_timeout,omitempty"`
+	// TTFBTimeout from sending the request until the backend's response headers arrive, 504 beyond
+	TTFBTimeout float64 `yaml:"ttfb_timeout,omitempty"`
+	// Timeout for the whole upstream exchange, response body included. Defaults to 60, 504 beyond
+	Timeout float64 `yaml:"timeout,omitempty"`
+	// IdleTimeout of kept-alive connections: to clients in config.yaml (defaults to 120), to backends per endpoint
+	IdleTimeout float64 `yaml:"idle_timeout,omitempty"`
+	// Server-wide only: size of the request headers (defaults to 1 MiB, 431 beyond), time allowed to
+	// read them (defaults to 10) and to write a response (unlimited, as it also caps streaming)
+	MaxHeaderBytes    int     `yaml:"max_header_bytes,omitempty"`
+	ReadHeaderTimeout float64 `yaml:"read_header_timeout,omitempty"`
+	WriteTimeout      float64 `yaml:"write_timeout,omitempty"`
+}
+
+// Seconds converts a configured number of seconds, returning def for zero.
+func Seconds(s float64, def time.Duration) time.Duration {
+	if s == 0 {
+		return def
+	}
+	return time.Duration(s * float64(time.Second))
+}
+
+// Override returns the limits of an endpoint: l with the non-zero fields of o, if any, taking
+// precedence. IdleTimeout is only taken from o, l's applies to client connections.
+func (l LimitsConfig) Override(o *LimitsConfig) LimitsConfig {
+	l.IdleTimeout = 0
+	if o == nil {
+		return l
+	}
+	if o.MaxRequestBody != 0 {
+		l.MaxRequestBody = o.MaxRequestBody
+	}
+	if o.MaxResponseBody != 0 {
+		l.MaxResponseBody = o.MaxResponseBody
+	}
+	if o.ReadTimeout != 0 {
+		l.ReadTimeout = o.ReadTimeout
+	}
+	if o.ConnectTimeout != 0 {
+		l.ConnectTimeout = o.ConnectTimeout
+	}
+	if o.TTFBTimeout != 0 {
+		l.TTFBTimeout = o.TTFBTimeout
+	}
+	if o.Timeout != 0 {
+		l.Timeout = o.Timeout
+	}
+	if o.IdleTimeout != 0 {
+		l.IdleTimeout = o.IdleTimeout
+	}
+	return l
+}
+
+// validate rejects negative limits, and the server-wide ones when they are set for an endpoint.
+func (l LimitsConfig) validate(endpoint bool) error {
+	if l.MaxRequestBody < 0 || l.MaxResponseBody < 0 || l.MaxHeaderBytes < 0 || l.ReadTimeout < 0 || l.ConnectTimeout < 0 ||
+		l.TTFBTimeout < 0 || l.Timeout < 0 || l.IdleTimeout < 0 || l.ReadHeaderTimeout < 0 || l.WriteTimeout < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	if endpoint && (l.MaxHeaderBytes != 0 || l.ReadHeaderTimeout != 0 || l.WriteTimeout != 0) {
+		return fmt.Errorf("limits.max_header_bytes, read_header_timeout and write_timeout can only be set in config.yaml")
+	}
+	return nil
+}
+
+// CertificateConfig is a PEM certificate (chain) and key pair served by the proxy.
+type CertificateConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// ACMEConfig obtains and renews certificates from an ACME CA such as Let's Encrypt, using the
+// HTTP-01 and TLS-ALPN-01 challenges.
+type ACMEConfig struct {
+	Email string `yaml:"email,omitempty"` // contact for expiry notices from the CA
+	// DirectoryURL of the CA, defaults to Let's Encrypt production
+	DirectoryURL string `yaml:"directory_url,omitempty"`
+	// CAFile is a PEM bundle trusted for the directory's HTTPS, e.g. the root of a local Pebble server
+	CAFile string `yaml:"ca_file,omitempty"`
+	// Hosts certificates are requested for, defaults to the non-wildcard hosts of the endpoint files
+	Hosts []string `yaml:"hosts,omitempty"`
+	// CacheDir stores account keys and certificates, defaults to certs/acme
+	CacheDir string `yaml:"cache_dir,omitempty"`
+	// RenewBefore in days before expiry at which certificates are renewed, defaults to 30
+	RenewBefore int `yaml:"renew_before,omitempty"`
+	// HTTPAddr answers HTTP-01 challenges and redirects other requests to HTTPS, defaults to ":80"
+	HTTPAddr string `yaml:"http_addr,omitempty"`
+	// RetryAfter in seconds before issuance is retried for a host after a failure, defaults to 600
+	RetryAfter int `yaml:"retry_after,omitempty"`
+}
+
+// ClientAuthConfig authenticates clients by their TLS certificate (mTLS).
+type ClientAuthConfig struct {
+	// Verify is "none" (default), "optional" (verified when presented) or "required"
+	Verify string `yaml:"verify,omitempty"`
+	// CAFile is the PEM bundle client certificates must chain to. Endpoints default to the listener's
+	CAFile string `yaml:"ca_file,omitempty"`
+	// AllowedCNs and AllowedSANs restrict the accepted certificates by subject common name or by any
+	// DNS, email, URI or IP SAN. Entries may be glob patterns like "*.svc.internal". Empty allows all
+	AllowedCNs  []string `yaml:"allowed_cns,omitempty"`
+	AllowedSANs []string `yaml:"allowed_sans,omitempty"`
+	// ForwardHeader, if set, carries the verified identity (the CN, or the first SAN) to the backends.
+	// Values sent by clients in this header are always removed
+	ForwardHeader string `yaml:"forward_header,omitempty"`
+}
+
+// Validate checks the verify mode and that a CA is given when certificates are verified.
+func (c *ClientAuthConfig) Validate(requireCA bool) error {
+	switch c.Verify {
+	case "", "none", "optional", "required":
+	default:
+		return fmt.Errorf("client_auth.verify must be none, optional or required")
+	}
+	if requireCA && c.CAFile == "" && (c.Verify == "optional" || c.Verify == "required") {
+		return fmt.Errorf("client_auth.ca_file is required to verify client certificates")
+	}
+	return nil
+}
+
+// ServerTLSConfig controls how the server obtains the certificate it serves.
+type ServerTLSConfig struct {
+	// Mode is one of:
+	//   "files" (default): serve https_cert_path/https_key_path if both exist and the certificates
+	//                      below, plain HTTP when there are none
+	//   "required": like files, but refuse to start without a certificate
+	//   "self-signed": like files, generating a self-signed certificate at those paths when missing
+	//   "acme": obtain certificates from an ACME CA, falling back to the self-signed and listed ones
+	//   "off": plain HTTP
+	Mode string `yaml:"mode,omitempty"`
+	// Hosts are DNS names and IPs added to a generated certificate, besides the endpoint hosts and localhost
+	Hosts []string `yaml:"hosts,omitempty"`
+	// Certificates and the <name>.crt/<name>.key pairs in CertificatesDir are served in addition to
+	// https_cert_path/https_key_path, chosen by the SNI name of the client. The first one is the default.
+	Certificates    []CertificateConfig `yaml:"certificates,omitempty"`
+	CertificatesDir string              `yaml:"certificates_dir,omitempty"`
+	ACME            ACMEConfig          `yaml:"acme,omitempty"`
+	// ClientAuth verifies client certificates during the TLS handshake, for all endpoints
+	ClientAuth ClientAuthConfig `yaml:"client_auth,omitempty"`
+	// ReloadInterval in seconds between checks of the certificate files for changes, defaults to 60
+	ReloadInterval int `yaml:"reload_interval,omitempty"`
+	// ExpiryWarning in days before the certificate expires from which warnings are logged, defaults to 30
+	ExpiryWarning int `yaml:"expiry_warning,omitempty"`
+}
+
+// ListenerConfig is one address the server accepts connections on.
+type ListenerConfig struct {
+	// Name identifies the listener in logs, defaults to the address
+	Name string `yaml:"name,omitempty"`
+	// Address is "host:port", ":port" or "unix:/path/to/socket"
+	Address string `yaml:"address"`
+	// TLS serves HTTPS with the certificates of the tls section
+	TLS bool `yaml:"tls,omitempty"`
+	// ClientAuth replaces tls.client_auth on this listener; its ca_file defaults to the global one
+	ClientAuth *ClientAuthConfig `yaml:"client_auth,omitempty"`
+	// RedirectHTTPS answers every request with a permanent redirect to https on RedirectPort (default 443)
+	RedirectHTTPS bool `yaml:"redirect_https,omitempty"`
+	RedirectPort  int  `yaml:"redirect_port,omitempty"`
+	// H2C accepts cleartext HTTP/2 with prior knowledge besides HTTP/1.1 on a plain listener
+	H2C bool `yaml:"h2c,omitempty"`
+	// HTTP3 also serves HTTP/3 over QUIC on the UDP port of a TLS listener's address and advertises it
+	// with Alt-Svc
+	HTTP3 bool `yaml:"http3,omitempty"`
+	// Endpoints restricts the listener to the endpoints whose keys match one of these glob patterns.
+	// The metrics path is served if it matches too. Empty serves everything
+	Endpoints []string `yaml:"endpoints,omitempty"`
+}
+
+// validate checks a listener's address, redirect settings and endpoint patterns.
+func (l *ListenerConfig) validate() error {
+	if l.Address == "" || l.Address == "unix:" {
+		return fmt.Errorf("address must be specified")
+	}
+	if !strings.HasPrefix(l.Address, "unix:") {
+		if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			return fmt.Errorf("invalid address %q: %v", l.Address, err)
+		}
+	}
+	if l.RedirectHTTPS && l.TLS {
+		return fmt.Errorf("redirect_https is only for plain HTTP listeners")
+	}
+	if l.H2C && l.TLS {
+		return fmt.Errorf("h2c is only for plain HTTP listeners, HTTP/2 is negotiated over TLS")
+	}
+	if l.HTTP3 && (!l.TLS || strings.HasPrefix(l.Address, "unix:")) {
+		return fmt.Errorf("http3 requires a TLS listener on a host:port address")
+	}
+	if l.RedirectPort < 0 || l.RedirectPort > 65535 {
+		return fmt.Errorf("redirect_port must be a valid port")
+	}
+	for _, p := range l.Endpoints {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid endpoint pattern %q: %v", p, err)
+		}
+	}
+	if l.ClientAuth != nil {
+		return l.ClientAuth.Validate(false)
+	}
+	return nil
+}
+
 // MainConfig represents the contents of config.yaml.
 type MainConfig struct {
-	Port          int       `yaml:"port"`
-	HTTPSCertPath string    `yaml:"https_cert_path"`
-	HTTPSKeyPath  string    `yaml:"https_key_path"`
-	Log           LogConfig `yaml:"log"`
+	// Port is the single listener used when Listeners is empty, serving HTTPS if a certificate is available
+	Port          int                  `yaml:"port"`
+	Listeners     []ListenerConfig     `yaml:"listeners,omitempty"`
+	HTTPSCertPath string               `yaml:"https_cert_path"`
+	HTTPSKeyPath  string               `yaml:"https_key_path"`
+	TLS           ServerTLSConfig      `yaml:"tls,omitempty"`
+	Log           LogConfig            `yaml:"log"`
+	AccessLog     AccessLogConfig      `yaml:"access_log,omitempty"`
+	RequestID     RequestIDConfig      `yaml:"request_id,omitempty"`
+	Tracing       TracingConfig        `yaml:"tracing,omitempty"`
+	AccessControl *AccessControlConfig `yaml:"access_control,omitempty"`
+	// TrustedProxies lists the CIDRs whose X-Forwarded-For header is trusted for the client IP
+	TrustedProxies []string      `yaml:"trusted_proxies,omitempty"`
+	Metrics        MetricsConfig `yaml:"metrics,omitempty"`
+	Limits         LimitsConfig  `yaml:"limits,omitempty"`
 }
 
 // URLConfig defines a single backend URL and optional proxy/auth settings.
 type URLConfig struct {
-	URL      string `yaml:"url"`
+	URL string `yaml:"url"`
+	// Proxy tunnels connections to the backend through socks5://, socks5h://, http:// or https://
+	// proxies, with credentials in the URL's user info
+	Proxy string `yaml:"proxy,omitempty"`
+	// ProxyTLS customizes how https proxies are verified
+	ProxyTLS *UpstreamTLSConfig `yaml:"proxy_tls,omitempty"`
+	// ProxyPool sends the requests through the exits of a pool of proxies.yaml instead of a single proxy
+	ProxyPool string `yaml:"proxy_pool,omitempty"`
+	// Socks5, Username and Password are the older form of a socks5h:// proxy
 	Socks5   string `yaml:"socks5,omitempty"`
 	Username string `yaml:"username,omitempty"`
 	Password string `yaml:"password,omitempty"`
 	Weight   int    `yaml:"weight,omitempty"`
+	Canary   bool   `yaml:"canary,omitempty"` // part of the endpoint's canary subset
+	// TLS customizes how https backends are verified and which client certificate is presented
+	TLS *UpstreamTLSConfig `yaml:"tls,omitempty"`
+	// Protocol is "auto" (default: HTTP/2 if negotiated via ALPN over TLS, else HTTP/1.1), "h1",
+	// "h2" (HTTP/2 over TLS only) or "h2c" (cleartext HTTP/2 with prior knowledge)
+	Protocol string `yaml:"protocol,omitempty"`
+	// DNS controls how the host is resolved, and may expand it into one target per DNS record
+	DNS *DNSConfig `yaml:"dns,omitempty"`
+}
+
+// BanKey identifies the target in ban tracking: its URL, plus the address it is pinned to if any,
+// so that every resolved address of a discovered host is banned on its own.
+func (u *URLConfig) BanKey() string {
+	if u.DNS != nil && u.DNS.Resolve != "" {
+		return u.URL + "@" + u.DNS.Resolve
+	}
+	return u.URL
+}
+
+// validate checks the backend's TLS and proxy settings and that its protocol suits the URL scheme.
+func (u *URLConfig) validate() error {
+	if u.TLS != nil {
+		if err := u.TLS.Validate(); err != nil {
+			return err
+		}
+	}
+	if u.Proxy != "" && u.Socks5 != "" {
+		return fmt.Errorf("proxy and socks5 cannot be combined")
+	}
+	if u.ProxyPool != "" && (u.Proxy != "" || u.Socks5 != "") {
+		return fmt.Errorf("proxy_pool cannot be combined with proxy or socks5")
+	}
+	proxyURL, err := u.ProxyURL()
+	if err != nil {
+		return err
+	}
+	if u.DNS != nil {
+		if err := u.DNS.validate(); err != nil {
+			return err
+		}
+	}
+	if u.ProxyTLS != nil {
+		if proxyURL == nil || proxyURL.Scheme != "https" {
+			return fmt.Errorf("proxy_tls needs an https:// proxy")
+		}
+		if err := u.ProxyTLS.Validate(); err != nil {
+			return fmt.Errorf("proxy_%v", err)
+		}
+	}
+	https := strings.HasPrefix(strings.ToLower(u.URL), "https://")
+	switch u.Protocol {
+	case "", "auto", "h1":
+	case "h2":
+		if !https {
+			return fmt.Errorf("protocol h2 needs an https URL, use h2c for cleartext HTTP/2")
+		}
+	case "h2c":
+		if https {
+			return fmt.Errorf("protocol h2c needs an http URL, use h2 over TLS")
+		}
+	default:
+		return fmt.Errorf("protocol must be auto, h1, h2 or h2c")
+	}
+	return nil
+}
+
+// Default ports of the proxy schemes
+var proxyPorts = map[string]string{
+	"socks5":  "1080",
+	"socks5h": "1080",
+	"http":    "80",
+	"https":   "443",
+}
+
+// ProxyURL returns the proxy connections to the backend go through, nil if they are direct. The
+// socks5 field maps to socks5h://, as the proxy has always resolved the backend's name. The port
+// defaults to the scheme's.
+func (u *URLConfig) ProxyURL() (*url.URL, error) {
+	if u.Socks5 != "" {
+		p := &url.URL{Scheme: "socks5h", Host: u.Socks5}
+		if u.Username != "" || u.Password != "" {
+			p.User = url.UserPassword(u.Username, u.Password)
+		}
+		return p, nil
+	}
+	if u.Proxy == "" {
+		return nil, nil
+	}
+	p, err := url.Parse(u.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy: %v", err)
+	}
+	p.Scheme = strings.ToLower(p.Scheme)
+	port, ok := proxyPorts[p.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("proxy must be a socks5://, socks5h://, http:// or https:// URL")
+	}
+	if p.Hostname() == "" || (p.Path != "" && p.Path != "/") || p.RawQuery != "" {
+		return nil, fmt.Errorf("proxy must be of the form %s://[user:password@]host[:port]", p.Scheme)
+	}
+	if p.Port() == "" {
+		p.Host = net.JoinHostPort(p.Hostname(), port)
+	}
+	p.Path = ""
+	return p, nil
+}
+
+// DNSConfig controls how a backend's host is resolved. With a DNS setting, names are resolved
+// locally and proxies receive addresses.
+type DNSConfig struct {
+	// Resolve pins the host to this IP address, like curl's --resolve
+	Resolve string `yaml:"resolve,omitempty"`
+	// Server is a DNS server, "host" or "host:port", queried instead of the system resolver
+	Server string `yaml:"server,omitempty"`
+	// Prefer is "ipv4" or "ipv6": those addresses are tried first, and only those are discovered
+	// when the host has any
+	Prefer string `yaml:"prefer,omitempty"`
+	// Discover expands the URL into one target per record: "a" for the A and AAAA records of its
+	// host, "srv" for the SRV records named by its host, such as _http._tcp.api.internal
+	Discover string `yaml:"discover,omitempty"`
+	// TTL is how often, in seconds, discovered targets are resolved again. Defaults to 30
+	TTL int `yaml:"ttl,omitempty"`
+}
+
+// validate checks the pin, server address and options.
+func (d *DNSConfig) validate() error {
+	if d.Resolve != "" && net.ParseIP(d.Resolve) == nil {
+		return fmt.Errorf("dns.resolve must be an IP address")
+	}
+	if d.Server != "" {
+		if host, _, err := net.SplitHostPort(d.ServerAddress()); err != nil || host == "" {
+			return fmt.Errorf("invalid dns.server %q", d.Server)
+		}
+	}
+	switch d.Prefer {
+	case "", "ipv4", "ipv6":
+	default:
+		return fmt.Errorf("dns.prefer must be ipv4 or ipv6")
+	}
+	switch d.Discover {
+	case "", "a", "srv":
+	default:
+		return fmt.Errorf("dns.discover must be a or srv")
+	}
+	if d.Discover != "" && d.Resolve != "" {
+		return fmt.Errorf("dns.discover and dns.resolve cannot be combined")
+	}
+	if d.TTL < 0 {
+		return fmt.Errorf("dns.ttl cannot be negative")
+	}
+	return nil
+}
+
+// ServerAddress returns Server with the default port 53 if it has none.
+func (d *DNSConfig) ServerAddress() string {
+	if _, _, err := net.SplitHostPort(d.Server); err == nil {
+		return d.Server
+	}
+	return net.JoinHostPort(strings.Trim(d.Server, "[]"), "53")
+}
+
+// UpstreamTLSConfig configures TLS towards a backend, directly or through its SOCKS5 proxy.
+type UpstreamTLSConfig struct {
+	// CAFile is a PEM bundle trusted instead of the system roots
+	CAFile string `yaml:"ca_file,omitempty"`
+	// CertFile and KeyFile are the PEM client certificate and key presented to backends requiring mTLS
+	CertFile string `yaml:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty"`
+	// ServerName is sent as SNI and verified instead of the URL's host
+	ServerName string `yaml:"server_name,omitempty"`
+	// InsecureSkipVerify accepts any backend certificate; pins are still checked
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify,omitempty"`
+	// MinVersion is "1.0", "1.1", "1.2" or "1.3", defaults to 1.2
+	MinVersion string `yaml:"min_version,omitempty"`
+	// PinnedSPKI lists base64 SHA-256 hashes of accepted public keys (SubjectPublicKeyInfo). The leaf
+	// or, when verified, any certificate of its chain must match one of them.
+	PinnedSPKI []string `yaml:"pinned_spki,omitempty"`
+}
+
+// Validate checks the TLS settings that can be checked without reading files.
+func (t *UpstreamTLSConfig) Validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	switch t.MinVersion {
+	case "", "1.0", "1.1", "1.2", "1.3":
+	default:
+		return fmt.Errorf("tls.min_version must be 1.0, 1.1, 1.2 or 1.3")
+	}
+	for _, pin := range t.PinnedSPKI {
+		if b, err := base64.StdEncoding.DecodeString(pin); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("tls.pinned_spki entry '%s' is not a base64 SHA-256 hash", pin)
+		}
+	}
+	return nil
 }
 
 // BanRule defines the matching words and the duration of ban for backend URLs.
@@ -41,16 +526,179 @@ type BanRuleRaw struct {
 	Duration int      `yaml:"duration"`
 }
 
+// AuthConfig defines how clients must authenticate before an endpoint is served.
+// Type selects the scheme: "api_key", "basic" or "jwt".
+type AuthConfig struct {
+	Type string `yaml:"type"`
+	// Header carrying the credentials. Defaults to X-API-Key for api_key and Authorization otherwise.
+	Header string `yaml:"header,omitempty"`
+	// api_key: newline separated keys in a file and/or comma separated keys in an environment variable
+	KeysFile string `yaml:"keys_file,omitempty"`
+	KeysEnv  string `yaml:"keys_env,omitempty"`
+	// basic: htpasswd file (bcrypt, {SHA} and $apr1$ hashes)
+	HtpasswdFile string `yaml:"htpasswd_file,omitempty"`
+	Realm        string `yaml:"realm,omitempty"`
+	// jwt: local JWKS file, accepted algorithms and claim checks
+	JWKSFile   string            `yaml:"jwks_file,omitempty"`
+	Algorithms []string          `yaml:"algorithms,omitempty"`
+	Issuer     string            `yaml:"issuer,omitempty"`
+	Audience   string            `yaml:"audience,omitempty"`
+	Claims     map[string]string `yaml:"claims,omitempty"`
+	Leeway     int               `yaml:"leeway,omitempty"` // in seconds
+}
+
+// RouteConfig defines how requests are matched to an endpoint beyond its path.
+// Exactly one of Path, Regex or Glob is used; Path defaults to the endpoint key when it starts with "/".
+type RouteConfig struct {
+	// Path matches exactly, or as a prefix when it ends with "/"
+	Path string `yaml:"path,omitempty"`
+	// Regex matches the whole request path; named groups are available to URL templates as {name}
+	Regex string `yaml:"regex,omitempty"`
+	// Glob matches the request path with * (one segment), ** (any segments) and {name} (named segment)
+	Glob    string   `yaml:"glob,omitempty"`
+	Methods []string `yaml:"methods,omitempty"`
+	// Headers and Query must match the given value, an empty value only requires presence
+	Headers map[string]string `yaml:"headers,omitempty"`
+	Query   map[string]string `yaml:"query,omitempty"`
+	// Priority orders overlapping routes, higher first
+	Priority int `yaml:"priority,omitempty"`
+}
+
+// Signature returns a normalized description of the requests matched by the route, ignoring priority.
+func (rc RouteConfig) Signature() string {
+	methods := append([]string{}, rc.Methods...)
+	sort.Strings(methods)
+	pairs := func(m map[string]string) string {
+		var kv []string
+		for k, v := range m {
+			kv = append(kv, k+"="+v)
+		}
+		sort.Strings(kv)
+		return strings.Join(kv, "&")
+	}
+	return fmt.Sprintf("path=%s regex=%s glob=%s methods=%s headers=%s query=%s",
+		rc.Path, rc.Regex, rc.Glob, strings.Join(methods, ","), pairs(rc.Headers), pairs(rc.Query))
+}
+
+// MirrorConfig defines a secondary pool that receives asynchronous copies of an endpoint's requests.
+// Mirror responses are discarded and never ban backends of the primary pool.
+type MirrorConfig struct {
+	Percentage float64     `yaml:"percentage"` // share of requests copied, 0-100
+	Strategy   string      `yaml:"strategy,omitempty"`
+	URLs       []URLConfig `yaml:"urls"`
+	Timeout    int         `yaml:"timeout,omitempty"` // in seconds, defaults to 10
+	// MaxConcurrent caps in-flight mirror requests, excess copies are dropped. Defaults to 50
+	MaxConcurrent int `yaml:"max_concurrent,omitempty"`
+	// MaxBodyBytes is the largest request body that is copied, larger requests are not mirrored. Defaults to 1 MiB
+	MaxBodyBytes int64 `yaml:"max_body_bytes,omitempty"`
+}
+
+// CanaryConfig splits an endpoint's traffic between its canary URLs and the remaining stable URLs.
+type CanaryConfig struct {
+	// Percentage of clients sent to the canary until the first schedule step
+	Percentage float64 `yaml:"percentage"`
+	// Requests carrying Header (with HeaderValue if set) or Cookie (with CookieValue if set) always go to the canary
+	Header      string `yaml:"header,omitempty"`
+	HeaderValue string `yaml:"header_value,omitempty"`
+	Cookie      string `yaml:"cookie,omitempty"`
+	CookieValue string `yaml:"cookie_value,omitempty"`
+	// StickyHeader keys the sticky split on this header's value instead of the client IP when present
+	StickyHeader string          `yaml:"sticky_header,omitempty"`
+	Schedule     []CanaryStep    `yaml:"schedule,omitempty"`
+	Rollback     *CanaryRollback `yaml:"rollback,omitempty"`
+}
+
+// CanaryStep sets the canary percentage once After seconds have passed since startup.
+type CanaryStep struct {
+	After      int     `yaml:"after"`
+	Percentage float64 `yaml:"percentage"`
+}
+
+// CanaryRollback disables the canary when its error rate exceeds ErrorRate (0-1) within Window seconds.
+type CanaryRollback struct {
+	ErrorRate   float64 `yaml:"error_rate"`
+	Window      int     `yaml:"window,omitempty"`       // in seconds, defaults to 60
+	MinRequests int     `yaml:"min_requests,omitempty"` // defaults to 20
+}
+
+// CacheConfig enables an HTTP cache for the GET and HEAD requests of an endpoint.
+// Cache-Control, Expires and Vary of the backend responses are honoured.
+type CacheConfig struct {
+	// TTL in seconds for responses without freshness information, 0 only caches responses that allow it
+	TTL int `yaml:"ttl,omitempty"`
+	// MaxTTL in seconds caps the freshness granted by response headers, 0 leaves it uncapped
+	MaxTTL int `yaml:"max_ttl,omitempty"`
+	// Seconds a stale response may be served while it is revalidated in the background, or while
+	// the backends fail. Used unless the response sets its own stale-while-revalidate/stale-if-error.
+	StaleWhileRevalidate int `yaml:"stale_while_revalidate,omitempty"`
+	StaleIfError         int `yaml:"stale_if_error,omitempty"`
+	// MaxSize of the in-memory LRU in bytes, defaults to 64 MiB
+	MaxSize int64 `yaml:"max_size,omitempty"`
+	// MaxEntrySize in bytes, larger responses are not cached. Defaults to 1 MiB
+	MaxEntrySize int64 `yaml:"max_entry_size,omitempty"`
+	// Dir enables on-disk storage behind the in-memory LRU, bounded by MaxDiskSize (defaults to 1 GiB)
+	Dir         string `yaml:"dir,omitempty"`
+	MaxDiskSize int64  `yaml:"max_disk_size,omitempty"`
+}
+
+// CoalesceConfig lets identical in-flight GET requests of an endpoint share one upstream call.
+type CoalesceConfig struct {
+	// Headers whose values are part of the key in addition to method, path and query, e.g. Authorization
+	Headers []string `yaml:"headers,omitempty"`
+	// MaxWait in seconds a request waits for the shared call before making its own, defaults to 10
+	MaxWait float64 `yaml:"max_wait,omitempty"`
+	// MaxBodySize in bytes of a response that is shared, defaults to 1 MiB
+	MaxBodySize int64 `yaml:"max_body_size,omitempty"`
+}
+
+// CompressionConfig compresses uncompressed backend responses for clients that accept it.
+type CompressionConfig struct {
+	// Encodings in order of preference, from "zstd", "br" and "gzip". Defaults to all three in that order
+	Encodings []string `yaml:"encodings,omitempty"`
+	// ContentTypes that are compressed; entries ending in "/*" match a whole type. Defaults to common text types
+	ContentTypes []string `yaml:"content_types,omitempty"`
+	// MinSize in bytes below which responses are sent uncompressed, defaults to 1024
+	MinSize int `yaml:"min_size,omitempty"`
+}
+
 // strategyConfig defines a stategy, a slice of backend URLs to use for the strategy and the ban rules.
 type StrategyConfig struct {
-	Strategy    string       `yaml:"strategy"`
-	URLs        []URLConfig  `yaml:"urls"`
+	Strategy string      `yaml:"strategy"`
+	URLs     []URLConfig `yaml:"urls"`
+	// ProxyPool is the default proxy_pool of the URLs without a proxy of their own
+	ProxyPool   string       `yaml:"proxy_pool,omitempty"`
 	BanRulesRaw []BanRuleRaw `yaml:"ban,omitempty"`
+	Auth        *AuthConfig  `yaml:"auth,omitempty"`
+	// AccessControl applies in addition to the global access_control lists
+	AccessControl *AccessControlConfig `yaml:"access_control,omitempty"`
+	// Route adds matching on methods, headers, query parameters and regex/glob paths
+	Route *RouteConfig `yaml:"route,omitempty"`
+	// Mirror copies a share of the traffic to a secondary pool
+	Mirror *MirrorConfig `yaml:"mirror,omitempty"`
+	// Canary splits the traffic between the URLs marked canary and the others
+	Canary *CanaryConfig `yaml:"canary,omitempty"`
+	// Cache answers repeatable requests without selecting a backend
+	Cache *CacheConfig `yaml:"cache,omitempty"`
+	// Coalesce shares one upstream call between identical concurrent requests
+	Coalesce *CoalesceConfig `yaml:"coalesce,omitempty"`
+	// Compression compresses responses the backends send uncompressed
+	Compression *CompressionConfig `yaml:"compression,omitempty"`
+	// Limits overrides the size limits and timeouts of config.yaml
+	Limits *LimitsConfig `yaml:"limits,omitempty"`
+	// ClientAuth requires or verifies client certificates for this endpoint
+	ClientAuth *ClientAuthConfig `yaml:"client_auth,omitempty"`
+	// Protocol is "http" (default) or "grpc", which speaks HTTP/2 to the backends and reports
+	// errors as gRPC status trailers
+	Protocol string `yaml:"protocol,omitempty"`
 }
 
-// EndpointsConfig represents all endpoints in a config file keyed by their paths.
+// EndpointsConfig represents all endpoints in a config file keyed by their paths, or by
+// route names for endpoints whose route defines the path.
 type EndpointsConfig struct {
-	Enabled           bool                      `yaml:"enabled"`
+	Enabled bool `yaml:"enabled"`
+	// Hosts the endpoints are served for, exact ("example.com") or wildcard ("*.example.com").
+	// Files without hosts form the default virtual host.
+	Hosts             []string                  `yaml:"hosts,omitempty"`
 	EndpointsMap      map[string]StrategyConfig `yaml:"endpoints"`
 	GlobalBanRulesRaw []BanRuleRaw              `yaml:"global_ban"`
 }
@@ -75,9 +723,20 @@ func LoadMainConfig(path string) (*MainConfig, error) {
 
 // Validate checks for required fields in MainConfig.
 func (c *MainConfig) Validate() error {
-	if c.Port == 0 {
+	if c.Port == 0 && len(c.Listeners) == 0 {
 		return fmt.Errorf("port must be specified and non-zero")
 	}
+	addresses := make(map[string]bool)
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("invalid listener %d: %v", i, err)
+		}
+		if addresses[l.Address] {
+			return fmt.Errorf("duplicate listener address %s", l.Address)
+		}
+		addresses[l.Address] = true
+	}
 	if c.Log.Level == "" {
 		return fmt.Errorf("log.level must be specified")
 	}
@@ -87,6 +746,43 @@ func (c *MainConfig) Validate() error {
 	if c.Log.Format == "" {
 		return fmt.Errorf("log.format must be specified")
 	}
+	switch c.AccessLog.Format {
+	case "", "json", "logfmt", "combined":
+	default:
+		return fmt.Errorf("access_log.format must be json, logfmt or combined")
+	}
+	switch c.RequestID.Format {
+	case "", "uuidv7", "ulid":
+	default:
+		return fmt.Errorf("request_id.format must be uuidv7 or ulid")
+	}
+	switch c.Tracing.Protocol {
+	case "", "grpc", "http":
+	default:
+		return fmt.Errorf("tracing.protocol must be grpc or http")
+	}
+	if r := c.Tracing.SampleRatio; r != nil && (*r < 0 || *r > 1) {
+		return fmt.Errorf("tracing.sample_ratio must be between 0 and 1")
+	}
+	switch c.TLS.Mode {
+	case "", "off", "files", "self-signed", "required", "acme":
+	default:
+		return fmt.Errorf("tls.mode must be off, files, self-signed, required or acme")
+	}
+	if err := c.TLS.ClientAuth.Validate(true); err != nil {
+		return fmt.Errorf("tls.%v", err)
+	}
+	if c.TLS.ACME.RenewBefore < 0 || c.TLS.ACME.RetryAfter < 0 {
+		return fmt.Errorf("tls.acme.renew_before and retry_after must not be negative")
+	}
+	for _, c := range c.TLS.Certificates {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return fmt.Errorf("tls.certificates entries need cert_file and key_file")
+		}
+	}
+	if err := c.Limits.validate(false); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -98,12 +794,26 @@ type BanRuleClean struct {
 
 // Contains the flattened banrules
 type StrategyConfigClean struct {
-	Strategy string
-	URLs     []URLConfig
-	BanRules []BanRuleClean
+	Host          string // empty for the default virtual host
+	Route         RouteConfig
+	Strategy      string
+	URLs          []URLConfig
+	BanRules      []BanRuleClean
+	Auth          *AuthConfig
+	AccessControl *AccessControlConfig
+	Mirror        *MirrorConfig
+	Canary        *CanaryConfig
+	Cache         *CacheConfig
+	Coalesce      *CoalesceConfig
+	Compression   *CompressionConfig
+	Limits        *LimitsConfig
+	ClientAuth    *ClientAuthConfig
+	Protocol      string
 }
 
 // Loads all YAML files (except config.yaml) with enabled: true.
+// Endpoints of the default virtual host are keyed by path or route name, the others by
+// host + path or route name + "@" + host.
 func LoadEnabledEndpointsMap(dir string) (map[string]StrategyConfigClean, error) {
 	entries, err := os.ReadDir(dir)
 	if err != nil {
@@ -111,6 +821,7 @@ func LoadEnabledEndpointsMap(dir string) (map[string]StrategyConfigClean, error)
 	}
 
 	configs := make(map[string]StrategyConfigClean)
+	signatures := make(map[string]string) // host + route signature -> endpoint key
 	for _, entry := range entries {
 		if entry.IsDir() || entry.Name() == "config.yaml" || filepath.Ext(entry.Name()) != ".yaml" {
 			continue
@@ -129,17 +840,89 @@ func LoadEnabledEndpointsMap(dir string) (map[string]StrategyConfigClean, error)
 
 		var cfg EndpointsConfig
 		if err := yaml.Unmarshal(data, &cfg); err == nil && cfg.Enabled {
-			for path, strat := range cfg.EndpointsMap {
-				if _, exists := configs[path]; exists {
-					return nil, fmt.Errorf("duplicate endpoint path found: %s", path)
+			hosts, err := normalizeHosts(cfg.Hosts)
+			if err != nil {
+				return nil, fmt.Errorf("invalid hosts in %s: %v", fullPath, err)
+			}
+			for name, strat := range cfg.EndpointsMap {
+				route, err := resolveRoute(name, strat.Route)
+				if err != nil {
+					return nil, fmt.Errorf("invalid endpoint %s in %s: %v", name, fullPath, err)
+				}
+				if err := applyProtocol(&strat); err != nil {
+					return nil, fmt.Errorf("invalid endpoint %s in %s: %v", name, fullPath, err)
+				}
+				for i := range strat.URLs {
+					u := &strat.URLs[i]
+					if strat.ProxyPool != "" && u.Proxy == "" && u.Socks5 == "" && u.ProxyPool == "" {
+						u.ProxyPool = strat.ProxyPool
+					}
+					if err := u.validate(); err != nil {
+						return nil, fmt.Errorf("invalid endpoint %s in %s: urls[%d]: %v", name, fullPath, i, err)
+					}
+				}
+				// Mirror URLs take no endpoint proxy_pool: copies are sent once, without exit selection
+				if strat.Mirror != nil {
+					for i := range strat.Mirror.URLs {
+						u := &strat.Mirror.URLs[i]
+						err := u.validate()
+						switch {
+						case err != nil:
+						case u.ProxyPool != "":
+							err = fmt.Errorf("proxy_pool is not supported for mirror urls")
+						case u.DNS != nil && u.DNS.Discover != "":
+							err = fmt.Errorf("dns.discover is not supported for mirror urls")
+						}
+						if err != nil {
+							return nil, fmt.Errorf("invalid endpoint %s in %s: mirror.urls[%d]: %v", name, fullPath, i, err)
+						}
+					}
 				}
-				clean := StrategyConfigClean{
-					Strategy: strat.Strategy,
-					URLs:     strat.URLs,
-					BanRules: flattenBanRules(strat.BanRulesRaw),
+				if strat.ClientAuth != nil {
+					if err := strat.ClientAuth.Validate(false); err != nil {
+						return nil, fmt.Errorf("invalid endpoint %s in %s: %v", name, fullPath, err)
+					}
+				}
+				if strat.Limits != nil {
+					if err := strat.Limits.validate(true); err != nil {
+						return nil, fmt.Errorf("invalid endpoint %s in %s: %v", name, fullPath, err)
+					}
+				}
+				for _, host := range hosts {
+					key := endpointKey(host, name)
+					if _, exists := configs[key]; exists {
+						return nil, fmt.Errorf("duplicate endpoint path found: %s", key)
+					}
+					signature := host + " " + route.Signature()
+					if other, exists := signatures[signature]; exists {
+						return nil, fmt.Errorf("duplicate endpoint route found: %s matches the same requests as %s", key, other)
+					}
+					signatures[signature] = key
+					clean := StrategyConfigClean{
+						Host:          host,
+						Route:         route,
+						Strategy:      strat.Strategy,
+						URLs:          strat.URLs,
+						BanRules:      flattenBanRules(strat.BanRulesRaw),
+						Auth:          strat.Auth,
+						AccessControl: strat.AccessControl,
+						Mirror:        strat.Mirror,
+						Canary:        strat.Canary,
+						Cache:         strat.Cache,
+						Coalesce:      strat.Coalesce,
+						Compression:   strat.Compression,
+						Limits:        strat.Limits,
+						ClientAuth:    strat.ClientAuth,
+						Protocol:      strat.Protocol,
+					}
+					applyGlobalBanRules(&clean, cfg.GlobalBanRulesRaw)
+					for _, rule := range clean.BanRules {
+						if _, _, err := grpcstatus.ParseRule(rule.Match); err != nil {
+							return nil, fmt.Errorf("invalid endpoint %s in %s: %v", name, fullPath, err)
+						}
+					}
+					configs[key] = clean
 				}
-				applyGlobalBanRules(&clean, cfg.GlobalBanRulesRaw)
-				configs[path] = clean
 			}
 		} else if err != nil {
 			return nil, fmt.Errorf("failed to parse endpoint config %s: %v", entry.Name(), err)
@@ -149,6 +932,130 @@ func LoadEnabledEndpointsMap(dir string) (map[string]StrategyConfigClean, error)
 	return configs, nil
 }
 
+// Helper function for LoadEnabledEndpointsMap - builds the key of an endpoint on a host.
+func endpointKey(host, name string) string {
+	if host == "" {
+		return name
+	}
+	if strings.HasPrefix(name, "/") {
+		return host + name
+	}
+	return name + "@" + host
+}
+
+// Helper function for LoadEnabledEndpointsMap - validates and normalizes the route of an endpoint.
+// Endpoints keyed by a path use it as their route path unless the route defines one.
+func resolveRoute(name string, raw *RouteConfig) (RouteConfig, error) {
+	var route RouteConfig
+	if raw != nil {
+		route = *raw
+	}
+	if route.Path == "" && route.Regex == "" && route.Glob == "" {
+		if !strings.HasPrefix(name, "/") {
+			return route, fmt.Errorf("route path, regex or glob must be specified for named endpoints")
+		}
+		route.Path = name
+	}
+	defined := 0
+	for _, pattern := range []string{route.Path, route.Regex, route.Glob} {
+		if pattern != "" {
+			defined++
+		}
+	}
+	if defined > 1 {
+		return route, fmt.Errorf("only one of route path, regex or glob may be specified")
+	}
+	if route.Path != "" && !strings.HasPrefix(route.Path, "/") {
+		return route, fmt.Errorf("route path must start with /")
+	}
+	if route.Glob != "" && !strings.HasPrefix(route.Glob, "/") {
+		return route, fmt.Errorf("route glob must start with /")
+	}
+	if route.Regex != "" {
+		if _, err := regexp.Compile(route.Regex); err != nil {
+			return route, fmt.Errorf("invalid route regex: %v", err)
+		}
+	}
+	for i, method := range route.Methods {
+		route.Methods[i] = strings.ToUpper(strings.TrimSpace(method))
+	}
+	if len(route.Headers) > 0 {
+		headers := make(map[string]string, len(route.Headers))
+		for k, v := range route.Headers {
+			headers[http.CanonicalHeaderKey(k)] = v
+		}
+		route.Headers = headers
+	}
+	return route, nil
+}
+
+// Helper function for LoadEnabledEndpointsMap - lowercases and validates the hosts of a file.
+// A file without hosts yields the single empty host of the default virtual host.
+func normalizeHosts(hosts []string) ([]string, error) {
+	if len(hosts) == 0 {
+		return []string{""}, nil
+	}
+	seen := make(map[string]bool)
+	var normalized []string
+	for _, host := range hosts {
+		host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+		name := strings.TrimPrefix(host, "*.")
+		if name == "" || strings.ContainsAny(name, "*/: ") {
+			return nil, fmt.Errorf("invalid host '%s'", host)
+		}
+		if seen[host] {
+			return nil, fmt.Errorf("host '%s' listed twice", host)
+		}
+		seen[host] = true
+		normalized = append(normalized, host)
+	}
+	return normalized, nil
+}
+
+// Helper function for LoadEnabledEndpointsMap - checks the endpoint protocol. gRPC needs HTTP/2 end to
+// end, so its URLs default to h2 for https and h2c for http.
+func applyProtocol(strat *StrategyConfig) error {
+	switch strat.Protocol {
+	case "", "http":
+		return nil
+	case "grpc":
+	default:
+		return fmt.Errorf("protocol must be http or grpc")
+	}
+	urls, err := grpcURLs(strat.URLs)
+	if err != nil {
+		return fmt.Errorf("urls%v", err)
+	}
+	strat.URLs = urls
+	if strat.Mirror != nil {
+		mirror := *strat.Mirror
+		if mirror.URLs, err = grpcURLs(mirror.URLs); err != nil {
+			return fmt.Errorf("mirror.urls%v", err)
+		}
+		strat.Mirror = &mirror
+	}
+	return nil
+}
+
+// Helper function for applyProtocol - returns copies of the URLs of a gRPC endpoint with their protocol set.
+// Errors start with the index of the offending URL.
+func grpcURLs(in []URLConfig) ([]URLConfig, error) {
+	urls := make([]URLConfig, len(in))
+	for i, u := range in {
+		switch u.Protocol {
+		case "", "auto":
+			u.Protocol = "h2c"
+			if strings.HasPrefix(strings.ToLower(u.URL), "https://") {
+				u.Protocol = "h2"
+			}
+		case "h1":
+			return nil, fmt.Errorf("[%d]: gRPC needs HTTP/2, protocol h1 is not supported", i)
+		}
+		urls[i] = u
+	}
+	return urls, nil
+}
+
 // Helper function for LoadEnabledEndpointsMap - flatten the Ban rules to be inserted into StrategyConfigClean data structure
 func flattenBanRules(rules []BanRuleRaw) []BanRuleClean {
 	var flat []BanRuleClean
@@ -188,30 +1095,24 @@ func hasBanRule(clean *StrategyConfigClean, word string) bool {
 	return false
 }
 
-// Find duplicate endpoint within same file, returns duplicate endpoint path
+// Find duplicate endpoint within same file, returns duplicate endpoint key quoted as "/path":.
+// The YAML decoder silently keeps the last of repeated mapping keys, so the raw endpoints
+// mapping is walked in order to catch them.
 func findDuplicateEndpointWithinFile(data []byte) string {
-	text := string(data)
-
-	// Remove comments from # to end of line
-	lines := strings.Split(text, "\n")
-	for i, line := range lines {
-		if idx := strings.Index(line, "#"); idx != -1 {
-			lines[i] = line[:idx]
-		}
+	var doc struct {
+		Endpoints yaml.MapSlice `yaml:"endpoints"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return ""
 	}
-	cleaned := strings.Join(lines, "\n")
-
-	// Find all occurrences of "/word":
-	re := regexp.MustCompile(`"(/[\w\d]+)":`)
-	matches := re.FindAllStringSubmatch(cleaned, -1)
 
 	seen := make(map[string]bool)
-	for _, match := range matches {
-		word := match[0] // full match like "/abc":
-		if seen[word] {
-			return word
+	for _, item := range doc.Endpoints {
+		key := fmt.Sprint(item.Key)
+		if seen[key] {
+			return `"` + key + `":`
 		}
-		seen[word] = true
+		seen[key] = true
 	}
 
 	return ""
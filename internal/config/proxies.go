@@ -0,0 +1,107 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ProxiesConfig represents the contents of proxies.yaml.
+type ProxiesConfig struct {
+	Pools map[string]ProxyPoolConfig `yaml:"pools"`
+}
+
+// ProxyPoolConfig is a named set of proxies that backend URLs leave through, each request taking
+// one exit of the pool.
+type ProxyPoolConfig struct {
+	// Strategy picks the exit of each request: round-robin (default), random or sticky
+	Strategy string `yaml:"strategy,omitempty"`
+	// StickyHeader keys the sticky strategy on this header's value instead of the client IP when present
+	StickyHeader string `yaml:"sticky_header,omitempty"`
+	// Retries is how many other exits are tried after an exit fails to connect or its response
+	// status triggers a ban rule
+	Retries int `yaml:"retries,omitempty"`
+	// MaxFailures consecutive connection failures bench an exit for BenchDuration seconds.
+	// Default to 3 and 30
+	MaxFailures   int `yaml:"max_failures,omitempty"`
+	BenchDuration int `yaml:"bench_duration,omitempty"`
+	// Exits are the proxies of the pool
+	Exits []ProxyExitConfig `yaml:"exits"`
+}
+
+// ProxyExitConfig is one proxy of a pool, with the same syntax as a URL's proxy.
+type ProxyExitConfig struct {
+	Proxy    string             `yaml:"proxy"`
+	ProxyTLS *UpstreamTLSConfig `yaml:"proxy_tls,omitempty"`
+}
+
+// validate checks the pool's strategy, counts and exits.
+func (p *ProxyPoolConfig) validate() error {
+	switch p.Strategy {
+	case "", "round-robin", "random", "sticky":
+	default:
+		return fmt.Errorf("strategy must be round-robin, random or sticky")
+	}
+	if p.Retries < 0 || p.MaxFailures < 0 || p.BenchDuration < 0 {
+		return fmt.Errorf("retries, max_failures and bench_duration cannot be negative")
+	}
+	if len(p.Exits) == 0 {
+		return fmt.Errorf("exits must not be empty")
+	}
+	seen := make(map[string]bool)
+	for i, e := range p.Exits {
+		if e.Proxy == "" {
+			return fmt.Errorf("exits[%d]: proxy must be specified", i)
+		}
+		if seen[e.Proxy] {
+			return fmt.Errorf("exits[%d]: duplicate proxy", i)
+		}
+		seen[e.Proxy] = true
+		u := URLConfig{Proxy: e.Proxy, ProxyTLS: e.ProxyTLS}
+		if err := u.validate(); err != nil {
+			return fmt.Errorf("exits[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// LoadProxyPools reads the proxy pools of path. A missing file defines no pools.
+func LoadProxyPools(path string) (map[string]ProxyPoolConfig, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cfg ProxiesConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	for name, pool := range cfg.Pools {
+		if err := pool.validate(); err != nil {
+			return nil, fmt.Errorf("invalid proxy pool %s in %s: %v", name, path, err)
+		}
+	}
+	return cfg.Pools, nil
+}
+
+// CheckProxyPools verifies that the pools the endpoints' URLs use are defined.
+func CheckProxyPools(endpoints map[string]StrategyConfigClean, pools map[string]ProxyPoolConfig) error {
+	keys := make([]string, 0, len(endpoints))
+	for key := range endpoints {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for i, u := range endpoints[key].URLs {
+			if _, ok := pools[u.ProxyPool]; u.ProxyPool != "" && !ok {
+				return fmt.Errorf("endpoint %s: urls[%d]: unknown proxy_pool %s", key, i, u.ProxyPool)
+			}
+		}
+	}
+	return nil
+}
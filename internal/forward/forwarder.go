@@ -1,125 +1,324 @@
 package forward
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/abswn/revproxy-go/internal/ban"
+	"github.com/abswn/revproxy-go/internal/compression"
 	"github.com/abswn/revproxy-go/internal/config"
-	"golang.org/x/net/proxy"
+	"github.com/abswn/revproxy-go/internal/grpcstatus"
+	"github.com/abswn/revproxy-go/internal/requestid"
+	"github.com/abswn/revproxy-go/internal/resolver"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// ForwardRequest forwards the request to the given target URL.
+// tracer looks up the tracer on every use so that it follows the currently installed provider.
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/abswn/revproxy-go/internal/forward")
+}
+
+// Result describes the outcome of a forwarded request.
+type Result struct {
+	Endpoint        string        // endpoint key that served the request, set by the caller
+	Backend         string        // sanitized backend URL, empty if no backend was selected
+	StatusCode      int           // backend response status, 0 if the backend was not reached
+	Banned          bool          // the response triggered a ban rule
+	Retries         int           // attempts made after the first one
+	UpstreamLatency time.Duration // from sending the request until the backend response was read
+	ClientIdentity  string        // CN or SAN of the verified client certificate, empty without one
+}
+
+type resultKey struct{}
+
+// WithResult returns a context in which ForwardRequest records its Result.
+// A Result already present in ctx is reused, so outer middlewares see what inner handlers record.
+func WithResult(ctx context.Context) (context.Context, *Result) {
+	if res, ok := ctx.Value(resultKey{}).(*Result); ok {
+		return ctx, res
+	}
+	res := &Result{}
+	return context.WithValue(ctx, resultKey{}, res), res
+}
+
+// ForwardRequest forwards the request to the given target URL. Targets using a proxy pool leave
+// through one of its exits, see WithProxyPool.
 func ForwardRequest(w http.ResponseWriter, r *http.Request, target config.URLConfig, banRules []config.BanRuleClean, bm *ban.BanManager) error {
-	// Parse the target URL to ensure it's valid
-	parsedURL, err := url.Parse(target.URL)
-	if err != nil {
-		log.Errorf("Invalid target URL: %v", err)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
-		return err
+	res, _ := r.Context().Value(resultKey{}).(*Result)
+	if res == nil {
+		res = &Result{}
 	}
+	logger := requestid.Logger(r.Context())
 
-	// Create outbound request using r.Context() so that client disconnection cancels backend request
-	proxyReq, err := http.NewRequestWithContext(r.Context(), r.Method, parsedURL.String(), r.Body)
+	// Parse the target URL to ensure it's valid, filling in {name} captures of the matched route
+	parsedURL, err := url.Parse(ExpandPathValues(target.URL, r))
 	if err != nil {
-		log.Errorf("Failed to create proxy request: %v", err)
+		logger.Errorf("Invalid target URL: %v", err)
 		http.Error(w, "Bad Gateway", http.StatusBadGateway)
 		return err
 	}
 
-	// Clone headers from the original request to the new one
-	proxyReq.Header = r.Header.Clone()
-
-	// 60 seconds timeout for the requests
-	client := &http.Client{
-		Timeout: 60 * time.Second,
-	}
+	// Sanitize the backend URL
+	sanitizedURL := SanitizeParsedURL(parsedURL)
+	res.Backend = sanitizedURL
 
-	// If SOCKS5 proxy is specified, configure a custom Transport
-	if target.Socks5 != "" {
-		var auth *proxy.Auth
-		if target.Username != "" || target.Password != "" {
-			auth = &proxy.Auth{
-				User:     target.Username,
-				Password: target.Password,
-			}
-		}
+	// Bound the whole exchange, response body and retries included
+	limits := LimitsFrom(r.Context())
+	ctx, cancel := context.WithTimeout(r.Context(), config.Seconds(limits.Timeout, defaultTimeout))
+	defer cancel()
 
-		// Create a SOCKS5 dialer
-		dialer, err := proxy.SOCKS5("tcp", target.Socks5, auth, &net.Dialer{
-			Timeout:   10 * time.Second,
-			KeepAlive: 10 * time.Second,
-		})
-		if err != nil {
-			log.Errorf("Failed to create SOCKS5 dialer: %v", err)
-			// return error to prevent unexpected routing
+	e := &exchange{w: w, r: r, ctx: ctx, limits: limits, logger: logger, res: res,
+		parsedURL: parsedURL, sanitizedURL: sanitizedURL, banRules: banRules}
+	if target.ProxyPool != "" {
+		pooled, ok := r.Context().Value(poolKey{}).(pooledTarget)
+		if !ok || pooled.pool.Name() != target.ProxyPool {
+			err := fmt.Errorf("proxy pool %s is not available", target.ProxyPool)
+			logger.Errorf("Cannot forward to backend %s: %v", sanitizedURL, err)
 			http.Error(w, "Bad Gateway", http.StatusBadGateway)
 			return err
 		}
-		// Override the default HTTP transport to route through SOCKS5
-		client.Transport = &http.Transport{
-			DialContext: dialer.(proxy.ContextDialer).DialContext,
+		return e.viaPool(target, pooled)
+	}
+	ban := func(d time.Duration, reason string) {
+		label := sanitizedURL
+		if target.DNS != nil && target.DNS.Resolve != "" {
+			label += " at " + target.DNS.Resolve
 		}
+		logger.Infof("Banning URL %s %s", label, reason)
+		bm.BanURL(target.BanKey(), d)
 	}
+	return e.attempt(target, r.Body, ban, false).err
+}
 
-	// Sanitize the backend URL
-	sanitizedURL := SanitizeParsedURL(parsedURL)
+// exchange holds what the attempts of a forwarded request share.
+type exchange struct {
+	w            http.ResponseWriter
+	r            *http.Request
+	ctx          context.Context // bounds all attempts
+	limits       config.LimitsConfig
+	logger       *log.Entry
+	res          *Result
+	parsedURL    *url.URL
+	sanitizedURL string
+	banRules     []config.BanRuleClean
+}
+
+// attemptResult is the outcome of one upstream attempt.
+type attemptResult struct {
+	err           error
+	connectFailed bool // no connection to the backend could be set up
+	retry         bool // the attempt failed before anything was written to the client
+	status        int  // status to answer with when a failure left to the caller cannot be retried
+}
+
+// attempt sends the request to target once, with body. ban is called when the response triggers a
+// ban rule. With canRetry, failures that another route to the backend may avoid (no connection, or
+// a status triggering a ban rule) are left to the caller instead of being answered.
+func (e *exchange) attempt(target config.URLConfig, outBody io.ReadCloser, ban func(d time.Duration, reason string), canRetry bool) attemptResult {
+	w, r, res, logger, limits := e.w, e.r, e.res, e.logger, e.limits
+	parsedURL, sanitizedURL := e.parsedURL, e.sanitizedURL
+
+	// Trace the upstream attempt, connection setup included
+	ctx, span := tracer().Start(e.ctx, "upstream "+r.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("server.address", parsedURL.Hostname()),
+			attribute.String("revproxy.backend", sanitizedURL),
+			attribute.Bool("revproxy.socks5", target.Socks5 != "" || strings.HasPrefix(target.Proxy, "socks5")),
+			attribute.Bool("revproxy.proxied", target.Socks5 != "" || target.Proxy != ""),
+		))
+	defer span.End()
+	ctx = httptrace.WithClientTrace(ctx, clientTrace(span))
+	// Tell connect timeouts apart from the backend's slowness to respond
+	var connected atomic.Bool
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{GotConn: func(httptrace.GotConnInfo) { connected.Store(true) }})
+
+	// Watch the client's body for size limit and read timeout errors while it is sent upstream
+	var reqBody *bodyReader
+	if outBody != nil && outBody != http.NoBody {
+		reqBody = &bodyReader{ReadCloser: outBody}
+		outBody = reqBody
+	}
+
+	// Create outbound request using r.Context() so that client disconnection cancels backend request
+	proxyReq, err := http.NewRequestWithContext(ctx, r.Method, parsedURL.String(), outBody)
+	if err != nil {
+		logger.Errorf("Failed to create proxy request: %v", err)
+		span.SetStatus(codes.Error, err.Error())
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return attemptResult{err: err}
+	}
+
+	// Clone headers and trailers from the original request to the new one and continue the trace upstream.
+	// Request trailers are filled in once the client's body has been read, in time to be sent on.
+	proxyReq.Header = r.Header.Clone()
+	RemoveHopHeaders(proxyReq.Header)
+	proxyReq.ContentLength = r.ContentLength
+	proxyReq.Trailer = r.Trailer
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(proxyReq.Header))
+
+	client, err := NewClient(target, limits)
+	if err != nil {
+		logger.Errorf("Failed to create client for backend %s: %v", sanitizedURL, err)
+		span.SetStatus(codes.Error, err.Error())
+		// A misconfigured proxy fails like a proxy that cannot be reached
+		if canRetry {
+			return attemptResult{err: err, connectFailed: true, retry: true, status: http.StatusBadGateway}
+		}
+		// return error to prevent unexpected routing
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return attemptResult{err: err, connectFailed: true}
+	}
 
 	// Send the request to the backend URL
-	log.Infof("Forwarding %s request for %s to backend %s", r.Method, r.URL.Path, sanitizedURL)
+	logger.Infof("Forwarding %s request for %s to backend %s", r.Method, r.URL.Path, sanitizedURL)
+	// Let a streamed HTTP/1.1 request body keep flowing upstream while the response is sent back.
+	// HTTP/2 clients are always full-duplex.
+	if r.ProtoMajor == 1 && r.ContentLength == -1 {
+		http.NewResponseController(w).EnableFullDuplex()
+	}
+	start := time.Now()
 	resp, err := client.Do(proxyReq)
 	if err != nil {
+		res.UpstreamLatency = time.Since(start)
+		var bodyErr error
+		if reqBody != nil {
+			bodyErr = reqBody.Err()
+		}
+		status, reason := classify(ctx, err, bodyErr, connected.Load(), limits)
 		// Replace the url in the error message with sanitizedURL
 		errMsg := strings.Replace(err.Error(), parsedURL.String(), sanitizedURL, 1)
 		// Create new error
 		err = fmt.Errorf("%s", errMsg)
-		log.Errorf("Request to backend failed: %v", err)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
-		return err
+		logger.Errorf("%s: %v", reason, err)
+		span.SetStatus(codes.Error, errMsg)
+		// No connection could be set up, through no fault of the client or the overall timeout
+		connectFailed := !connected.Load() && bodyErr == nil && ctx.Err() == nil
+		if connectFailed && canRetry {
+			return attemptResult{err: err, connectFailed: true, retry: true, status: status}
+		}
+		http.Error(w, http.StatusText(status), status)
+		return attemptResult{err: err, connectFailed: connectFailed}
 	}
 	defer resp.Body.Close()
+	res.StatusCode = resp.StatusCode
+	span.SetAttributes(
+		attribute.Int("http.response.status_code", resp.StatusCode),
+		attribute.String("network.protocol.version", strings.TrimPrefix(resp.Proto, "HTTP/")),
+	)
+
+	// A status triggering a ban rule is retried on another route before the client sees it
+	if canRetry {
+		if d, ok := statusBan(e.banRules, resp.StatusCode); ok {
+			span.SetStatus(codes.Error, resp.Status)
+			res.Banned = true
+			ban(time.Duration(d)*time.Second, resp.Status)
+			return attemptResult{err: fmt.Errorf("backend %s answered %s", sanitizedURL, resp.Status), retry: true, status: http.StatusBadGateway}
+		}
+	}
 
-	// Copy all headers from the backend response to the client
+	// Refuse responses announcing a body above the limit before anything is sent to the client
+	if limits.MaxResponseBody > 0 && resp.ContentLength > limits.MaxResponseBody {
+		err := fmt.Errorf("response body of %d bytes exceeds the limit of %d bytes", resp.ContentLength, limits.MaxResponseBody)
+		logger.Errorf("Backend %s %v", sanitizedURL, err)
+		span.SetStatus(codes.Error, err.Error())
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return attemptResult{err: err}
+	}
+
+	// Copy all end-to-end headers from the backend response to the client, announcing its trailers
+	RemoveHopHeaders(resp.Header)
 	for k, v := range resp.Header {
 		w.Header()[k] = v
 	}
+	announced := announceTrailers(w, resp.Trailer)
 
-	// Set the backend response status code
+	// Set the backend response status code. Streamed responses of unknown length are flushed as
+	// they arrive, the header included.
 	w.WriteHeader(resp.StatusCode)
+	var dst io.Writer = w
+	if resp.ContentLength == -1 {
+		rc := http.NewResponseController(w)
+		rc.Flush()
+		dst = flushWriter{w: w, rc: rc}
+	}
 
-	// Stream the backend response body directly to the client
-	// _, copyErr := io.Copy(w, resp.Body)
-
-	// Use TeeReader to hold a copy of the response object for analysis
-	var bodyBuffer bytes.Buffer
-	tee := io.TeeReader(resp.Body, &bodyBuffer)
+	// Use TeeReader to hold a copy of the start of the response for analysis
+	var bodyBuffer cappedBuffer
+	var respBody io.Reader = resp.Body
+	if limits.MaxResponseBody > 0 {
+		respBody = io.LimitReader(resp.Body, limits.MaxResponseBody)
+	}
+	tee := io.TeeReader(respBody, &bodyBuffer)
 
-	// Write response to client
-	_, copyErr := io.Copy(w, tee)
+	// Write response to client, followed by the trailers the backend sent after its body
+	_, copyErr := io.Copy(dst, tee)
+	copyTrailers(w, resp.Trailer, announced)
 	if copyErr != nil {
-		log.Warnf("Failed to copy response body: %v", copyErr)
+		logger.Warnf("Failed to copy response body: %v", copyErr)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			logger.Errorf("Backend exceeded the overall timeout of %s while sending the response body", config.Seconds(limits.Timeout, defaultTimeout))
+		}
 	}
+	var tooLarge error
+	if limits.MaxResponseBody > 0 && copyErr == nil {
+		if n, _ := resp.Body.Read(make([]byte, 1)); n > 0 {
+			tooLarge = fmt.Errorf("response body exceeds the limit of %d bytes", limits.MaxResponseBody)
+			logger.Errorf("Backend %s %v, response cut off", sanitizedURL, tooLarge)
+		}
+	}
+	res.UpstreamLatency = time.Since(start)
+	if resp.StatusCode >= 500 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	span.End()
 
 	// Analyze response
-	bodyStr := strings.ToLower(bodyBuffer.String())
+	_, banSpan := tracer().Start(r.Context(), "ban.evaluate")
+	defer banSpan.End()
+	// Rules match the decoded body, while the client receives it as sent by the backend
+	body := compression.Decode(resp.Header.Get("Content-Encoding"), bodyBuffer.Bytes(), 200)
+	bodyStr := strings.ToLower(string(body))
 	if len(bodyStr) > 200 {
 		bodyStr = bodyStr[:200]
 	}
 	statusCodeStr := strconv.Itoa(resp.StatusCode)
 	statusText := strings.ToLower(resp.Status)
+	// gRPC errors arrive with HTTP status 200, their code and message in the trailers
+	grpcCode, grpcMessage, isGRPC := grpcstatus.FromResponse(resp)
+	grpcMessage = strings.ToLower(grpcMessage)
 	shouldBan := false
 	banDuration := 0
-	for _, rule := range banRules {
+	for _, rule := range e.banRules {
 		word := strings.ToLower(rule.Match)
+		if code, ok, _ := grpcstatus.ParseRule(word); ok {
+			if isGRPC && code == grpcCode {
+				shouldBan = true
+				banDuration = rule.Duration
+				break
+			}
+			continue
+		}
 		// if the string is a 3 digit number
 		if len(word) == 3 {
 			_, err := strconv.Atoi(word)
@@ -129,18 +328,162 @@ func ForwardRequest(w http.ResponseWriter, r *http.Request, target config.URLCon
 				break
 			}
 		} else if strings.Contains(statusText, word) ||
-			strings.Contains(bodyStr, word) {
+			strings.Contains(bodyStr, word) ||
+			(isGRPC && strings.Contains(grpcMessage, word)) {
 			shouldBan = true
 			banDuration = rule.Duration
 			break
 		}
 	}
+	banSpan.SetAttributes(attribute.Bool("revproxy.banned", shouldBan))
 	if shouldBan {
-		log.Infof("Banning URL %s %s %s", sanitizedURL, resp.Status, bodyStr)
-		bm.BanURL(target.URL, time.Duration(banDuration)*time.Second)
+		banSpan.SetAttributes(attribute.Int("revproxy.ban_duration", banDuration))
+		res.Banned = true
+		if isGRPC {
+			ban(time.Duration(banDuration)*time.Second, fmt.Sprintf("grpc-status %d %s", grpcCode, grpcMessage))
+		} else {
+			ban(time.Duration(banDuration)*time.Second, resp.Status+" "+bodyStr)
+		}
 	}
 
-	return nil
+	return attemptResult{err: tooLarge}
+}
+
+// transportKey identifies the settings a cached transport was built with.
+type transportKey struct {
+	proxy                       string // proxy URL, credentials included
+	proxyTLS                    string // UpstreamTLSConfig of the proxy in text form
+	connectTimeout, ttfbTimeout float64
+	idleTimeout                 float64
+	tls                         string // UpstreamTLSConfig in text form
+	protocol                    string
+	dns                         string // DNSConfig in text form
+}
+
+// Transports are shared between requests with the same settings so that connections are reused
+var transports sync.Map // transportKey -> *http.Transport
+
+// NewClient returns an HTTP client for target, routed through its proxy if configured.
+// The overall timeout is left to the request context.
+func NewClient(target config.URLConfig, limits config.LimitsConfig) (*http.Client, error) {
+	if target.ProxyPool != "" && target.Proxy == "" {
+		return nil, fmt.Errorf("proxy pool %s requires an exit to be selected", target.ProxyPool)
+	}
+	proxyURL, err := target.ProxyURL()
+	if err != nil {
+		return nil, err
+	}
+	key := transportKey{
+		connectTimeout: limits.ConnectTimeout,
+		ttfbTimeout:    limits.TTFBTimeout,
+		idleTimeout:    limits.IdleTimeout,
+		protocol:       target.Protocol,
+	}
+	if target.TLS != nil {
+		key.tls = fmt.Sprintf("%+v", *target.TLS)
+	}
+	if proxyURL != nil {
+		key.proxy = proxyURL.String()
+	}
+	if target.ProxyTLS != nil {
+		key.proxyTLS = fmt.Sprintf("%+v", *target.ProxyTLS)
+	}
+	if target.DNS != nil {
+		key.dns = fmt.Sprintf("%+v", *target.DNS)
+	}
+	if t, ok := transports.Load(key); ok {
+		return &http.Client{Transport: t.(*http.Transport)}, nil
+	}
+
+	connectTimeout := config.Seconds(limits.ConnectTimeout, defaultConnectTimeout)
+	netDialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 10 * time.Second,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = netDialer.DialContext
+	if target.DNS != nil {
+		transport.DialContext = resolver.Dial(target.DNS, netDialer.DialContext)
+	}
+	transport.ResponseHeaderTimeout = config.Seconds(limits.TTFBTimeout, 0)
+	transport.IdleConnTimeout = config.Seconds(limits.IdleTimeout, transport.IdleConnTimeout)
+	setProtocol(transport, target.Protocol)
+	// TLS runs over the dialed connection, so these settings hold through proxy tunnels as well
+	if target.TLS != nil {
+		tlsConfig, err := upstreamTLSConfig(target.TLS)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	// If a proxy is specified, route the connections through it
+	if proxyURL != nil {
+		dial, err := proxyDialer(proxyURL, target.ProxyTLS, netDialer)
+		if err != nil {
+			return nil, err
+		}
+		if target.DNS != nil {
+			// The backend's name is resolved here, and the proxy is handed its addresses
+			dial = resolver.Dial(target.DNS, dial)
+		}
+		// Dial through the tunnel, bounding its setup by the connect timeout and tracing it
+		spanName := "proxy.dial"
+		if proxyURL.Scheme == "socks5" || proxyURL.Scheme == "socks5h" {
+			spanName = "socks5.dial"
+		}
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			ctx, span := tracer().Start(ctx, spanName, trace.WithAttributes(
+				attribute.String("revproxy.proxy", proxyURL.Redacted()),
+				attribute.String("server.address", addr),
+			))
+			defer span.End()
+			ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+			defer cancel()
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				span.SetStatus(codes.Error, err.Error())
+			}
+			return conn, err
+		}
+	}
+	t, _ := transports.LoadOrStore(key, transport)
+	return &http.Client{Transport: t.(*http.Transport)}, nil
+}
+
+// clientTrace records connection setup of an upstream attempt as events on span.
+func clientTrace(span trace.Span) *httptrace.ClientTrace {
+	event := func(name string, attrs ...attribute.KeyValue) {
+		span.AddEvent(name, trace.WithAttributes(attrs...))
+	}
+	return &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { event("dns.start") },
+		DNSDone:           func(httptrace.DNSDoneInfo) { event("dns.done") },
+		ConnectStart:      func(network, addr string) { event("connect.start", attribute.String("net.peer", addr)) },
+		ConnectDone:       func(network, addr string, err error) { event("connect.done", attribute.Bool("error", err != nil)) },
+		TLSHandshakeStart: func() { event("tls.start") },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { event("tls.done") },
+		GotConn: func(info httptrace.GotConnInfo) {
+			event("conn.acquired", attribute.Bool("reused", info.Reused))
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { event("request.written") },
+		GotFirstResponseByte: func() { event("response.first_byte") },
+	}
+}
+
+// Matches {name} placeholders in target URLs
+var placeholderRe = regexp.MustCompile(`\{(\w+)\}`)
+
+// ExpandPathValues replaces {name} placeholders in rawURL with the escaped path values of r.
+func ExpandPathValues(rawURL string, r *http.Request) string {
+	return placeholderRe.ReplaceAllStringFunc(rawURL, func(m string) string {
+		segments := strings.Split(r.PathValue(m[1:len(m)-1]), "/")
+		for i, seg := range segments {
+			segments[i] = url.PathEscape(seg)
+		}
+		return strings.Join(segments, "/")
+	})
 }
 
 // Sanitize
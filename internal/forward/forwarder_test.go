@@ -1,11 +1,15 @@
 package forward
 
 import (
+	"compress/gzip"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/abswn/revproxy-go/internal/ban"
 	"github.com/abswn/revproxy-go/internal/config"
@@ -105,6 +109,34 @@ func TestForwardRequest_BanTriggeredByStatusCode(t *testing.T) {
 	}
 }
 
+func TestForwardRequest_PinnedAddress(t *testing.T) {
+	var host string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+
+	// The name does not resolve, the connection goes to the pinned address
+	target := config.URLConfig{URL: "http://backend.invalid:" + port + "/", DNS: &config.DNSConfig{Resolve: "127.0.0.1"}}
+	rules := []config.BanRuleClean{{Match: "418", Duration: 5}}
+	bm := ban.NewManager()
+	rw := httptest.NewRecorder()
+	if err := ForwardRequest(rw, httptest.NewRequest(http.MethodGet, "/", nil), target, rules, bm); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if rw.Code != http.StatusTeapot || host != "backend.invalid:"+port {
+		t.Fatalf("expected the backend to be reached as backend.invalid:%s, got %d from %q", port, rw.Code, host)
+	}
+	// Only the pinned address is banned
+	other := target
+	other.DNS = &config.DNSConfig{Resolve: "127.0.0.2"}
+	if !bm.IsBanned(target.BanKey()) || bm.IsBanned(other.BanKey()) || bm.IsBanned(target.URL) {
+		t.Errorf("expected only %s to be banned", target.BanKey())
+	}
+}
+
 func TestForwardRequest_BanTriggeredByStatusText(t *testing.T) {
 	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad request error", http.StatusBadRequest) // 400 Bad Request
@@ -152,6 +184,79 @@ func TestForwardRequest_BanTriggeredByBody(t *testing.T) {
 	}
 }
 
+func TestForwardRequest_BanTriggeredByCompressedBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusOK)
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte("Please try after some time"))
+		gz.Close()
+	}))
+	defer backend.Close()
+
+	// The client accepts gzip itself, so the body is passed through compressed
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rw := httptest.NewRecorder()
+
+	rules := []config.BanRuleClean{
+		{Match: "try after", Duration: 8},
+	}
+	bm := ban.NewManager()
+
+	err := ForwardRequest(rw, req, config.URLConfig{URL: backend.URL}, rules, bm)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if !bm.IsBanned(backend.URL) {
+		t.Errorf("Expected ban triggered by decompressed body content")
+	}
+	if rw.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("Expected the body to reach the client still compressed")
+	}
+}
+
+func TestForwardRequest_BanTriggeredByGRPCStatus(t *testing.T) {
+	// A gRPC backend failing with RESOURCE_EXHAUSTED in the trailers, or trailers-only
+	trailers := startBackend(t, false, true, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Grpc-Status", "8")
+		w.Header().Set("Grpc-Message", "Quota%20exceeded")
+	})
+	trailersOnly := startBackend(t, false, true, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "8")
+		w.Header().Set("Grpc-Message", "Quota%20exceeded")
+	})
+
+	tests := []struct {
+		match string
+		want  bool
+	}{
+		{"grpc-status:8", true},
+		{"grpc-status:RESOURCE_EXHAUSTED", true},
+		{"grpc-status:UNAVAILABLE", false},
+		{"quota exceeded", true},
+		{"429", false},
+	}
+	for _, backend := range []*httptest.Server{trailers, trailersOnly} {
+		for _, tc := range tests {
+			bm := ban.NewManager()
+			rw := httptest.NewRecorder()
+			target := config.URLConfig{URL: backend.URL, Protocol: "h2c"}
+			req := httptest.NewRequest(http.MethodPost, "/svc.Chat/Send", nil)
+			if err := ForwardRequest(rw, req, target, []config.BanRuleClean{{Match: tc.match, Duration: 5}}, bm); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if bm.IsBanned(backend.URL) != tc.want {
+				t.Errorf("rule %q: expected banned=%v", tc.match, tc.want)
+			}
+		}
+	}
+}
+
 func TestForwardRequest_BanNotTriggered(t *testing.T) {
 	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -200,3 +305,124 @@ func TestForwardRequest_LongBodyTruncatedBeforeMatch(t *testing.T) {
 		t.Errorf("URL should not be banned because match is outside 200 bytes")
 	}
 }
+
+func TestForwardRequest_ExpandsPathValues(t *testing.T) {
+	var gotPath string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.EscapedPath()
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/gpt%204/chat", nil)
+	req.SetPathValue("model", "gpt 4")
+	rw := httptest.NewRecorder()
+
+	err := ForwardRequest(rw, req, config.URLConfig{URL: backend.URL + "/models/{model}/chat"}, []config.BanRuleClean{}, ban.NewManager())
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if gotPath != "/models/gpt%204/chat" {
+		t.Errorf("Expected captured value in backend path, got %s", gotPath)
+	}
+}
+
+func TestForwardRequest_RecordsResult(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer backend.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	ctx, res := WithResult(req.Context())
+	rules := []config.BanRuleClean{{Match: "429", Duration: 5}}
+
+	err := ForwardRequest(httptest.NewRecorder(), req.WithContext(ctx), config.URLConfig{URL: backend.URL}, rules, ban.NewManager())
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if res.StatusCode != http.StatusTooManyRequests || !res.Banned {
+		t.Errorf("Unexpected result: %+v", res)
+	}
+}
+
+// forwardWithLimits forwards req to target through Limit and returns the recorded response and error.
+func forwardWithLimits(req *http.Request, target config.URLConfig, limits config.LimitsConfig) (*httptest.ResponseRecorder, error) {
+	rw := httptest.NewRecorder()
+	var err error
+	Limit(limits, func(w http.ResponseWriter, r *http.Request) {
+		err = ForwardRequest(w, r, target, []config.BanRuleClean{}, ban.NewManager())
+	})(rw, req)
+	return rw, err
+}
+
+// timeoutReader fails like a request body read past its deadline.
+type timeoutReader struct{}
+
+func (timeoutReader) Read([]byte) (int, error) { return 0, os.ErrDeadlineExceeded }
+
+func TestForwardRequest_Limits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		switch r.URL.Path {
+		case "/slow-headers":
+			time.Sleep(300 * time.Millisecond)
+		case "/large":
+			w.Write([]byte(strings.Repeat("a", 100)))
+		case "/large-stream":
+			w.Write([]byte(strings.Repeat("a", 60)))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(strings.Repeat("a", 60)))
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	// A SOCKS5 proxy that accepts connections but never answers the handshake
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stalled.Close()
+	go func() {
+		for {
+			conn, err := stalled.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	chunked := func(body io.Reader) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/", body)
+		req.ContentLength = -1
+		return req
+	}
+	tests := []struct {
+		name       string
+		req        *http.Request
+		target     config.URLConfig
+		limits     config.LimitsConfig
+		wantStatus int
+		wantErr    bool
+	}{
+		{"within limits", httptest.NewRequest(http.MethodPost, "/", strings.NewReader("small")), config.URLConfig{URL: backend.URL}, config.LimitsConfig{MaxRequestBody: 10, MaxResponseBody: 10}, http.StatusOK, false},
+		{"declared request body too large", httptest.NewRequest(http.MethodPost, "/", strings.NewReader("too large body")), config.URLConfig{URL: backend.URL}, config.LimitsConfig{MaxRequestBody: 10}, http.StatusRequestEntityTooLarge, false},
+		{"streamed request body too large", chunked(strings.NewReader(strings.Repeat("a", 1<<20))), config.URLConfig{URL: backend.URL}, config.LimitsConfig{MaxRequestBody: 10}, http.StatusRequestEntityTooLarge, true},
+		{"request body read timeout", chunked(timeoutReader{}), config.URLConfig{URL: backend.URL}, config.LimitsConfig{}, http.StatusRequestTimeout, true},
+		{"declared response body too large", httptest.NewRequest(http.MethodGet, "/", nil), config.URLConfig{URL: backend.URL + "/large"}, config.LimitsConfig{MaxResponseBody: 50}, http.StatusBadGateway, true},
+		{"streamed response body too large", httptest.NewRequest(http.MethodGet, "/", nil), config.URLConfig{URL: backend.URL + "/large-stream"}, config.LimitsConfig{MaxResponseBody: 50}, http.StatusOK, true},
+		{"ttfb timeout", httptest.NewRequest(http.MethodGet, "/", nil), config.URLConfig{URL: backend.URL + "/slow-headers"}, config.LimitsConfig{TTFBTimeout: 0.05}, http.StatusGatewayTimeout, true},
+		{"overall timeout", httptest.NewRequest(http.MethodGet, "/", nil), config.URLConfig{URL: backend.URL + "/slow-headers"}, config.LimitsConfig{Timeout: 0.05}, http.StatusGatewayTimeout, true},
+		{"connect timeout", httptest.NewRequest(http.MethodGet, "/", nil), config.URLConfig{URL: backend.URL, Socks5: stalled.Addr().String()}, config.LimitsConfig{ConnectTimeout: 0.05}, http.StatusGatewayTimeout, true},
+	}
+	for _, tc := range tests {
+		rw, err := forwardWithLimits(tc.req, tc.target, tc.limits)
+		if rw.Code != tc.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.wantStatus, rw.Code)
+		}
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package forward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/requestid"
+)
+
+// Upstream limits applied when none are configured
+const (
+	defaultConnectTimeout = 10 * time.Second
+	defaultTimeout        = 60 * time.Second
+)
+
+type limitsKey struct{}
+
+// Limit enforces the request body limits of an endpoint and hands its upstream limits to ForwardRequest.
+func Limit(limits config.LimitsConfig, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := requestid.Logger(r.Context())
+		if limits.MaxRequestBody > 0 && r.Body != nil {
+			if r.ContentLength > limits.MaxRequestBody {
+				logger.Warnf("Request body of %d bytes exceeds the limit of %d bytes", r.ContentLength, limits.MaxRequestBody)
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limits.MaxRequestBody)
+		}
+		if limits.ReadTimeout > 0 {
+			// Replaces the server-wide read deadline for the rest of the request body
+			deadline := time.Now().Add(config.Seconds(limits.ReadTimeout, 0))
+			if err := http.NewResponseController(w).SetReadDeadline(deadline); err != nil {
+				logger.Debugf("Failed to set request read deadline: %v", err)
+			}
+		}
+		next(w, r.WithContext(WithLimits(r.Context(), limits)))
+	}
+}
+
+// WithLimits returns a context in which ForwardRequest applies limits.
+func WithLimits(ctx context.Context, limits config.LimitsConfig) context.Context {
+	return context.WithValue(ctx, limitsKey{}, limits)
+}
+
+// LimitsFrom returns the limits set by Limit or WithLimits, or none.
+func LimitsFrom(ctx context.Context) config.LimitsConfig {
+	limits, _ := ctx.Value(limitsKey{}).(config.LimitsConfig)
+	return limits
+}
+
+// bodyReader records the first error reading the client's request body while the transport sends it.
+type bodyReader struct {
+	io.ReadCloser
+	mu  sync.Mutex
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.mu.Lock()
+		if b.err == nil {
+			b.err = err
+		}
+		b.mu.Unlock()
+	}
+	return n, err
+}
+
+func (b *bodyReader) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// classify maps a failed upstream attempt to the status returned to the client and a log message.
+// Failures reading the client's body take precedence, as the transport reports them as its own.
+func classify(ctx context.Context, err, bodyErr error, connected bool, limits config.LimitsConfig) (int, string) {
+	var maxErr *http.MaxBytesError
+	if errors.As(bodyErr, &maxErr) {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body exceeds the limit of %d bytes", maxErr.Limit)
+	}
+	if isTimeout(bodyErr) {
+		return http.StatusRequestTimeout, "Client did not send the request body in time"
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, fmt.Sprintf("Backend exceeded the overall timeout of %s", config.Seconds(limits.Timeout, defaultTimeout))
+	case !isTimeout(err):
+		return http.StatusBadGateway, "Request to backend failed"
+	case !connected:
+		return http.StatusGatewayTimeout, fmt.Sprintf("Backend connection exceeded the connect timeout of %s", config.Seconds(limits.ConnectTimeout, defaultConnectTimeout))
+	default:
+		return http.StatusGatewayTimeout, fmt.Sprintf("Backend response headers exceeded the time-to-first-byte timeout of %s", config.Seconds(limits.TTFBTimeout, 0))
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,119 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/grpcstatus"
+	"github.com/abswn/revproxy-go/internal/proxypool"
+)
+
+// maxReplayBody is the largest request body kept in memory so that it can be sent again through
+// another exit.
+const maxReplayBody = 1 << 20
+
+type poolKey struct{}
+
+// pooledTarget is the proxy pool of a request and the key of its sticky exit selection.
+type pooledTarget struct {
+	pool      *proxypool.Pool
+	clientKey string
+}
+
+// WithProxyPool returns a context in which ForwardRequest sends targets using pool through its
+// exits, trying others when one fails. clientKey keys sticky exit selection.
+func WithProxyPool(ctx context.Context, pool *proxypool.Pool, clientKey string) context.Context {
+	return context.WithValue(ctx, poolKey{}, pooledTarget{pool: pool, clientKey: clientKey})
+}
+
+// viaPool sends the request through the exits of a proxy pool, moving on to another exit while
+// attempts fail before anything reached the client. Bans hit the exit, not the target URL.
+func (e *exchange) viaPool(target config.URLConfig, pooled pooledTarget) error {
+	pool := pooled.pool
+	body, replay, err := e.replayableBody()
+	if err != nil {
+		return err
+	}
+	exit, ok := pool.Select(e.r, pooled.clientKey, nil)
+	if !ok {
+		e.logger.Warnf("All exits of proxy pool %s are benched", pool.Name())
+		if strings.HasPrefix(e.r.Header.Get("Content-Type"), "application/grpc") {
+			grpcstatus.WriteError(e.w, grpcstatus.Unavailable, "all proxy exits temporarily unavailable")
+		} else {
+			http.Error(e.w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		}
+		return fmt.Errorf("all exits of proxy pool %s are benched", pool.Name())
+	}
+	var tried []string
+	for {
+		tried = append(tried, exit.Proxy)
+		viaExit := target
+		viaExit.ProxyPool, viaExit.Proxy, viaExit.ProxyTLS = "", exit.Proxy, exit.ProxyTLS
+		current := exit
+		ban := func(d time.Duration, reason string) {
+			e.logger.Infof("Benching exit %s of proxy pool %s for %s %s", pool.Label(current), pool.Name(), e.sanitizedURL, reason)
+			pool.Ban(current, d)
+		}
+		canRetry := replay && e.res.Retries < pool.Retries() && pool.Available(tried)
+		out := e.attempt(viaExit, body(), ban, canRetry)
+		if out.connectFailed {
+			pool.Failed(exit, e.logger)
+		} else {
+			pool.Succeeded(exit)
+		}
+		if !out.retry {
+			return out.err
+		}
+		next, ok := pool.Select(e.r, pooled.clientKey, tried)
+		if !ok {
+			http.Error(e.w, http.StatusText(out.status), out.status)
+			return out.err
+		}
+		e.logger.Infof("Retrying %s through exit %s of proxy pool %s", e.sanitizedURL, pool.Label(next), pool.Name())
+		e.res.Retries++
+		exit = next
+	}
+}
+
+// replayableBody returns the request body to send with each attempt. replay is false when the body
+// can only be sent once, being streamed or larger than maxReplayBody. Failures reading the body
+// are answered.
+func (e *exchange) replayableBody() (body func() io.ReadCloser, replay bool, err error) {
+	r := e.r
+	once := func() io.ReadCloser { return r.Body }
+	if r.Body == nil || r.Body == http.NoBody {
+		return once, true, nil
+	}
+	if r.ContentLength < 0 || r.ContentLength > maxReplayBody {
+		return once, false, nil
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		status, reason := classify(e.ctx, err, err, false, e.limits)
+		if status == http.StatusBadGateway {
+			status, reason = http.StatusBadRequest, "Failed to read the request body"
+		}
+		e.logger.Errorf("%s: %v", reason, err)
+		http.Error(e.w, http.StatusText(status), status)
+		return nil, false, err
+	}
+	return func() io.ReadCloser { return io.NopCloser(bytes.NewReader(data)) }, true, nil
+}
+
+// statusBan returns the duration of the first ban rule matching status alone.
+func statusBan(rules []config.BanRuleClean, status int) (int, bool) {
+	code := strconv.Itoa(status)
+	for _, rule := range rules {
+		if strings.TrimSpace(rule.Match) == code {
+			return rule.Duration, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,122 @@
+package forward
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+// Upper bound on the part of a response body kept for ban rule inspection, so that long streams
+// are not held in memory
+const maxInspected = 1 << 20
+
+// setProtocol restricts transport to the HTTP version configured for a backend.
+func setProtocol(transport *http.Transport, protocol string) {
+	var protocols http.Protocols
+	switch protocol {
+	case "h1":
+		protocols.SetHTTP1(true)
+	case "h2":
+		protocols.SetHTTP2(true)
+	case "h2c":
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		// HTTP/2 when the backend offers it via ALPN, HTTP/1.1 otherwise
+		transport.ForceAttemptHTTP2 = true
+		return
+	}
+	transport.Protocols = &protocols
+}
+
+// Hop-by-hop headers apply to a single connection and are not forwarded (RFC 9110, section 7.6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopHeaders deletes the hop-by-hop headers of h, including those listed in Connection.
+// "TE: trailers" is kept, as gRPC backends require it.
+func RemoveHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	if te := h.Values("Te"); len(te) > 0 {
+		h.Del("Te")
+		for _, v := range te {
+			for _, token := range strings.Split(v, ",") {
+				if strings.EqualFold(strings.TrimSpace(token), "trailers") {
+					h.Set("Te", "trailers")
+				}
+			}
+		}
+	}
+}
+
+// announceTrailers declares the backend's trailer names before the response header is written
+// and returns them.
+func announceTrailers(w http.ResponseWriter, trailer http.Header) map[string]bool {
+	announced := make(map[string]bool, len(trailer))
+	names := make([]string, 0, len(trailer))
+	for k := range trailer {
+		announced[k] = true
+		names = append(names, k)
+	}
+	if len(names) > 0 {
+		w.Header().Set("Trailer", strings.Join(names, ", "))
+		// HTTP/1.1 can only carry trailers in a chunked body
+		w.Header().Del("Content-Length")
+	}
+	return announced
+}
+
+// copyTrailers sets the trailer values received after the backend's body. Names that were not
+// announced, as HTTP/2 backends may send, use the TrailerPrefix convention.
+func copyTrailers(w http.ResponseWriter, trailer http.Header, announced map[string]bool) {
+	for k, v := range trailer {
+		if !announced[k] {
+			k = http.TrailerPrefix + k
+		}
+		w.Header()[k] = v
+	}
+}
+
+// flushWriter sends every write to the client immediately, for streamed responses.
+type flushWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (f flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if err == nil {
+		// Writers that cannot flush still deliver the data when the handler returns
+		f.rc.Flush()
+	}
+	return n, err
+}
+
+// cappedBuffer keeps the first maxInspected bytes written to it and discards the rest.
+type cappedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := maxInspected - b.Len(); room < len(p) {
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
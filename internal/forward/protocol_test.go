@@ -0,0 +1,229 @@
+package forward
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/ban"
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+// h2cProtocols accepts HTTP/1.1 and cleartext HTTP/2 with prior knowledge.
+func h2cProtocols() *http.Protocols {
+	p := new(http.Protocols)
+	p.SetHTTP1(true)
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
+
+// startBackend starts a backend reporting the protocol of each request in X-Proto.
+func startBackend(t *testing.T, tlsBackend, http2 bool, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+		if handler != nil {
+			handler(w, r)
+		}
+	}))
+	if tlsBackend {
+		backend.EnableHTTP2 = http2
+		backend.StartTLS()
+	} else {
+		if http2 {
+			backend.Config.Protocols = h2cProtocols()
+		}
+		backend.Start()
+	}
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// startProxy serves ForwardRequest to target over HTTP/1.1 and h2c.
+func startProxy(t *testing.T, target config.URLConfig) *httptest.Server {
+	t.Helper()
+	bm := ban.NewManager()
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ForwardRequest(w, r, target, nil, bm)
+	}))
+	proxy.Config.Protocols = h2cProtocols()
+	proxy.Start()
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+// h2cClient speaks cleartext HTTP/2 with prior knowledge.
+func h2cClient() *http.Client {
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: transport}
+}
+
+func TestForwardRequest_Protocols(t *testing.T) {
+	h1 := startBackend(t, false, false, nil)
+	h2c := startBackend(t, false, true, nil)
+	h1TLS := startBackend(t, true, false, nil)
+	h2TLS := startBackend(t, true, true, nil)
+	dir := t.TempDir()
+	upstreamTLS := func(srv *httptest.Server) *config.UpstreamTLSConfig {
+		return &config.UpstreamTLSConfig{CAFile: writePEM(t, dir, strings.TrimPrefix(srv.URL, "https://127.0.0.1:")+".pem", "CERTIFICATE", srv.Certificate().Raw)}
+	}
+
+	tests := []struct {
+		name      string
+		backend   *httptest.Server
+		protocol  string
+		wantProto string // empty if the request must fail
+	}{
+		{"auto over cleartext", h2c, "", "HTTP/1.1"},
+		{"auto negotiates h2", h2TLS, "auto", "HTTP/2.0"},
+		{"auto falls back to h1", h1TLS, "auto", "HTTP/1.1"},
+		{"h1 over TLS", h2TLS, "h1", "HTTP/1.1"},
+		{"h2 over TLS", h2TLS, "h2", "HTTP/2.0"},
+		{"h2 without ALPN support", h1TLS, "h2", ""},
+		{"h2c prior knowledge", h2c, "h2c", "HTTP/2.0"},
+		{"h2c to an HTTP/1 backend", h1, "h2c", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			target := config.URLConfig{URL: tc.backend.URL, Protocol: tc.protocol}
+			if strings.HasPrefix(tc.backend.URL, "https://") {
+				target.TLS = upstreamTLS(tc.backend)
+			}
+			rw := httptest.NewRecorder()
+			err := ForwardRequest(rw, httptest.NewRequest(http.MethodGet, "/", nil), target, nil, ban.NewManager())
+			if tc.wantProto == "" {
+				if err == nil || rw.Code != http.StatusBadGateway {
+					t.Errorf("expected 502, got %d (%v)", rw.Code, err)
+				}
+				return
+			}
+			if err != nil || rw.Header().Get("X-Proto") != tc.wantProto {
+				t.Errorf("expected %s, got %q (%v)", tc.wantProto, rw.Header().Get("X-Proto"), err)
+			}
+		})
+	}
+}
+
+func TestForwardRequest_Trailers(t *testing.T) {
+	backend := startBackend(t, false, true, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write([]byte("message"))
+		w.Header().Set("Grpc-Status", "0")
+		// Undeclared trailers are allowed in HTTP/2
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "done "+r.Trailer.Get("X-Checksum"))
+	})
+	proxy := startProxy(t, config.URLConfig{URL: backend.URL, Protocol: "h2c"})
+
+	for name, client := range map[string]*http.Client{"h1": proxy.Client(), "h2c": h2cClient()} {
+		t.Run(name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, proxy.URL, io.NopCloser(strings.NewReader("request")))
+			req.Trailer = http.Header{"X-Checksum": {"abc"}}
+			req.Header.Set("Te", "trailers")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != "message" {
+				t.Errorf("unexpected body %q", body)
+			}
+			if resp.Trailer.Get("Grpc-Status") != "0" || resp.Trailer.Get("Grpc-Message") != "done abc" {
+				t.Errorf("expected the backend's trailers, got %v", resp.Trailer)
+			}
+		})
+	}
+}
+
+func TestForwardRequest_FullDuplex(t *testing.T) {
+	// An echo backend answering each line as soon as it arrives
+	backend := startBackend(t, false, true, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			w.Write([]byte("echo " + scanner.Text() + "\n"))
+			w.(http.Flusher).Flush()
+		}
+	})
+	proxy := startProxy(t, config.URLConfig{URL: backend.URL, Protocol: "h2c"})
+
+	for name, client := range map[string]*http.Client{"h1": proxy.Client(), "h2c": h2cClient()} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			pr, pw := io.Pipe()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodPost, proxy.URL, pr)
+			respCh := make(chan *http.Response, 1)
+			go func() {
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Error(err)
+					pr.Close()
+				}
+				respCh <- resp
+			}()
+			// The response starts before the request body is complete
+			pw.Write([]byte("one\n"))
+			resp := <-respCh
+			if resp == nil {
+				return
+			}
+			defer resp.Body.Close()
+			lines := bufio.NewReader(resp.Body)
+			for _, msg := range []string{"one", "two", "three"} {
+				if msg != "one" {
+					pw.Write([]byte(msg + "\n"))
+				}
+				line, err := lines.ReadString('\n')
+				if err != nil || line != "echo "+msg+"\n" {
+					t.Fatalf("expected echo of %s, got %q (%v)", msg, line, err)
+				}
+			}
+			pw.Close()
+		})
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{
+		"Connection":          {"keep-alive, X-Hop"},
+		"X-Hop":               {"1"},
+		"Keep-Alive":          {"timeout=5"},
+		"Proxy-Authorization": {"Basic dTpw"},
+		"Transfer-Encoding":   {"chunked"},
+		"Upgrade":             {"websocket"},
+		"Te":                  {"deflate"},
+		"X-End":               {"1"},
+	}
+	RemoveHopHeaders(h)
+	if len(h) != 1 || h.Get("X-End") != "1" {
+		t.Errorf("expected only end-to-end headers, got %v", h)
+	}
+	h = http.Header{"Te": {"deflate, trailers"}}
+	RemoveHopHeaders(h)
+	if h.Get("Te") != "trailers" {
+		t.Errorf("expected TE: trailers to be kept, got %v", h)
+	}
+}
+
+// Make sure the h2c client really uses HTTP/2 so that the tests above cover both inbound protocols
+func TestH2CClient(t *testing.T) {
+	backend := startBackend(t, false, true, nil)
+	resp, err := h2cClient().Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.Header.Get("X-Proto") != "HTTP/2.0" {
+		t.Errorf("expected HTTP/2, got %s", resp.Proto)
+	}
+}
@@ -0,0 +1,150 @@
+package forward
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/config"
+	"golang.org/x/net/proxy"
+)
+
+// dialFunc opens a connection to addr.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// proxyDialer returns a dial function tunneling connections through the proxy at u, which
+// ProxyURL has validated. tlsCfg configures TLS towards https proxies.
+func proxyDialer(u *url.URL, tlsCfg *config.UpstreamTLSConfig, netDialer *net.Dialer) (dialFunc, error) {
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", u.Host, auth, netDialer)
+		if err != nil {
+			return nil, err
+		}
+		dial := dialer.(proxy.ContextDialer).DialContext
+		if u.Scheme == "socks5h" {
+			return dial, nil
+		}
+		// socks5:// resolves the backend's name locally and hands the proxy an address
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			if net.ParseIP(host) == nil {
+				ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+				if err != nil {
+					return nil, err
+				}
+				addr = net.JoinHostPort(ips[0].String(), port)
+			}
+			return dial(ctx, network, addr)
+		}, nil
+	case "http", "https":
+		d := &connectDialer{proxy: u, netDialer: netDialer}
+		if u.Scheme == "https" {
+			d.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+			if tlsCfg != nil {
+				var err error
+				if d.tlsConfig, err = upstreamTLSConfig(tlsCfg); err != nil {
+					return nil, fmt.Errorf("proxy_tls: %v", err)
+				}
+			}
+			if d.tlsConfig.ServerName == "" {
+				d.tlsConfig.ServerName = u.Hostname()
+			}
+		}
+		return d.DialContext, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+}
+
+// connectDialer tunnels connections through an HTTP proxy with the CONNECT method, so that TLS and
+// HTTP/2 to the backend run end to end whatever the backend's scheme.
+type connectDialer struct {
+	proxy     *url.URL
+	tlsConfig *tls.Config // set for https proxies
+	netDialer *net.Dialer
+}
+
+func (d *connectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.netDialer.DialContext(ctx, "tcp", d.proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	// The handshake and the CONNECT exchange are bounded by ctx
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+	tunnel, err := d.connect(ctx, conn, addr)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	return tunnel, nil
+}
+
+// connect asks the proxy on conn for a tunnel to addr.
+func (d *connectDialer) connect(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	if d.tlsConfig != nil {
+		tlsConn := tls.Client(conn, d.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, fmt.Errorf("TLS handshake with proxy %s: %v", d.proxy.Host, err)
+		}
+		conn = tlsConn
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.proxy.User != nil {
+		password, _ := d.proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("reading CONNECT response from proxy %s: %v", d.proxy.Host, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", d.proxy.Host, addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// The backend spoke first and its bytes are already buffered
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads what was buffered while parsing the CONNECT response before the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,237 @@
+package forward
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/ban"
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/proxypool"
+)
+
+// standIn records the addresses clients asked a stand-in proxy to connect to. Every tunnel leads to
+// backend whatever the address, so that names need not resolve.
+type standIn struct {
+	backend string
+	mu      sync.Mutex
+	asked   []string
+}
+
+func (s *standIn) record(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.asked = append(s.asked, addr)
+}
+
+func (s *standIn) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.asked = nil
+}
+
+func (s *standIn) last() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.asked) == 0 {
+		return ""
+	}
+	return s.asked[len(s.asked)-1]
+}
+
+// tunnel copies between the client and the backend until either side closes.
+func (s *standIn) tunnel(client io.ReadWriteCloser) {
+	upstream, err := net.Dial("tcp", s.backend)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	go io.Copy(upstream, client)
+	io.Copy(client, upstream)
+}
+
+// startConnectProxy serves an HTTP CONNECT proxy requiring Basic user:secret, over TLS if useTLS.
+func startConnectProxy(t *testing.T, s *standIn, useTLS bool) *httptest.Server {
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT", http.StatusMethodNotAllowed)
+			return
+		}
+		if user, password, ok := parseProxyAuth(r); !ok || user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		s.record(r.Host)
+		w.WriteHeader(http.StatusOK)
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.Flush()
+		s.tunnel(conn)
+	}))
+	if useTLS {
+		proxy.StartTLS()
+	} else {
+		proxy.Start()
+	}
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+// parseProxyAuth reads Basic credentials from Proxy-Authorization.
+func parseProxyAuth(r *http.Request) (string, string, bool) {
+	r = &http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}
+	return r.BasicAuth()
+}
+
+func TestForwardRequest_Proxy(t *testing.T) {
+	// Closing every connection makes each case open a tunnel of its own
+	closeConn := func(w http.ResponseWriter, r *http.Request) { w.Header().Set("Connection", "close") }
+	backend := startBackend(t, false, false, closeConn)
+	tlsBackend := startBackend(t, true, false, closeConn)
+	dir := t.TempDir()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+	_, tlsPort, _ := net.SplitHostPort(strings.TrimPrefix(tlsBackend.URL, "https://"))
+
+	socks := &standIn{backend: strings.TrimPrefix(backend.URL, "http://")}
+	socksAddr := startSOCKS5(t, socks)
+	connect := &standIn{backend: strings.TrimPrefix(backend.URL, "http://")}
+	connectProxy := startConnectProxy(t, connect, false)
+	tlsConnect := &standIn{backend: strings.TrimPrefix(tlsBackend.URL, "https://")}
+	tlsConnectProxy := startConnectProxy(t, tlsConnect, true)
+	proxyCA := &config.UpstreamTLSConfig{CAFile: writePEM(t, dir, "proxy-ca.pem", "CERTIFICATE", tlsConnectProxy.Certificate().Raw)}
+	// The httptest certificate is valid for example.com, reached through the tunnel
+	backendTLS := &config.UpstreamTLSConfig{CAFile: writePEM(t, dir, "backend-ca.pem", "CERTIFICATE", tlsBackend.Certificate().Raw)}
+
+	tests := []struct {
+		name      string
+		target    config.URLConfig
+		standIn   *standIn
+		wantAsked string // empty if the request must fail
+	}{
+		{"socks5h sends the name", config.URLConfig{URL: "http://backend.test:" + port, Proxy: "socks5h://user:secret@" + socksAddr}, socks, "backend.test:" + port},
+		{"socks5 resolves locally", config.URLConfig{URL: "http://localhost:" + port, Proxy: "socks5://user:secret@" + socksAddr}, socks, "127.0.0.1:" + port},
+		{"socks5 wrong password", config.URLConfig{URL: "http://backend.test:" + port, Proxy: "socks5h://user:wrong@" + socksAddr}, socks, ""},
+		{"legacy socks5 fields", config.URLConfig{URL: "http://backend.test:" + port, Socks5: socksAddr, Username: "user", Password: "secret"}, socks, "backend.test:" + port},
+		{"http CONNECT", config.URLConfig{URL: "http://backend.test:" + port, Proxy: "http://user:secret@" + strings.TrimPrefix(connectProxy.URL, "http://")}, connect, "backend.test:" + port},
+		{"http CONNECT without credentials", config.URLConfig{URL: "http://backend.test:" + port, Proxy: connectProxy.URL}, connect, ""},
+		{"https proxy to https backend", config.URLConfig{URL: "https://example.com:" + tlsPort, Proxy: "https://user:secret@" + strings.TrimPrefix(tlsConnectProxy.URL, "https://"), ProxyTLS: proxyCA, TLS: backendTLS}, tlsConnect, "example.com:" + tlsPort},
+		{"https proxy not trusted", config.URLConfig{URL: "https://example.com:" + tlsPort, Proxy: "https://user:secret@" + strings.TrimPrefix(tlsConnectProxy.URL, "https://"), TLS: backendTLS}, tlsConnect, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.standIn.reset()
+			rw := httptest.NewRecorder()
+			err := ForwardRequest(rw, httptest.NewRequest(http.MethodGet, "/", nil), tc.target, nil, ban.NewManager())
+			if tc.wantAsked == "" {
+				if err == nil || rw.Code == http.StatusOK {
+					t.Errorf("expected failure, got %d", rw.Code)
+				}
+				return
+			}
+			if err != nil || rw.Code != http.StatusOK {
+				t.Fatalf("expected success, got %d (%v)", rw.Code, err)
+			}
+			if asked := tc.standIn.last(); asked != tc.wantAsked {
+				t.Errorf("expected the proxy to be asked for %s, got %s", tc.wantAsked, asked)
+			}
+		})
+	}
+}
+
+func TestForwardRequest_ProxyPool(t *testing.T) {
+	// Tunnels through the limited exit reach a backend answering 429, as if the exit's address
+	// were rate limited
+	limited := startBackend(t, false, false, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	backend := startBackend(t, false, false, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+	limitedExit := startConnectProxy(t, &standIn{backend: strings.TrimPrefix(limited.URL, "http://")}, false)
+	goodExit := startConnectProxy(t, &standIn{backend: strings.TrimPrefix(backend.URL, "http://")}, false)
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead.Close()
+	exit := func(srv *httptest.Server) config.ProxyExitConfig {
+		return config.ProxyExitConfig{Proxy: "http://user:secret@" + strings.TrimPrefix(srv.URL, "http://")}
+	}
+	deadExit := config.ProxyExitConfig{Proxy: "http://" + dead.Addr().String()}
+	target := config.URLConfig{URL: "http://backend.test/", ProxyPool: "exits"}
+	rules := []config.BanRuleClean{{Match: "429", Duration: 60}}
+
+	t.Run("banned exit is benched and retried", func(t *testing.T) {
+		bm := ban.NewManager()
+		pool := proxypool.New("exits", config.ProxyPoolConfig{Retries: 2, Exits: []config.ProxyExitConfig{exit(limitedExit), exit(goodExit)}})
+		rw, res, err := forwardVia(pool, bm, target, rules, "payload")
+		if err != nil || rw.Code != http.StatusOK || rw.Body.String() != "payload" {
+			t.Fatalf("expected the body echoed through the second exit, got %d %q (%v)", rw.Code, rw.Body.String(), err)
+		}
+		// The request is reported as banned, since its first attempt benched an exit
+		if res.Retries != 1 || !res.Banned {
+			t.Errorf("expected 1 retry and a ban, got %+v", res)
+		}
+		if !pool.Benched(exit(limitedExit)) || bm.IsBanned(target.URL) {
+			t.Error("expected the exit to be benched and the URL to stay usable")
+		}
+		// Later requests avoid the benched exit
+		rw, res, _ = forwardVia(pool, bm, target, rules, "again")
+		if rw.Code != http.StatusOK || res.Retries != 0 || res.Banned {
+			t.Errorf("expected a direct success, got %d with %d retries", rw.Code, res.Retries)
+		}
+	})
+
+	t.Run("unreachable exit", func(t *testing.T) {
+		pool := proxypool.New("exits", config.ProxyPoolConfig{Retries: 1, MaxFailures: 1, Exits: []config.ProxyExitConfig{deadExit, exit(goodExit)}})
+		rw, res, err := forwardVia(pool, ban.NewManager(), target, rules, "payload")
+		if err != nil || rw.Code != http.StatusOK || res.Retries != 1 {
+			t.Fatalf("expected success after 1 retry, got %d with %d retries (%v)", rw.Code, res.Retries, err)
+		}
+		if !pool.Benched(deadExit) {
+			t.Error("expected the unreachable exit to be benched")
+		}
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		pool := proxypool.New("exits", config.ProxyPoolConfig{Exits: []config.ProxyExitConfig{exit(limitedExit), exit(goodExit)}})
+		rw, res, _ := forwardVia(pool, ban.NewManager(), target, rules, "")
+		if rw.Code != http.StatusTooManyRequests || res.Retries != 0 || !res.Banned {
+			t.Errorf("expected the 429 without retries, got %d with %d retries", rw.Code, res.Retries)
+		}
+		rw, _, _ = forwardVia(pool, ban.NewManager(), target, rules, "")
+		if rw.Code != http.StatusOK {
+			t.Errorf("expected the next request to use the other exit, got %d", rw.Code)
+		}
+		pool.Ban(exit(goodExit), time.Minute)
+		rw, _, err := forwardVia(pool, ban.NewManager(), target, rules, "")
+		if err == nil || rw.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected 503 with every exit benched, got %d", rw.Code)
+		}
+	})
+
+	t.Run("pool missing from the context", func(t *testing.T) {
+		rw, _, err := forwardVia(nil, ban.NewManager(), target, rules, "")
+		if err == nil || rw.Code != http.StatusBadGateway {
+			t.Errorf("expected 502 rather than a direct connection, got %d", rw.Code)
+		}
+	})
+}
+
+// forwardVia forwards a POST of body to target through pool, as the endpoint handler does.
+func forwardVia(pool *proxypool.Pool, bm *ban.BanManager, target config.URLConfig, rules []config.BanRuleClean, body string) (*httptest.ResponseRecorder, *Result, error) {
+	ctx, res := WithResult(context.Background())
+	if pool != nil {
+		ctx = WithProxyPool(ctx, pool, "203.0.113.7")
+	}
+	rw := httptest.NewRecorder()
+	err := ForwardRequest(rw, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)).WithContext(ctx), target, rules, bm)
+	return rw, res, err
+}
@@ -0,0 +1,90 @@
+package forward
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// upstreamTLSConfig builds the client TLS config for a backend, loading its CA bundle and client certificate.
+func upstreamTLSConfig(cfg *config.UpstreamTLSConfig) (*tls.Config, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if v, ok := tlsVersions[cfg.MinVersion]; ok {
+		tlsConfig.MinVersion = v
+	}
+	if cfg.InsecureSkipVerify {
+		log.Warnf("TLS certificate verification is disabled for a backend (insecure_skip_verify)")
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if len(cfg.PinnedSPKI) > 0 {
+		pins := make([][]byte, len(cfg.PinnedSPKI))
+		for i, pin := range cfg.PinnedSPKI {
+			pins[i], _ = base64.StdEncoding.DecodeString(pin)
+		}
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pins)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// verifyPins accepts a connection whose leaf public key matches a pin. Other certificates only count
+// when their chain was verified, since anyone can present a copy of a public intermediate.
+func verifyPins(cs tls.ConnectionState, pins [][]byte) error {
+	var candidates []*x509.Certificate
+	if len(cs.PeerCertificates) > 0 {
+		candidates = append(candidates, cs.PeerCertificates[0])
+	}
+	for _, chain := range cs.VerifiedChains {
+		candidates = append(candidates, chain...)
+	}
+	for _, cert := range candidates {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(sum[:], pin) {
+				return nil
+			}
+		}
+	}
+	return errors.New("backend certificate does not match any pinned public key")
+}
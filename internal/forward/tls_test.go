@@ -0,0 +1,197 @@
+package forward
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/ban"
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+// writePEM writes a PEM block to a file in dir and returns its path.
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newClientCert creates a self-signed client certificate, returning it and the paths of its PEM files.
+func newClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "revproxy-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, writePEM(t, dir, "client.pem", "CERTIFICATE", der), writePEM(t, dir, "client-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+// startSOCKS5 serves a minimal SOCKS5 CONNECT proxy accepting IPv4 and domain addresses, and
+// returns its address. Without s it needs no authentication and connects to the requested address;
+// with s it requires user:secret, records the requested address and tunnels to s's backend.
+func startSOCKS5(t *testing.T, s *standIn) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, s)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveSOCKS5(conn net.Conn, s *standIn) {
+	defer conn.Close()
+	buf := make([]byte, 262)
+	// Greeting: version, method count, methods
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+	if s == nil {
+		conn.Write([]byte{5, 0})
+	} else {
+		// Username/password authentication (RFC 1929)
+		conn.Write([]byte{5, 2})
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		password := make([]byte, buf[0])
+		io.ReadFull(conn, password)
+		if string(user) != "user" || string(password) != "secret" {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+	// Request: version, CONNECT, reserved, address type
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		io.ReadFull(conn, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 3:
+		io.ReadFull(conn, buf[:1])
+		n := int(buf[0])
+		io.ReadFull(conn, buf[:n])
+		host = string(buf[:n])
+	default:
+		return
+	}
+	io.ReadFull(conn, buf[:2])
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2]))))
+	if s != nil {
+		s.record(addr)
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		s.tunnel(conn)
+		return
+	}
+	upstream, err := net.Dial("tcp", addr)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func TestForwardRequest_UpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, certFile, keyFile := newClientCert(t, dir)
+
+	// A backend requiring a client certificate, with the httptest certificate valid for example.com
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs, MaxVersion: tls.VersionTLS12}
+	backend.StartTLS()
+	defer backend.Close()
+
+	caFile := writePEM(t, dir, "ca.pem", "CERTIFICATE", backend.Certificate().Raw)
+	sum := sha256.Sum256(backend.Certificate().RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+	wrongPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	socks := startSOCKS5(t, nil)
+
+	tests := []struct {
+		name   string
+		tls    *config.UpstreamTLSConfig
+		wantOK bool
+	}{
+		{"system roots", nil, false},
+		{"no client certificate", &config.UpstreamTLSConfig{CAFile: caFile}, false},
+		{"ca and client certificate", &config.UpstreamTLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, true},
+		{"server name", &config.UpstreamTLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "example.com"}, true},
+		{"wrong server name", &config.UpstreamTLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "other.test"}, false},
+		{"insecure", &config.UpstreamTLSConfig{InsecureSkipVerify: true, CertFile: certFile, KeyFile: keyFile}, true},
+		{"pinned", &config.UpstreamTLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, PinnedSPKI: []string{wrongPin, pin}}, true},
+		{"wrong pin", &config.UpstreamTLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, PinnedSPKI: []string{wrongPin}}, false},
+		{"insecure wrong pin", &config.UpstreamTLSConfig{InsecureSkipVerify: true, CertFile: certFile, KeyFile: keyFile, PinnedSPKI: []string{wrongPin}}, false},
+		{"min version above backend", &config.UpstreamTLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3"}, false},
+		{"missing ca file", &config.UpstreamTLSConfig{CAFile: filepath.Join(dir, "missing.pem")}, false},
+	}
+	for _, tc := range tests {
+		for _, socks5 := range []string{"", socks} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			rw := httptest.NewRecorder()
+			target := config.URLConfig{URL: backend.URL, Socks5: socks5, TLS: tc.tls}
+			err := ForwardRequest(rw, req, target, []config.BanRuleClean{}, ban.NewManager())
+			if ok := err == nil && rw.Code == http.StatusOK; ok != tc.wantOK {
+				t.Errorf("%s (socks5 %q): expected success %v, got status %d, error %v", tc.name, socks5, tc.wantOK, rw.Code, err)
+			}
+		}
+	}
+}
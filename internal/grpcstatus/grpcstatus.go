@@ -0,0 +1,107 @@
+// Reads and writes gRPC status codes, which travel in the grpc-status and grpc-message trailers.
+package grpcstatus
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Unavailable is the code returned when no backend can take a call.
+const Unavailable = 14
+
+// RulePrefix marks ban rules matching a gRPC status, as in "grpc-status:14" or "grpc-status:UNAVAILABLE".
+const RulePrefix = "grpc-status:"
+
+// Canonical code names, indexed by code
+var names = []string{
+	"OK",
+	"CANCELLED",
+	"UNKNOWN",
+	"INVALID_ARGUMENT",
+	"DEADLINE_EXCEEDED",
+	"NOT_FOUND",
+	"ALREADY_EXISTS",
+	"PERMISSION_DENIED",
+	"RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION",
+	"ABORTED",
+	"OUT_OF_RANGE",
+	"UNIMPLEMENTED",
+	"INTERNAL",
+	"UNAVAILABLE",
+	"DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+// ParseCode reads a code given by number or by case-insensitive name.
+func ParseCode(s string) (int, bool) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.Atoi(s); err == nil {
+		return n, n >= 0 && n < len(names)
+	}
+	for code, name := range names {
+		if strings.EqualFold(s, name) {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+// ParseRule returns the code of a ban rule match in the RulePrefix form. ok is false for other rules;
+// err is set if the code is not valid.
+func ParseRule(match string) (code int, ok bool, err error) {
+	rest, ok := strings.CutPrefix(strings.ToLower(strings.TrimSpace(match)), RulePrefix)
+	if !ok {
+		return 0, false, nil
+	}
+	code, valid := ParseCode(rest)
+	if !valid {
+		return 0, true, fmt.Errorf("unknown gRPC status '%s' in ban rule", rest)
+	}
+	return code, true, nil
+}
+
+// FromResponse returns the status of a gRPC response, read from its trailers or, for trailers-only
+// responses, its header. The body must have been read. ok is false if there is no status.
+func FromResponse(resp *http.Response) (code int, message string, ok bool) {
+	h := resp.Trailer
+	if h.Get("Grpc-Status") == "" {
+		h = resp.Header
+	}
+	code, err := strconv.Atoi(h.Get("Grpc-Status"))
+	if err != nil {
+		return 0, "", false
+	}
+	message = h.Get("Grpc-Message")
+	if decoded, err := url.PathUnescape(message); err == nil {
+		message = decoded
+	}
+	return code, message, true
+}
+
+// WriteError answers a call with code and message in the trailers, the way gRPC servers report
+// errors. The HTTP status is 200, as gRPC requires.
+func WriteError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", encodeMessage(message))
+}
+
+// encodeMessage percent-encodes the bytes the gRPC spec does not allow in grpc-message.
+func encodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,63 @@
+package grpcstatus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		match   string
+		code    int
+		ok      bool
+		wantErr bool
+	}{
+		{"grpc-status:14", 14, true, false},
+		{"GRPC-STATUS:resource_exhausted", 8, true, false},
+		{"grpc-status:UNAUTHENTICATED", 16, true, false},
+		{"grpc-status:17", 0, true, true},
+		{"grpc-status:busy", 0, true, true},
+		{"429", 0, false, false},
+		{"quota", 0, false, false},
+	}
+	for _, tt := range tests {
+		code, ok, err := ParseRule(tt.match)
+		if code != tt.code || ok != tt.ok || (err != nil) != tt.wantErr {
+			t.Errorf("ParseRule(%q) = %d, %v, %v", tt.match, code, ok, err)
+		}
+	}
+}
+
+func TestFromResponse(t *testing.T) {
+	resp := &http.Response{
+		Header:  http.Header{"Content-Type": {"application/grpc"}},
+		Trailer: http.Header{"Grpc-Status": {"8"}, "Grpc-Message": {"quota%20exceeded"}},
+	}
+	if code, msg, ok := FromResponse(resp); !ok || code != 8 || msg != "quota exceeded" {
+		t.Errorf("unexpected status from trailers: %d %q %v", code, msg, ok)
+	}
+	// Trailers-only responses carry the status in the header
+	resp = &http.Response{Header: http.Header{"Grpc-Status": {"14"}}}
+	if code, _, ok := FromResponse(resp); !ok || code != 14 {
+		t.Errorf("unexpected status from header: %d %v", code, ok)
+	}
+	if _, _, ok := FromResponse(&http.Response{Header: http.Header{}}); ok {
+		t.Error("expected no status for a plain HTTP response")
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	rw := httptest.NewRecorder()
+	WriteError(rw, Unavailable, "no backend: 100% busy\n")
+	res := rw.Result()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "application/grpc" {
+		t.Errorf("unexpected response: %d %v", res.StatusCode, res.Header)
+	}
+	if res.Trailer.Get("Grpc-Status") != "14" || res.Trailer.Get("Grpc-Message") != "no backend: 100%25 busy%0A" {
+		t.Errorf("unexpected trailers: %v", res.Trailer)
+	}
+	if code, msg, ok := FromResponse(res); !ok || code != Unavailable || msg != "no backend: 100% busy\n" {
+		t.Errorf("expected the status to round trip, got %d %q", code, msg)
+	}
+}
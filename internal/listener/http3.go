@@ -0,0 +1,68 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// altSvcMaxAge is how long, in seconds, clients may remember that HTTP/3 is available.
+const altSvcMaxAge = 86400
+
+// HTTP3 serves a TLS listener's handler over QUIC on a UDP socket.
+type HTTP3 struct {
+	server *http3.Server
+	conn   net.PacketConn
+}
+
+// ListenHTTP3 opens the UDP side of address for srv, whose handler, TLS configuration and limits
+// are reused so that HTTP/3 clients are routed exactly like HTTPS ones.
+func ListenHTTP3(address string, srv *http.Server) (*HTTP3, error) {
+	if srv.TLSConfig == nil {
+		return nil, fmt.Errorf("HTTP/3 requires TLS")
+	}
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTP3{
+		server: &http3.Server{
+			Handler:        srv.Handler,
+			TLSConfig:      http3.ConfigureTLSConfig(srv.TLSConfig),
+			MaxHeaderBytes: srv.MaxHeaderBytes,
+			IdleTimeout:    srv.IdleTimeout,
+		},
+		conn: conn,
+	}, nil
+}
+
+// Port returns the UDP port HTTP/3 is served on.
+func (h *HTTP3) Port() int {
+	return h.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Serve accepts QUIC connections until the server is closed or fails.
+func (h *HTTP3) Serve() error {
+	return h.server.Serve(h.conn)
+}
+
+// Close stops the server and its socket.
+func (h *HTTP3) Close() error {
+	err := h.server.Close()
+	h.conn.Close()
+	return err
+}
+
+// AltSvc advertises HTTP/3 on port in the responses of next, so that clients switch to it for
+// later requests.
+func AltSvc(port int, next http.Handler) http.HandlerFunc {
+	value := fmt.Sprintf(`h3=":%d"; ma=%d`, port, altSvcMaxAge)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			w.Header().Set("Alt-Svc", value)
+		}
+		next.ServeHTTP(w, r)
+	}
+}
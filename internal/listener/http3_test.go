@@ -0,0 +1,64 @@
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestListenHTTP3(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})
+	// The TCP listener provides the certificate shared with HTTP/3
+	tcp := httptest.NewUnstartedServer(nil)
+	tcp.StartTLS()
+	defer tcp.Close()
+
+	h3, err := ListenHTTP3("127.0.0.1:0", &http.Server{Handler: handler, TLSConfig: tcp.TLS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h3.Close()
+	go h3.Serve()
+	tcp.Config.Handler = AltSvc(h3.Port(), handler)
+
+	resp, err := tcp.Client().Get(tcp.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	want := fmt.Sprintf(`h3=":%d"; ma=86400`, h3.Port())
+	if got := resp.Header.Get("Alt-Svc"); got != want {
+		t.Fatalf("expected Alt-Svc %q, got %q", want, got)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(tcp.Certificate())
+	client := &http.Client{Transport: &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	defer client.Transport.(*http3.Transport).Close()
+	resp, err = client.Get(fmt.Sprintf("https://127.0.0.1:%d/", h3.Port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "HTTP/3.0" {
+		t.Errorf("expected the handler to see HTTP/3.0, got %q", body)
+	}
+	if resp.Header.Get("Alt-Svc") != "" {
+		t.Errorf("expected no Alt-Svc over HTTP/3, got %q", resp.Header.Get("Alt-Svc"))
+	}
+}
+
+func TestListenHTTP3_RequiresTLS(t *testing.T) {
+	if _, err := ListenHTTP3("127.0.0.1:0", &http.Server{}); err == nil {
+		t.Error("expected an error without a TLS configuration")
+	}
+}
@@ -0,0 +1,90 @@
+// Opens the TCP, unix socket and QUIC listeners the server accepts connections on.
+package listener
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// loopback is reported as the remote address of unix socket clients, so that access control and
+// trusted_proxies treat them as local.
+var loopback = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// Listen opens address, either "host:port" or "unix:/path/to/socket". A stale socket file left
+// behind by a previous run is removed first.
+func Listen(address string) (net.Listener, error) {
+	socket, ok := strings.CutPrefix(address, "unix:")
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	if info, err := os.Stat(socket); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socket)
+		}
+		if err := os.Remove(socket); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	return unixListener{ln}, nil
+}
+
+type unixListener struct {
+	net.Listener
+}
+
+func (l unixListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return unixConn{conn}, nil
+}
+
+type unixConn struct {
+	net.Conn
+}
+
+func (unixConn) RemoteAddr() net.Addr {
+	return loopback
+}
+
+// Serves reports whether a listener restricted to the glob patterns serves the endpoint key.
+// Without patterns every endpoint is served.
+func Serves(patterns []string, key string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, key); ok || p == key {
+			return true
+		}
+	}
+	return false
+}
+
+// RedirectHTTPS answers every request with a permanent redirect to the same URL over https, on
+// port or the default port 443.
+func RedirectHTTPS(port int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if port != 0 && port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	}
+}
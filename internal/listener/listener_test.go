@@ -0,0 +1,103 @@
+package listener
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListen_Unix(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "revproxy.sock")
+	// A socket file left behind by a previous run does not prevent listening
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := Listen("unix:" + socket)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var remoteAddr string
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddr = r.RemoteAddr
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://revproxy/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if host, _, _ := net.SplitHostPort(remoteAddr); host != "127.0.0.1" {
+		t.Errorf("expected unix socket clients to appear as 127.0.0.1, got %q", remoteAddr)
+	}
+}
+
+func TestListen_NotASocket(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen("unix:" + file); err == nil {
+		t.Error("expected an error for a regular file")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("expected the file to be kept: %v", err)
+	}
+}
+
+func TestServes(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		key      string
+		want     bool
+	}{
+		{nil, "/api", true},
+		{[]string{"/admin", "/metrics"}, "/metrics", true},
+		{[]string{"/admin", "/metrics"}, "/api", false},
+		{[]string{"api.example.com/*"}, "api.example.com/v1", true},
+		{[]string{"api.example.com/*"}, "/v1", false},
+		{[]string{"*@internal"}, "health@internal", true},
+	}
+	for _, tt := range tests {
+		if got := Serves(tt.patterns, tt.key); got != tt.want {
+			t.Errorf("Serves(%v, %q) = %v, want %v", tt.patterns, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	tests := []struct {
+		host string
+		port int
+		want string
+	}{
+		{"example.com", 0, "https://example.com/a/b?q=1"},
+		{"example.com:80", 443, "https://example.com/a/b?q=1"},
+		{"example.com:8080", 8443, "https://example.com:8443/a/b?q=1"},
+		{"[::1]:8080", 0, "https://[::1]/a/b?q=1"},
+		{"[::1]", 8443, "https://[::1]:8443/a/b?q=1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/a/b?q=1", nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		RedirectHTTPS(tt.port)(w, r)
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != tt.want {
+			t.Errorf("%s with port %d: got %d %q, want %q", tt.host, tt.port, w.Code, w.Header().Get("Location"), tt.want)
+		}
+	}
+}
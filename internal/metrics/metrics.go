@@ -0,0 +1,159 @@
+// Minimal labelled counters and gauges exposed in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is a labelled family of values of one type.
+type metric struct {
+	name   string
+	help   string
+	kind   string // "counter" or "gauge"
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64 // joined label values -> value
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]*metric)
+)
+
+// register returns the metric called name, creating it if needed.
+func register(name, help, kind string, labels []string) *metric {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if m, ok := registry[name]; ok {
+		return m
+	}
+	m := &metric{name: name, help: help, kind: kind, labels: labels, values: make(map[string]float64)}
+	registry[name] = m
+	return m
+}
+
+// key joins label values into the map key of a series.
+func (m *metric) key(labelValues []string) string {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\x00")
+}
+
+// Counter is a monotonically increasing labelled value.
+type Counter struct{ m *metric }
+
+// NewCounter registers a counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{m: register(name, help, "counter", labels)}
+}
+
+// Inc adds one to the series with the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the series with the given label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	k := c.m.key(labelValues)
+	c.m.mu.Lock()
+	c.m.values[k] += v
+	c.m.mu.Unlock()
+}
+
+// Value returns the current value of the series with the given label values.
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.m.value(labelValues)
+}
+
+// Gauge is a labelled value that can go up and down.
+type Gauge struct{ m *metric }
+
+// NewGauge registers a gauge with the given label names.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{m: register(name, help, "gauge", labels)}
+}
+
+// Set sets the series with the given label values to v.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	k := g.m.key(labelValues)
+	g.m.mu.Lock()
+	g.m.values[k] = v
+	g.m.mu.Unlock()
+}
+
+// Add adds v, which may be negative, to the series with the given label values.
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	k := g.m.key(labelValues)
+	g.m.mu.Lock()
+	g.m.values[k] += v
+	g.m.mu.Unlock()
+}
+
+// Value returns the current value of the series with the given label values.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.m.value(labelValues)
+}
+
+func (m *metric) value(labelValues []string) float64 {
+	k := m.key(labelValues)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[k]
+}
+
+// write writes the metric in the Prometheus text format.
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.values))
+	for k := range m.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		value := strconv.FormatFloat(m.values[k], 'g', -1, 64)
+		if len(m.labels) == 0 {
+			fmt.Fprintf(w, "%s %s\n", m.name, value)
+			continue
+		}
+		pairs := make([]string, len(m.labels))
+		for i, lv := range strings.Split(k, "\x00") {
+			pairs[i] = fmt.Sprintf("%s=%q", m.labels[i], lv)
+		}
+		fmt.Fprintf(w, "%s{%s} %s\n", m.name, strings.Join(pairs, ","), value)
+	}
+}
+
+// WriteTo writes all registered metrics, sorted by name.
+func WriteTo(w io.Writer) {
+	registryMu.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	registryMu.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		registryMu.Lock()
+		m := registry[name]
+		registryMu.Unlock()
+		m.write(w)
+	}
+}
+
+// Handler serves all registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterAndGauge(t *testing.T) {
+	c := NewCounter("test_requests_total", "Test requests.", "endpoint", "result")
+	c.Inc("/api", "200")
+	c.Add(2, "/api", "200")
+	c.Inc("/api", "error")
+
+	g := NewGauge("test_temperature", "Test gauge.")
+	g.Set(21.5)
+	g.Add(-1.5)
+
+	if v := c.Value("/api", "200"); v != 3 {
+		t.Errorf("expected counter value 3, got %v", v)
+	}
+	if v := g.Value(); v != 20 {
+		t.Errorf("expected gauge value 20, got %v", v)
+	}
+
+	rw := httptest.NewRecorder()
+	Handler().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rw.Body.String()
+	for _, want := range []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{endpoint="/api",result="200"} 3`,
+		`test_requests_total{endpoint="/api",result="error"} 1`,
+		"# TYPE test_temperature gauge",
+		"test_temperature 20",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, body)
+		}
+	}
+}
+
+func TestRegisterReturnsExisting(t *testing.T) {
+	a := NewCounter("test_shared_total", "Shared.", "x")
+	b := NewCounter("test_shared_total", "Shared.", "x")
+	a.Inc("1")
+	if b.Value("1") != 1 {
+		t.Error("expected counters with the same name to share values")
+	}
+}
+
+func TestWrongLabelCountPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for wrong number of label values")
+		}
+	}()
+	NewCounter("test_labels_total", "Labels.", "a", "b").Inc("only-one")
+}
@@ -0,0 +1,206 @@
+// Copies a share of an endpoint's requests to a secondary pool, discarding the responses.
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/ban"
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/forward"
+	"github.com/abswn/revproxy-go/internal/metrics"
+	"github.com/abswn/revproxy-go/internal/requestid"
+	"github.com/abswn/revproxy-go/internal/strategy"
+)
+
+// Mirror results are reported apart from the primary traffic
+var (
+	mirrorRequests = metrics.NewCounter("revproxy_mirror_requests_total",
+		"Mirrored requests by endpoint and result (status code, error, timeout, dropped, no_backend, body_too_large).",
+		"endpoint", "result")
+	mirrorSeconds = metrics.NewCounter("revproxy_mirror_duration_seconds_total",
+		"Total time spent on completed mirror requests.", "endpoint")
+)
+
+var (
+	sampleRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	sampleMu   sync.Mutex
+)
+
+// Mirror sends sampled copies of requests to the mirror pool.
+type Mirror struct {
+	endpoint     string
+	percentage   float64
+	strategy     string
+	targets      []config.URLConfig
+	counter      *uint32
+	bm           *ban.BanManager // private to the mirror pool, never the primary BanManager
+	sem          chan struct{}
+	timeout      time.Duration
+	maxBodyBytes int64
+}
+
+// New validates cfg and creates the Mirror of an endpoint.
+func New(endpoint string, cfg config.MirrorConfig) (*Mirror, error) {
+	if cfg.Percentage < 0 || cfg.Percentage > 100 {
+		return nil, fmt.Errorf("mirror percentage must be between 0 and 100")
+	}
+	if len(cfg.URLs) == 0 {
+		return nil, fmt.Errorf("mirror urls must be specified")
+	}
+	m := &Mirror{
+		endpoint:     endpoint,
+		percentage:   cfg.Percentage,
+		strategy:     cfg.Strategy,
+		targets:      cfg.URLs,
+		counter:      new(uint32),
+		bm:           ban.NewManager(),
+		timeout:      time.Duration(cfg.Timeout) * time.Second,
+		maxBodyBytes: cfg.MaxBodyBytes,
+	}
+	switch m.strategy {
+	case "":
+		m.strategy = "random"
+	case "round-robin", "weighted", "random":
+	default:
+		return nil, fmt.Errorf("unsupported mirror strategy '%s'", m.strategy)
+	}
+	if m.timeout <= 0 {
+		m.timeout = 10 * time.Second
+	}
+	if m.maxBodyBytes <= 0 {
+		m.maxBodyBytes = 1 << 20
+	}
+	maxConcurrent := cfg.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = 50
+	}
+	m.sem = make(chan struct{}, maxConcurrent)
+	return m, nil
+}
+
+// sampled decides whether the current request is mirrored.
+func (m *Mirror) sampled() bool {
+	if m.percentage <= 0 {
+		return false
+	}
+	sampleMu.Lock()
+	defer sampleMu.Unlock()
+	return sampleRand.Float64()*100 < m.percentage
+}
+
+// Middleware copies sampled requests, body included, to the mirror pool before calling next.
+// The primary request is never delayed by the mirror beyond buffering its body.
+func (m *Mirror) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !m.sampled() {
+			next(w, r)
+			return
+		}
+
+		var body []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			buf, err := io.ReadAll(io.LimitReader(r.Body, m.maxBodyBytes+1))
+			// Hand the primary request the full body, whatever was read into the buffer included
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+			if err != nil || int64(len(buf)) > m.maxBodyBytes {
+				mirrorRequests.Inc(m.endpoint, "body_too_large")
+				next(w, r)
+				return
+			}
+			body = buf
+		}
+
+		select {
+		case m.sem <- struct{}{}:
+			// Detach from the client's request but keep its ID for the mirror's log lines
+			clone := r.Clone(requestid.WithID(context.Background(), requestid.FromContext(r.Context())))
+			go func() {
+				defer func() { <-m.sem }()
+				m.send(clone, body)
+			}()
+		default:
+			mirrorRequests.Inc(m.endpoint, "dropped")
+		}
+		next(w, r)
+	}
+}
+
+// send sends the copy of a request to a mirror backend and discards the response.
+func (m *Mirror) send(r *http.Request, body []byte) {
+	var (
+		target config.URLConfig
+		ok     bool
+	)
+	switch m.strategy {
+	case "round-robin":
+		target, ok = strategy.RoundRobin(m.targets, m.counter, m.bm)
+	case "weighted":
+		target, ok = strategy.Weighted(m.targets, m.bm)
+	default:
+		target, ok = strategy.Random(m.targets, m.bm)
+	}
+	if !ok {
+		mirrorRequests.Inc(m.endpoint, "no_backend")
+		return
+	}
+	logger := requestid.Logger(r.Context())
+
+	parsedURL, err := url.Parse(forward.ExpandPathValues(target.URL, r))
+	if err != nil {
+		logger.Warnf("Mirror for %s has an invalid target URL: %v", m.endpoint, err)
+		mirrorRequests.Inc(m.endpoint, "error")
+		return
+	}
+	sanitizedURL := forward.SanitizeParsedURL(parsedURL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, r.Method, parsedURL.String(), bytes.NewReader(body))
+	if err != nil {
+		mirrorRequests.Inc(m.endpoint, "error")
+		return
+	}
+	req.Header = r.Header.Clone()
+	forward.RemoveHopHeaders(req.Header)
+	req.Header.Set("X-Revproxy-Mirror", "1")
+
+	client, err := forward.NewClient(target, config.LimitsConfig{})
+	if err != nil {
+		logger.Warnf("Mirror for %s failed to create client for %s: %v", m.endpoint, sanitizedURL, err)
+		mirrorRequests.Inc(m.endpoint, "error")
+		return
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result := "error"
+		if ctx.Err() != nil {
+			result = "timeout"
+		}
+		errMsg := strings.Replace(err.Error(), parsedURL.String(), sanitizedURL, 1)
+		logger.Debugf("Mirror request for %s to %s failed: %s", m.endpoint, sanitizedURL, errMsg)
+		mirrorRequests.Inc(m.endpoint, result)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	elapsed := time.Since(start)
+	mirrorSeconds.Add(elapsed.Seconds(), m.endpoint)
+	mirrorRequests.Inc(m.endpoint, strconv.Itoa(resp.StatusCode))
+	logger.Debugf("Mirror request for %s to %s returned %s in %s", m.endpoint, sanitizedURL, resp.Status, elapsed)
+}
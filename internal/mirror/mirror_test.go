@@ -0,0 +1,205 @@
+package mirror
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+// mirrorBackend records the requests it receives on a channel.
+func mirrorBackend(t *testing.T, status int) (*httptest.Server, chan string) {
+	t.Helper()
+	received := make(chan string, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r.Method + " " + r.Header.Get("X-Revproxy-Mirror") + " " + string(body)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(backend.Close)
+	return backend, received
+}
+
+func TestMirror_CopiesRequestWithBody(t *testing.T) {
+	backend, received := mirrorBackend(t, http.StatusTooManyRequests)
+	m, err := New("/mirror-body", config.MirrorConfig{Percentage: 100, URLs: []config.URLConfig{{URL: backend.URL}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var primaryBody string
+	handler := m.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		primaryBody = string(b)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	rw := httptest.NewRecorder()
+	handler(rw, httptest.NewRequest(http.MethodPost, "/api", strings.NewReader("payload")))
+
+	if primaryBody != "payload" {
+		t.Errorf("expected primary to receive full body, got %q", primaryBody)
+	}
+	if rw.Code != http.StatusOK {
+		t.Errorf("expected primary response to be untouched, got %d", rw.Code)
+	}
+	select {
+	case got := <-received:
+		if got != "POST 1 payload" {
+			t.Errorf("unexpected mirrored request: %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("mirror backend did not receive the request")
+	}
+
+	// The mirror's 429 is only reported, never turned into a ban
+	deadline := time.Now().Add(time.Second)
+	for mirrorRequests.Value("/mirror-body", "429") != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if v := mirrorRequests.Value("/mirror-body", "429"); v != 1 {
+		t.Errorf("expected mirror result to be counted, got %v", v)
+	}
+}
+
+func TestMirror_RemovesHopHeaders(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+	}))
+	t.Cleanup(backend.Close)
+	m, err := New("/mirror-hop", config.MirrorConfig{Percentage: 100, URLs: []config.URLConfig{{URL: backend.URL}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api", nil)
+	req.Header.Set("Connection", "Upgrade, X-Hop")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Proxy-Authorization", "Basic dTpw")
+	req.Header.Set("X-End", "1")
+	m.Middleware(func(w http.ResponseWriter, r *http.Request) {})(httptest.NewRecorder(), req)
+
+	select {
+	case h := <-received:
+		for _, name := range []string{"Connection", "Upgrade", "X-Hop", "Proxy-Authorization"} {
+			if h.Get(name) != "" {
+				t.Errorf("expected %s not to reach the mirror, got %q", name, h.Get(name))
+			}
+		}
+		if h.Get("X-End") != "1" {
+			t.Errorf("expected end-to-end headers to be mirrored, got %v", h)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("mirror backend did not receive the request")
+	}
+}
+
+func TestMirror_ZeroPercentage(t *testing.T) {
+	backend, received := mirrorBackend(t, http.StatusOK)
+	m, err := New("/mirror-zero", config.MirrorConfig{Percentage: 0, URLs: []config.URLConfig{{URL: backend.URL}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := m.Middleware(func(w http.ResponseWriter, r *http.Request) {})
+	for range 20 {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	select {
+	case <-received:
+		t.Error("expected no mirrored requests at 0%")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMirror_LargeBodyNotMirrored(t *testing.T) {
+	backend, received := mirrorBackend(t, http.StatusOK)
+	m, err := New("/mirror-large", config.MirrorConfig{Percentage: 100, MaxBodyBytes: 4, URLs: []config.URLConfig{{URL: backend.URL}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var primaryBody string
+	handler := m.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		primaryBody = string(b)
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader("larger than four")))
+
+	if primaryBody != "larger than four" {
+		t.Errorf("expected primary to receive full body, got %q", primaryBody)
+	}
+	if mirrorRequests.Value("/mirror-large", "body_too_large") != 1 {
+		t.Error("expected oversized body to be counted")
+	}
+	select {
+	case <-received:
+		t.Error("expected oversized request not to be mirrored")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMirror_ConcurrencyCapDropsCopies(t *testing.T) {
+	release := make(chan struct{})
+	var once sync.Once
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer once.Do(func() { close(release) })
+
+	m, err := New("/mirror-cap", config.MirrorConfig{Percentage: 100, MaxConcurrent: 1, URLs: []config.URLConfig{{URL: backend.URL}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := m.Middleware(func(w http.ResponseWriter, r *http.Request) {})
+	for range 3 {
+		handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	if v := mirrorRequests.Value("/mirror-cap", "dropped"); v != 2 {
+		t.Errorf("expected 2 dropped copies, got %v", v)
+	}
+}
+
+func TestMirror_Timeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(3 * time.Second):
+		}
+	}))
+	defer backend.Close()
+
+	m, err := New("/mirror-timeout", config.MirrorConfig{Percentage: 100, URLs: []config.URLConfig{{URL: backend.URL}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.timeout = 50 * time.Millisecond
+	m.Middleware(func(w http.ResponseWriter, r *http.Request) {})(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for mirrorRequests.Value("/mirror-timeout", "timeout") != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := mirrorRequests.Value("/mirror-timeout", "timeout"); v != 1 {
+		t.Errorf("expected mirror timeout to be counted, got %v", v)
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	tests := map[string]config.MirrorConfig{
+		"no urls":          {Percentage: 10},
+		"bad percentage":   {Percentage: 120, URLs: []config.URLConfig{{URL: "http://a.com"}}},
+		"unknown strategy": {Percentage: 10, Strategy: "fastest", URLs: []config.URLConfig{{URL: "http://a.com"}}},
+	}
+	for name, cfg := range tests {
+		if _, err := New("/x", cfg); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Authenticates clients by their TLS certificate, on the listener and per endpoint.
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/forward"
+	"github.com/abswn/revproxy-go/internal/requestid"
+)
+
+var errNoCertificate = errors.New("no client certificate")
+
+// Verifier checks client certificates against a CA bundle and the CN/SAN allow-lists.
+type Verifier struct {
+	cfg   config.ClientAuthConfig
+	roots *x509.CertPool
+	// handshake is set once the listener verifies certificates itself, see Configure
+	handshake bool
+}
+
+// New loads the CA bundle of cfg. The bundle is required unless cfg.Verify is none.
+func New(cfg config.ClientAuthConfig) (*Verifier, error) {
+	if err := cfg.Validate(true); err != nil {
+		return nil, err
+	}
+	v := &Verifier{cfg: cfg}
+	if cfg.ForwardHeader != "" {
+		v.cfg.ForwardHeader = http.CanonicalHeaderKey(cfg.ForwardHeader)
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %v", err)
+		}
+		v.roots = x509.NewCertPool()
+		if !v.roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", cfg.CAFile)
+		}
+	}
+	return v, nil
+}
+
+// Enabled reports whether client certificates are verified.
+func (v *Verifier) Enabled() bool {
+	return v.cfg.Verify == "optional" || v.cfg.Verify == "required"
+}
+
+// Configure makes the listener verify client certificates during the handshake, so that
+// connections without an acceptable certificate are refused before any request is read.
+// ACME TLS-ALPN challenges are still answered without a client certificate.
+func (v *Verifier) Configure(c *tls.Config) {
+	if !v.Enabled() {
+		return
+	}
+	c.ClientCAs = v.roots
+	c.ClientAuth = tls.VerifyClientCertIfGiven
+	if v.cfg.Verify == "required" {
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	c.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.VerifiedChains) == 0 {
+			return nil
+		}
+		return v.allowed(cs.VerifiedChains[0][0])
+	}
+	if slices.Contains(c.NextProtos, acme.ALPNProto) {
+		challenge := c.Clone()
+		challenge.ClientAuth = tls.NoClientCert
+		challenge.VerifyConnection = nil
+		c.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+				return challenge, nil
+			}
+			return nil, nil
+		}
+	}
+	v.handshake = true
+}
+
+// Verify returns the identity of the client certificate presented with r, or an error if there
+// is none or it does not chain to the CA bundle or match the allow-lists.
+func (v *Verifier) Verify(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", errNoCertificate
+	}
+	leaf := r.TLS.PeerCertificates[0]
+	if v.handshake && len(r.TLS.VerifiedChains) > 0 {
+		return Identity(leaf), nil
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return "", err
+	}
+	if err := v.allowed(leaf); err != nil {
+		return "", err
+	}
+	return Identity(leaf), nil
+}
+
+// Middleware rejects requests without an acceptable client certificate with 403, unless the
+// verify mode is optional and none was presented. The verified identity is recorded for the
+// access log and, if configured, forwarded in a header; clients cannot set that header themselves.
+func (v *Verifier) Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if v.cfg.ForwardHeader != "" {
+			r.Header.Del(v.cfg.ForwardHeader)
+		}
+		if !v.Enabled() {
+			next(w, r)
+			return
+		}
+		identity, err := v.Verify(r)
+		if err != nil && (err != errNoCertificate || v.cfg.Verify == "required") {
+			requestid.Logger(r.Context()).Warnf("Client certificate rejected for %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if identity != "" {
+			ctx, res := forward.WithResult(r.Context())
+			res.ClientIdentity = identity
+			r = r.WithContext(ctx)
+			if v.cfg.ForwardHeader != "" {
+				r.Header.Set(v.cfg.ForwardHeader, identity)
+			}
+		}
+		next(w, r)
+	}
+}
+
+// allowed checks cert against the allow-lists. A certificate passes if its CN matches an entry of
+// allowed_cns or any of its SANs matches an entry of allowed_sans; without lists all pass.
+func (v *Verifier) allowed(cert *x509.Certificate) error {
+	if len(v.cfg.AllowedCNs) == 0 && len(v.cfg.AllowedSANs) == 0 {
+		return nil
+	}
+	if cert.Subject.CommonName != "" && matchAny(v.cfg.AllowedCNs, cert.Subject.CommonName) {
+		return nil
+	}
+	for _, san := range sans(cert) {
+		if matchAny(v.cfg.AllowedSANs, san) {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate %q is not in the allowed CNs or SANs", Identity(cert))
+}
+
+// Identity names a client certificate by its subject CN, or by its first SAN without one.
+func Identity(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if names := sans(cert); len(names) > 0 {
+		return names[0]
+	}
+	return ""
+}
+
+// sans lists the DNS, email, URI and IP subject alternative names of cert.
+func sans(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// matchAny reports whether name equals or matches one of the glob patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if p == name {
+			return true
+		}
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/forward"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+// newCA creates a CA and writes its certificate to a PEM file.
+func newCA(t *testing.T, name string) testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	file := filepath.Join(t.TempDir(), name+".pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return testCA{cert: cert, key: key, file: file}
+}
+
+// issue signs a client certificate with the given CN and URI SAN.
+func (ca testCA) issue(t *testing.T, cn, uri string) tls.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if uri != "" {
+		u, _ := url.Parse(uri)
+		tmpl.URIs = []*url.URL{u}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startServer serves handler over TLS, letting configure adjust the server's TLS config.
+func startServer(t *testing.T, handler http.HandlerFunc, configure func(*tls.Config)) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(handler)
+	srv.TLS = &tls.Config{}
+	configure(srv.TLS)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// get requests url presenting cert, if any.
+func get(srv *httptest.Server, cert *tls.Certificate, header http.Header) (*http.Response, error) {
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	if cert != nil {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+	}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func TestMiddleware(t *testing.T) {
+	ca := newCA(t, "internal-ca")
+	other := newCA(t, "other-ca")
+	svcA := ca.issue(t, "svc-a", "")
+	sanOnly := ca.issue(t, "", "spiffe://internal/payments")
+	foreign := other.issue(t, "svc-a", "")
+
+	tests := []struct {
+		name       string
+		cfg        config.ClientAuthConfig
+		cert       *tls.Certificate
+		wantStatus int
+		wantHeader string
+	}{
+		{"required without certificate", config.ClientAuthConfig{Verify: "required"}, nil, http.StatusForbidden, ""},
+		{"required with certificate", config.ClientAuthConfig{Verify: "required"}, &svcA, http.StatusOK, "svc-a"},
+		{"certificate from another CA", config.ClientAuthConfig{Verify: "optional"}, &foreign, http.StatusForbidden, ""},
+		{"optional without certificate", config.ClientAuthConfig{Verify: "optional"}, nil, http.StatusOK, ""},
+		{"CN allowed", config.ClientAuthConfig{Verify: "required", AllowedCNs: []string{"svc-*"}}, &svcA, http.StatusOK, "svc-a"},
+		{"CN not allowed", config.ClientAuthConfig{Verify: "required", AllowedCNs: []string{"svc-b"}}, &svcA, http.StatusForbidden, ""},
+		{"SAN allowed", config.ClientAuthConfig{Verify: "required", AllowedCNs: []string{"svc-b"}, AllowedSANs: []string{"spiffe://internal/*"}}, &sanOnly, http.StatusOK, "spiffe://internal/payments"},
+		{"SAN not allowed", config.ClientAuthConfig{Verify: "required", AllowedSANs: []string{"spiffe://internal/billing"}}, &sanOnly, http.StatusForbidden, ""},
+		{"verify none", config.ClientAuthConfig{Verify: "none"}, &foreign, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.CAFile = ca.file
+			cfg.ForwardHeader = "x-client-cert"
+			v, err := New(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotHeader, gotIdentity string
+			srv := startServer(t, func(w http.ResponseWriter, r *http.Request) {
+				ctx, _ := forward.WithResult(r.Context())
+				v.Middleware(func(w http.ResponseWriter, r *http.Request) {
+					gotHeader = r.Header.Get("X-Client-Cert")
+					_, res := forward.WithResult(r.Context())
+					gotIdentity = res.ClientIdentity
+				})(w, r.WithContext(ctx))
+			}, func(c *tls.Config) { c.ClientAuth = tls.RequestClientCert })
+
+			// A header sent by the client never reaches the backend
+			resp, err := get(srv, tt.cert, http.Header{"X-Client-Cert": {"spoofed"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+			if gotHeader != tt.wantHeader || gotIdentity != tt.wantHeader {
+				t.Errorf("expected identity %q, got header %q and result %q", tt.wantHeader, gotHeader, gotIdentity)
+			}
+		})
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	ca := newCA(t, "internal-ca")
+	svcA := ca.issue(t, "svc-a", "")
+	svcB := ca.issue(t, "svc-b", "")
+
+	v, err := New(config.ClientAuthConfig{Verify: "required", CAFile: ca.file, AllowedCNs: []string{"svc-a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var identity string
+	srv := startServer(t, v.Middleware(func(w http.ResponseWriter, r *http.Request) {
+		_, res := forward.WithResult(r.Context())
+		identity = res.ClientIdentity
+	}), v.Configure)
+
+	if _, err := get(srv, nil, nil); err == nil {
+		t.Error("expected the handshake to fail without a client certificate")
+	}
+	if _, err := get(srv, &svcB, nil); err == nil {
+		t.Error("expected the handshake to fail for a CN outside the allow-list")
+	}
+	resp, err := get(srv, &svcA, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || identity != "svc-a" {
+		t.Errorf("expected 200 for svc-a, got %d with identity %q", resp.StatusCode, identity)
+	}
+}
+
+func TestNew_MissingCA(t *testing.T) {
+	if _, err := New(config.ClientAuthConfig{Verify: "required"}); err == nil {
+		t.Error("expected an error without ca_file")
+	}
+	if _, err := New(config.ClientAuthConfig{Verify: "required", CAFile: "missing.pem"}); err == nil {
+		t.Error("expected an error for a missing CA file")
+	}
+}
@@ -0,0 +1,174 @@
+// Rotates the proxies backend requests leave through, benching exits that fail or get banned.
+package proxypool
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abswn/revproxy-go/internal/ban"
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/metrics"
+)
+
+var benched = metrics.NewCounter("revproxy_proxy_exits_benched_total",
+	"Times a proxy exit was benched, by pool and reason (ban or health).", "pool", "reason")
+
+// Pool selects an exit per request among those of a pool that are not benched. Exits are benched
+// when a response through them triggers a ban rule, or after consecutive connection failures.
+// Bans stay with the exit, never with the backend URL.
+type Pool struct {
+	name    string
+	cfg     config.ProxyPoolConfig
+	labels  map[string]string // proxy -> proxy URL without credentials, for logs
+	bans    *ban.BanManager
+	counter uint32
+
+	mu       sync.Mutex
+	failures map[string]int // consecutive connection failures by proxy
+}
+
+// New creates the pool name from cfg, which LoadProxyPools has validated.
+func New(name string, cfg config.ProxyPoolConfig) *Pool {
+	if cfg.MaxFailures == 0 {
+		cfg.MaxFailures = 3
+	}
+	if cfg.BenchDuration == 0 {
+		cfg.BenchDuration = 30
+	}
+	p := &Pool{
+		name:     name,
+		cfg:      cfg,
+		labels:   make(map[string]string, len(cfg.Exits)),
+		bans:     ban.NewManager(),
+		failures: make(map[string]int),
+	}
+	for _, e := range cfg.Exits {
+		p.labels[e.Proxy] = e.Proxy
+		if u, err := url.Parse(e.Proxy); err == nil {
+			p.labels[e.Proxy] = u.Redacted()
+		}
+	}
+	return p
+}
+
+// Name returns the pool's name.
+func (p *Pool) Name() string {
+	return p.name
+}
+
+// Retries returns how many other exits a request may try after the first one.
+func (p *Pool) Retries() int {
+	return p.cfg.Retries
+}
+
+// Label identifies exit in logs without its credentials.
+func (p *Pool) Label(exit config.ProxyExitConfig) string {
+	return p.labels[exit.Proxy]
+}
+
+// Select picks the exit of a request among those neither benched nor already tried. clientKey
+// keys the sticky strategy unless the sticky header is present.
+func (p *Pool) Select(r *http.Request, clientKey string, tried []string) (config.ProxyExitConfig, bool) {
+	usable := func(e config.ProxyExitConfig) bool {
+		return !p.bans.IsBanned(e.Proxy) && !slices.Contains(tried, e.Proxy)
+	}
+	exits := p.cfg.Exits
+	switch p.cfg.Strategy {
+	case "random":
+		var candidates []config.ProxyExitConfig
+		for _, e := range exits {
+			if usable(e) {
+				candidates = append(candidates, e)
+			}
+		}
+		if len(candidates) == 0 {
+			return config.ProxyExitConfig{}, false
+		}
+		return candidates[rand.Intn(len(candidates))], true
+	case "sticky":
+		if p.cfg.StickyHeader != "" {
+			if v := r.Header.Get(p.cfg.StickyHeader); v != "" {
+				clientKey = v
+			}
+		}
+		// Rendezvous hashing: a client keeps its exit while it is usable, and only the clients
+		// of a benched exit move elsewhere
+		var best config.ProxyExitConfig
+		var bestScore uint64
+		found := false
+		for _, e := range exits {
+			if !usable(e) {
+				continue
+			}
+			h := fnv.New64a()
+			h.Write([]byte(clientKey + "\x00" + e.Proxy))
+			if score := h.Sum64(); !found || score > bestScore {
+				best, bestScore, found = e, score, true
+			}
+		}
+		return best, found
+	default:
+		for range exits {
+			index := atomic.AddUint32(&p.counter, 1) - 1
+			if e := exits[int(index)%len(exits)]; usable(e) {
+				return e, true
+			}
+		}
+		return config.ProxyExitConfig{}, false
+	}
+}
+
+// Available reports whether an exit besides the tried ones can take a request.
+func (p *Pool) Available(tried []string) bool {
+	for _, e := range p.cfg.Exits {
+		if !p.bans.IsBanned(e.Proxy) && !slices.Contains(tried, e.Proxy) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ban benches exit for d after a response through it triggered a ban rule.
+func (p *Pool) Ban(exit config.ProxyExitConfig, d time.Duration) {
+	p.bans.BanURL(exit.Proxy, d)
+	benched.Inc(p.name, "ban")
+}
+
+// Failed records a connection failure through exit, benching it once MaxFailures happened in a row.
+// logger is the logger of the request that failed.
+func (p *Pool) Failed(exit config.ProxyExitConfig, logger *log.Entry) {
+	p.mu.Lock()
+	p.failures[exit.Proxy]++
+	failures := p.failures[exit.Proxy]
+	if failures >= p.cfg.MaxFailures {
+		delete(p.failures, exit.Proxy)
+	}
+	p.mu.Unlock()
+	if failures < p.cfg.MaxFailures {
+		return
+	}
+	d := time.Duration(p.cfg.BenchDuration) * time.Second
+	p.bans.BanURL(exit.Proxy, d)
+	benched.Inc(p.name, "health")
+	logger.Warnf("Benching exit %s of proxy pool %s for %s after %d connection failures", p.Label(exit), p.name, d, failures)
+}
+
+// Succeeded records that a connection through exit was set up, resetting its failure count.
+func (p *Pool) Succeeded(exit config.ProxyExitConfig) {
+	p.mu.Lock()
+	delete(p.failures, exit.Proxy)
+	p.mu.Unlock()
+}
+
+// Benched reports whether exit is currently benched.
+func (p *Pool) Benched(exit config.ProxyExitConfig) bool {
+	return p.bans.IsBanned(exit.Proxy)
+}
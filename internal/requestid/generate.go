@@ -0,0 +1,61 @@
+package requestid
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// crockford is the base32 alphabet used by ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// timestamped returns 16 random bytes whose first 6 bytes are the current Unix time in milliseconds.
+func timestamped() [16]byte {
+	var b [16]byte
+	rand.Read(b[6:])
+	ms := uint64(time.Now().UnixMilli())
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+	return b
+}
+
+// NewUUIDv7 returns a time-ordered RFC 9562 version 7 UUID.
+func NewUUIDv7() string {
+	b := timestamped()
+	b[6] = b[6]&0x0f | 0x70 // version 7
+	b[8] = b[8]&0x3f | 0x80 // RFC 9562 variant
+	var s [36]byte
+	hex.Encode(s[0:8], b[0:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], b[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], b[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], b[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:], b[10:])
+	return string(s[:])
+}
+
+// NewULID returns a 26 character ULID: a millisecond timestamp followed by 80 random bits.
+func NewULID() string {
+	b := timestamped()
+	// The 128 bits are encoded 5 at a time, the first character holding only the top 3 bits
+	bit := func(i int) byte {
+		if i < 0 {
+			return 0
+		}
+		return b[i/8] >> (7 - uint(i%8)) & 1
+	}
+	var s [26]byte
+	for i := range s {
+		var v byte
+		for j := i*5 - 2; j < i*5+3; j++ {
+			v = v<<1 | bit(j)
+		}
+		s[i] = crockford[v]
+	}
+	return string(s[:])
+}
@@ -0,0 +1,112 @@
+// Attaches an ID to every request and provides a logger that includes it.
+package requestid
+
+import (
+	"context"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+// DefaultHeader carries the request ID when no header is configured.
+const DefaultHeader = "X-Request-ID"
+
+// maxLength bounds incoming IDs so clients cannot inflate log lines.
+const maxLength = 128
+
+type idKey struct{}
+
+// WithID returns a context carrying id.
+func WithID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, idKey{}, id)
+}
+
+// FromContext returns the request ID in ctx, or an empty string.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(idKey{}).(string)
+	return id
+}
+
+// Logger returns a logrus entry that tags every line with the request ID in ctx.
+func Logger(ctx context.Context) *log.Entry {
+	if id := FromContext(ctx); id != "" {
+		return log.WithField("request_id", id)
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// valid reports whether an incoming ID is short and made of printable ASCII without spaces.
+func valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Middleware assigns a request ID, or keeps a valid incoming one if allowed, and sets it on the
+// request headers forwarded upstream, the response to the client and the request context.
+func Middleware(cfg config.RequestIDConfig, next http.HandlerFunc) http.HandlerFunc {
+	header := http.CanonicalHeaderKey(cfg.Header)
+	if header == "" {
+		header = DefaultHeader
+	}
+	generate := NewUUIDv7
+	if cfg.Format == "ulid" {
+		generate = NewULID
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(header)
+		if !cfg.AcceptIncoming || !valid(id) {
+			id = generate()
+		}
+		r.Header.Set(header, id)
+		w.Header().Set(header, id)
+		next(&responseWriter{ResponseWriter: w, header: header, id: id}, r.WithContext(WithID(r.Context(), id)))
+	}
+}
+
+// responseWriter restores the ID header before the response is sent, since handlers copying
+// backend headers may have replaced it.
+type responseWriter struct {
+	http.ResponseWriter
+	header      string
+	id          string
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Set(w.header, w.id)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets streamed responses reach the client through the wrapper.
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,112 @@
+package requestid
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+var (
+	uuidv7Re = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	ulidRe   = regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+)
+
+func TestNewUUIDv7(t *testing.T) {
+	before := time.Now().UnixMilli()
+	id := NewUUIDv7()
+	if !uuidv7Re.MatchString(id) {
+		t.Fatalf("invalid UUIDv7 %q", id)
+	}
+	var ms int64
+	for _, c := range strings.ReplaceAll(id[:13], "-", "") {
+		ms = ms<<4 | int64(strings.IndexRune("0123456789abcdef", c))
+	}
+	if ms < before || ms > time.Now().UnixMilli() {
+		t.Errorf("expected timestamp around now, got %d", ms)
+	}
+	if NewUUIDv7() == id {
+		t.Error("expected unique IDs")
+	}
+}
+
+func TestNewULID(t *testing.T) {
+	before := time.Now().UnixMilli()
+	id := NewULID()
+	if !ulidRe.MatchString(id) {
+		t.Fatalf("invalid ULID %q", id)
+	}
+	var ms int64
+	for _, c := range id[:10] {
+		ms = ms<<5 | int64(strings.IndexRune(crockford, c))
+	}
+	if ms < before || ms > time.Now().UnixMilli() {
+		t.Errorf("expected timestamp around now, got %d", ms)
+	}
+}
+
+func TestMiddleware_GeneratesID(t *testing.T) {
+	var upstream, fromCtx string
+	handler := Middleware(config.RequestIDConfig{}, func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Get("X-Request-ID")
+		fromCtx = FromContext(r.Context())
+		// Simulate backend headers replacing the ID
+		w.Header().Set("X-Request-ID", "from-backend")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Request-ID", "client-supplied")
+	rw := httptest.NewRecorder()
+	handler(rw, r)
+
+	if !uuidv7Re.MatchString(upstream) || upstream != fromCtx {
+		t.Errorf("expected generated ID upstream and in context, got %q and %q", upstream, fromCtx)
+	}
+	if got := rw.Header().Get("X-Request-ID"); got != upstream {
+		t.Errorf("expected response ID %q, got %q", upstream, got)
+	}
+}
+
+func TestMiddleware_AcceptIncoming(t *testing.T) {
+	cfg := config.RequestIDConfig{Header: "x-correlation-id", Format: "ulid", AcceptIncoming: true}
+	var got string
+	handler := Middleware(cfg, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-Correlation-Id")
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Correlation-Id", "abc-123")
+	rw := httptest.NewRecorder()
+	handler(rw, r)
+	if got != "abc-123" || rw.Header().Get("X-Correlation-Id") != "abc-123" {
+		t.Errorf("expected incoming ID to be kept, got %q", got)
+	}
+
+	for _, invalid := range []string{"has space", strings.Repeat("a", maxLength+1)} {
+		r = httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Correlation-Id", invalid)
+		handler(httptest.NewRecorder(), r)
+		if !ulidRe.MatchString(got) {
+			t.Errorf("expected invalid ID %q to be replaced by a ULID, got %q", invalid, got)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	Logger(WithID(httptest.NewRequest(http.MethodGet, "/", nil).Context(), "req-42")).Info("hello")
+	if !strings.Contains(out.String(), "request_id=req-42") {
+		t.Errorf("expected request_id field, got %q", out.String())
+	}
+}
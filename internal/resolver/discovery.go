@@ -0,0 +1,178 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+const (
+	defaultTTL    = 30 * time.Second
+	lookupTimeout = 5 * time.Second
+)
+
+// Discovery keeps the targets of an endpoint. URLs with dns.discover stand for one target per DNS
+// record, resolved again once their TTL has passed; the other URLs are targets as they are.
+type Discovery struct {
+	urls    []config.URLConfig
+	sources []*source // per URL, nil for URLs without discovery
+	dynamic bool
+}
+
+// source holds the targets discovered from one URL.
+type source struct {
+	endpoint string
+	url      config.URLConfig
+	ttl      time.Duration
+
+	mu         sync.Mutex
+	targets    []config.URLConfig
+	expires    time.Time
+	refreshing bool
+}
+
+// NewDiscovery resolves the discovered URLs of an endpoint once. A URL that cannot be resolved yet
+// contributes no target until a later lookup succeeds.
+func NewDiscovery(endpoint string, urls []config.URLConfig) *Discovery {
+	d := &Discovery{urls: urls, sources: make([]*source, len(urls))}
+	for i, u := range urls {
+		if u.DNS == nil || u.DNS.Discover == "" {
+			continue
+		}
+		s := &source{endpoint: endpoint, url: u, ttl: defaultTTL}
+		if u.DNS.TTL > 0 {
+			s.ttl = time.Duration(u.DNS.TTL) * time.Second
+		}
+		s.refresh()
+		d.sources[i] = s
+		d.dynamic = true
+	}
+	return d
+}
+
+// Targets returns the current targets in configuration order, starting the lookups of expired
+// records in the background.
+func (d *Discovery) Targets() []config.URLConfig {
+	if !d.dynamic {
+		return d.urls
+	}
+	var targets []config.URLConfig
+	for i, u := range d.urls {
+		if s := d.sources[i]; s != nil {
+			targets = append(targets, s.current()...)
+		} else {
+			targets = append(targets, u)
+		}
+	}
+	return targets
+}
+
+// current returns the targets of s, refreshing them in the background once expired.
+func (s *source) current() []config.URLConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.refreshing && time.Now().After(s.expires) {
+		s.refreshing = true
+		go s.refresh()
+	}
+	return s.targets
+}
+
+// refresh looks the records up again. The previous targets are kept when the lookup fails or
+// finds nothing.
+func (s *source) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	targets, err := s.lookup(ctx)
+	if err == nil && len(targets) == 0 {
+		err = fmt.Errorf("no records")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshing = false
+	s.expires = time.Now().Add(s.ttl)
+	if err != nil {
+		log.Warnf("Discovery of %s for %s failed, keeping %d target(s): %v", s.url.URL, s.endpoint, len(s.targets), err)
+		return
+	}
+	if !slices.EqualFunc(targets, s.targets, func(a, b config.URLConfig) bool {
+		return a.BanKey() == b.BanKey() && a.Weight == b.Weight
+	}) {
+		log.Infof("Discovered %d target(s) from %s for %s", len(targets), s.url.URL, s.endpoint)
+	}
+	s.targets = targets
+}
+
+// lookup expands the URL into its targets, sorted so that their order only changes with the records.
+func (s *source) lookup(ctx context.Context) ([]config.URLConfig, error) {
+	parsed, err := url.Parse(s.url.URL)
+	if err != nil {
+		return nil, err
+	}
+	host := parsed.Hostname()
+	dns := *s.url.DNS
+	dns.Discover = ""
+
+	var targets []config.URLConfig
+	switch s.url.DNS.Discover {
+	case "a":
+		ips, err := LookupIPs(ctx, &dns, host)
+		if err != nil {
+			return nil, err
+		}
+		// Only the preferred family is used when the host has any
+		if dns.Prefer != "" && rank(dns.Prefer, ips[0]) == 0 {
+			ips = slices.DeleteFunc(ips, func(ip net.IP) bool { return rank(dns.Prefer, ip) != 0 })
+		}
+		for _, ip := range ips {
+			t := s.url
+			pinned := dns
+			pinned.Resolve = ip.String()
+			t.DNS = &pinned
+			targets = append(targets, t)
+		}
+	case "srv":
+		_, records, err := netResolver(&dns).LookupSRV(ctx, "", "", host)
+		if err != nil {
+			return nil, err
+		}
+		// The path is kept as written after the new host, since escaping it would break {name} placeholders
+		_, rest, ok := strings.Cut(s.url.URL, "://")
+		if !ok {
+			return nil, fmt.Errorf("%s has no host", s.url.URL)
+		}
+		if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+			rest = rest[i:]
+		} else {
+			rest = ""
+		}
+		// Only the records of the lowest priority value are used, the others are ignored
+		for _, rec := range records {
+			if rec.Priority != records[0].Priority {
+				continue
+			}
+			t := s.url
+			u := url.URL{Scheme: parsed.Scheme, User: parsed.User}
+			u.Host = net.JoinHostPort(strings.TrimSuffix(rec.Target, "."), strconv.Itoa(int(rec.Port)))
+			t.URL = u.String() + rest
+			t.DNS = &dns
+			if rec.Weight > 0 {
+				t.Weight = int(rec.Weight)
+			}
+			targets = append(targets, t)
+		}
+	}
+	slices.SortFunc(targets, func(a, b config.URLConfig) int { return strings.Compare(a.BanKey(), b.BanKey()) })
+	return targets, nil
+}
@@ -0,0 +1,82 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+// keys lists the ban keys of targets.
+func keys(targets []config.URLConfig) string {
+	var k []string
+	for _, t := range targets {
+		k = append(k, fmt.Sprintf("%s/%d", t.BanKey(), t.Weight))
+	}
+	return fmt.Sprint(k)
+}
+
+func TestDiscovery_A(t *testing.T) {
+	dns := startStubDNS(t)
+	dns.set("api.test", []string{"192.0.2.2", "192.0.2.1", "2001:db8::1"}, nil)
+
+	static := config.URLConfig{URL: "http://static.test/v1", Weight: 1}
+	urls := []config.URLConfig{
+		static,
+		{URL: "http://api.test:8080/v1", Weight: 2, DNS: &config.DNSConfig{Server: dns.addr, Discover: "a", Prefer: "ipv4", TTL: 1}},
+	}
+	d := NewDiscovery("api", urls)
+	want := "[http://static.test/v1/1 http://api.test:8080/v1@192.0.2.1/2 http://api.test:8080/v1@192.0.2.2/2]"
+	if got := keys(d.Targets()); got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	if target := d.Targets()[1]; target.DNS.Discover != "" || target.DNS.Server != dns.addr || urls[1].DNS.Resolve != "" {
+		t.Errorf("expected pinned copies keeping the other settings, got %+v", *target.DNS)
+	}
+
+	// Changed records are picked up once the TTL has passed
+	dns.set("api.test", []string{"192.0.2.3"}, nil)
+	want = "[http://static.test/v1/1 http://api.test:8080/v1@192.0.2.3/2]"
+	deadline := time.Now().Add(5 * time.Second)
+	for keys(d.Targets()) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s after the TTL, got %s", want, keys(d.Targets()))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Failed lookups keep the previous targets
+	dns.set("api.test", nil, nil)
+	time.Sleep(1500 * time.Millisecond)
+	d.Targets()
+	time.Sleep(200 * time.Millisecond)
+	if got := keys(d.Targets()); got != want {
+		t.Errorf("expected the targets to be kept, got %s", got)
+	}
+}
+
+func TestDiscovery_SRV(t *testing.T) {
+	dns := startStubDNS(t)
+	dns.set("_http._tcp.api.test", nil, []net.SRV{
+		{Target: "b.api.test.", Port: 8081, Priority: 10, Weight: 3},
+		{Target: "a.api.test.", Port: 8080, Priority: 10, Weight: 1},
+		{Target: "backup.api.test.", Port: 8080, Priority: 20, Weight: 1},
+	})
+
+	d := NewDiscovery("api", []config.URLConfig{
+		{URL: "https://_http._tcp.api.test/v1/{id}", Weight: 5, DNS: &config.DNSConfig{Server: dns.addr, Discover: "srv"}},
+	})
+	want := "[https://a.api.test:8080/v1/{id}/1 https://b.api.test:8081/v1/{id}/3]"
+	if got := keys(d.Targets()); got != want {
+		t.Errorf("expected the lowest priority records, got %s", got)
+	}
+}
+
+func TestDiscovery_Static(t *testing.T) {
+	urls := []config.URLConfig{{URL: "http://a.test"}, {URL: "http://b.test", DNS: &config.DNSConfig{Resolve: "192.0.2.1"}}}
+	if got := NewDiscovery("api", urls).Targets(); &got[0] != &urls[0] {
+		t.Error("expected URLs without discovery to be used as they are")
+	}
+}
@@ -0,0 +1,87 @@
+// Resolves backend hosts as their URLs' dns settings say, and discovers targets from DNS records.
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+// netResolver returns the resolver querying cfg's server, or the system resolver without one.
+func netResolver(cfg *config.DNSConfig) *net.Resolver {
+	if cfg.Server == "" {
+		return net.DefaultResolver
+	}
+	server := cfg.ServerAddress()
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// LookupIPs returns the addresses of host, those of the preferred family first.
+func LookupIPs(ctx context.Context, cfg *config.DNSConfig, host string) ([]net.IP, error) {
+	ips, err := netResolver(cfg).LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	if cfg.Prefer != "" {
+		slices.SortStableFunc(ips, func(a, b net.IP) int {
+			return rank(cfg.Prefer, a) - rank(cfg.Prefer, b)
+		})
+	}
+	return ips, nil
+}
+
+// rank orders ip by preference: 0 for the preferred family, 1 otherwise.
+func rank(prefer string, ip net.IP) int {
+	if (ip.To4() != nil) == (prefer == "ipv4") {
+		return 0
+	}
+	return 1
+}
+
+// Dial wraps dial so that names are resolved as cfg says: pinned to an address, or looked up
+// through its server. The addresses are tried in turn, preferred family first, until one connects.
+func Dial(cfg *config.DNSConfig, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		var ips []net.IP
+		switch {
+		case cfg.Resolve != "":
+			ips = []net.IP{net.ParseIP(cfg.Resolve)}
+		case net.ParseIP(host) != nil:
+			return dial(ctx, network, addr)
+		default:
+			if ips, err = LookupIPs(ctx, cfg, host); err != nil {
+				return nil, err
+			}
+		}
+		var firstErr error
+		for _, ip := range ips {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, firstErr
+	}
+}
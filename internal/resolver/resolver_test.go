@@ -0,0 +1,166 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/abswn/revproxy-go/internal/config"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubDNS answers A, AAAA and SRV queries from its records over UDP.
+type stubDNS struct {
+	addr string
+
+	mu  sync.Mutex
+	ips map[string][]net.IP  // name -> addresses
+	srv map[string][]net.SRV // name -> records
+}
+
+func startStubDNS(t *testing.T) *stubDNS {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	s := &stubDNS{addr: pc.LocalAddr().String(), ips: make(map[string][]net.IP), srv: make(map[string][]net.SRV)}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if msg, err := s.answer(buf[:n]); err == nil {
+				pc.WriteTo(msg, from)
+			}
+		}
+	}()
+	return s
+}
+
+// set replaces the records of name, given without its trailing dot.
+func (s *stubDNS) set(name string, ips []string, srv []net.SRV) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ips[name+"."] = nil
+	for _, ip := range ips {
+		s.ips[name+"."] = append(s.ips[name+"."], net.ParseIP(ip))
+	}
+	s.srv[name+"."] = srv
+}
+
+func (s *stubDNS) answer(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := strings.ToLower(q.Name.String())
+	ips, knownIPs := s.ips[name]
+	srv, knownSRV := s.srv[name]
+	rcode := dnsmessage.RCodeSuccess
+	if !knownIPs && !knownSRV {
+		rcode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true, RecursionAvailable: true, RCode: rcode})
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 1}
+	switch q.Type {
+	case dnsmessage.TypeA:
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				b.AResource(rh, dnsmessage.AResource{A: [4]byte(ip4)})
+			}
+		}
+	case dnsmessage.TypeAAAA:
+		for _, ip := range ips {
+			if ip.To4() == nil {
+				b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())})
+			}
+		}
+	case dnsmessage.TypeSRV:
+		for _, r := range srv {
+			b.SRVResource(rh, dnsmessage.SRVResource{Priority: r.Priority, Weight: r.Weight, Port: r.Port,
+				Target: dnsmessage.MustNewName(r.Target)})
+		}
+	}
+	return b.Finish()
+}
+
+func TestLookupIPs(t *testing.T) {
+	dns := startStubDNS(t)
+	dns.set("api.test", []string{"192.0.2.1", "2001:db8::1", "192.0.2.2"}, nil)
+
+	tests := []struct {
+		prefer string
+		first  string
+	}{
+		{"ipv6", "2001:db8::1"},
+		{"ipv4", "192.0.2."},
+	}
+	for _, tt := range tests {
+		ips, err := LookupIPs(context.Background(), &config.DNSConfig{Server: dns.addr, Prefer: tt.prefer}, "api.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 3 || !strings.HasPrefix(ips[0].String(), tt.first) {
+			t.Errorf("prefer %s: expected 3 addresses starting with %s, got %v", tt.prefer, tt.first, ips)
+		}
+	}
+	if _, err := LookupIPs(context.Background(), &config.DNSConfig{Server: dns.addr}, "missing.test"); err == nil {
+		t.Error("expected an unknown name to fail")
+	}
+}
+
+func TestDial(t *testing.T) {
+	dns := startStubDNS(t)
+	// The first address refuses connections, so the dialer moves on to the next one
+	dns.set("api.test", []string{"2001:db8::1", "192.0.2.1"}, nil)
+
+	var dialed []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if addr == "[2001:db8::1]:8080" {
+			return nil, errors.New("connection refused")
+		}
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	}
+	tests := []struct {
+		cfg  config.DNSConfig
+		addr string
+		want string
+	}{
+		{config.DNSConfig{Resolve: "198.51.100.7"}, "api.test:8080", "[198.51.100.7:8080]"},
+		{config.DNSConfig{Server: dns.addr, Prefer: "ipv6"}, "api.test:8080", "[[2001:db8::1]:8080 192.0.2.1:8080]"},
+		{config.DNSConfig{Server: dns.addr, Prefer: "ipv4"}, "api.test:8080", "[192.0.2.1:8080]"},
+		{config.DNSConfig{Server: dns.addr}, "203.0.113.9:8080", "[203.0.113.9:8080]"},
+	}
+	for _, tt := range tests {
+		dialed = nil
+		conn, err := Dial(&tt.cfg, dial)(context.Background(), "tcp", tt.addr)
+		if err != nil {
+			t.Fatalf("%+v: %v", tt.cfg, err)
+		}
+		conn.Close()
+		if got := fmt.Sprint(dialed); got != tt.want {
+			t.Errorf("%+v: expected to dial %s, got %s", tt.cfg, tt.want, got)
+		}
+	}
+}
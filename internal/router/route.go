@@ -0,0 +1,190 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+// Path kinds, most specific first.
+const (
+	kindExact = iota
+	kindPrefix
+	kindPattern
+)
+
+// route is a compiled RouteConfig.
+type route struct {
+	kind     int
+	path     string         // exact or prefix path
+	pattern  *regexp.Regexp // regex or compiled glob
+	methods  []string
+	headers  map[string]string
+	query    map[string]string
+	priority int
+	handler  http.Handler
+}
+
+// newRoute compiles rc.
+func newRoute(rc config.RouteConfig, h http.Handler) (*route, error) {
+	r := &route{
+		methods:  rc.Methods,
+		headers:  rc.Headers,
+		query:    rc.Query,
+		priority: rc.Priority,
+		handler:  h,
+	}
+	switch {
+	case rc.Regex != "":
+		// The regex matches the whole path, as globs do
+		re, err := regexp.Compile("^(?:" + rc.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid route regex '%s': %v", rc.Regex, err)
+		}
+		r.kind, r.pattern = kindPattern, re
+	case rc.Glob != "":
+		re, err := compileGlob(rc.Glob)
+		if err != nil {
+			return nil, err
+		}
+		r.kind, r.pattern = kindPattern, re
+	case strings.HasSuffix(rc.Path, "/"):
+		r.kind, r.path = kindPrefix, rc.Path
+	case rc.Path != "":
+		r.kind, r.path = kindExact, rc.Path
+	default:
+		return nil, fmt.Errorf("route path, regex or glob must be specified")
+	}
+	return r, nil
+}
+
+// before reports whether r must be tried before o: higher priority first, then exact paths,
+// longer prefixes, patterns, and finally routes with more method/header/query conditions.
+func (r *route) before(o *route) bool {
+	if r.priority != o.priority {
+		return r.priority > o.priority
+	}
+	if r.kind != o.kind {
+		return r.kind < o.kind
+	}
+	if r.kind == kindPrefix && len(r.path) != len(o.path) {
+		return len(r.path) > len(o.path)
+	}
+	return r.conditions() > o.conditions()
+}
+
+// conditions counts the non-path conditions of r.
+func (r *route) conditions() int {
+	n := len(r.headers) + len(r.query)
+	if len(r.methods) > 0 {
+		n++
+	}
+	return n
+}
+
+// match reports whether req, with cleaned path p, matches r and returns the named captures.
+func (r *route) match(req *http.Request, p string) (map[string]string, bool) {
+	var captures map[string]string
+	switch r.kind {
+	case kindExact:
+		if p != r.path {
+			return nil, false
+		}
+	case kindPrefix:
+		if !strings.HasPrefix(p, r.path) {
+			return nil, false
+		}
+	case kindPattern:
+		m := r.pattern.FindStringSubmatch(p)
+		if m == nil {
+			return nil, false
+		}
+		for i, name := range r.pattern.SubexpNames() {
+			if name != "" {
+				if captures == nil {
+					captures = make(map[string]string)
+				}
+				captures[name] = m[i]
+			}
+		}
+	}
+	if len(r.methods) > 0 && !slices.Contains(r.methods, req.Method) &&
+		!(req.Method == http.MethodHead && slices.Contains(r.methods, http.MethodGet)) {
+		return nil, false
+	}
+	for name, want := range r.headers {
+		if !valueMatches(req.Header.Values(name), want) {
+			return nil, false
+		}
+	}
+	if len(r.query) > 0 {
+		q := req.URL.Query()
+		for name, want := range r.query {
+			if !valueMatches(q[name], want) {
+				return nil, false
+			}
+		}
+	}
+	return captures, true
+}
+
+// valueMatches reports whether values is non-empty and, if want is set, contains want.
+func valueMatches(values []string, want string) bool {
+	if len(values) == 0 {
+		return false
+	}
+	return want == "" || slices.Contains(values, want)
+}
+
+// compileGlob converts a glob into an anchored regexp: ** matches anything, * and ? match within
+// a segment, and {name} captures a segment as name.
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '{':
+			end := strings.IndexByte(glob[i:], '}')
+			if end == -1 {
+				return nil, fmt.Errorf("invalid route glob '%s': unclosed {", glob)
+			}
+			fmt.Fprintf(&b, "(?P<%s>[^/]+)", glob[i+1:i+end])
+			i += end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid route glob '%s': %v", glob, err)
+	}
+	return re, nil
+}
+
+// cleanPath normalizes p like http.ServeMux, keeping a trailing slash.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	np := path.Clean(p)
+	if strings.HasSuffix(p, "/") && np != "/" {
+		np += "/"
+	}
+	return np
+}
@@ -0,0 +1,154 @@
+// Routes requests to endpoint handlers by virtual host (Host header or TLS SNI), path, method,
+// headers and query parameters.
+package router
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+// vhost holds the routes of one virtual host, in match order.
+type vhost struct {
+	routes []*route
+}
+
+// add inserts r keeping the routes sorted by priority, then specificity.
+func (v *vhost) add(r *route) {
+	v.routes = append(v.routes, r)
+	sort.SliceStable(v.routes, func(i, j int) bool {
+		return v.routes[i].before(v.routes[j])
+	})
+}
+
+// match returns the first route matching req.
+func (v *vhost) match(req *http.Request) (*route, map[string]string) {
+	path := cleanPath(req.URL.Path)
+	for _, r := range v.routes {
+		if captures, ok := r.match(req, path); ok {
+			return r, captures
+		}
+	}
+	return nil, nil
+}
+
+// wildcardHost is a "*.suffix" virtual host.
+type wildcardHost struct {
+	suffix string // ".example.com"
+	vhost  *vhost
+}
+
+// Router dispatches requests to the first matching route of the matching virtual host. Requests
+// whose host matches no virtual host, or that match no route there, fall back to the default host.
+type Router struct {
+	exact     map[string]*vhost
+	wildcards []wildcardHost // longest suffix first
+	fallback  *vhost
+}
+
+// New creates an empty Router.
+func New() *Router {
+	return &Router{
+		exact:    make(map[string]*vhost),
+		fallback: &vhost{},
+	}
+}
+
+// Handle registers h for requests to host matching rc. An empty host registers on the default
+// virtual host, a host starting with "*." matches any subdomain of the rest.
+func (rt *Router) Handle(host string, rc config.RouteConfig, h http.Handler) error {
+	r, err := newRoute(rc, h)
+	if err != nil {
+		return err
+	}
+	rt.vhostFor(strings.ToLower(host)).add(r)
+	return nil
+}
+
+// vhostFor returns the virtual host of host, creating it if needed.
+func (rt *Router) vhostFor(host string) *vhost {
+	if host == "" {
+		return rt.fallback
+	}
+	if suffix, ok := strings.CutPrefix(host, "*"); ok {
+		for _, wc := range rt.wildcards {
+			if wc.suffix == suffix {
+				return wc.vhost
+			}
+		}
+		v := &vhost{}
+		rt.wildcards = append(rt.wildcards, wildcardHost{suffix: suffix, vhost: v})
+		sort.SliceStable(rt.wildcards, func(i, j int) bool {
+			return len(rt.wildcards[i].suffix) > len(rt.wildcards[j].suffix)
+		})
+		return v
+	}
+	v, ok := rt.exact[host]
+	if !ok {
+		v = &vhost{}
+		rt.exact[host] = v
+	}
+	return v
+}
+
+// lookup returns the most specific virtual host matching host, or nil.
+func (rt *Router) lookup(host string) *vhost {
+	if v, ok := rt.exact[host]; ok {
+		return v
+	}
+	for _, wc := range rt.wildcards {
+		if strings.HasSuffix(host, wc.suffix) && len(host) > len(wc.suffix) {
+			return wc.vhost
+		}
+	}
+	return nil
+}
+
+// ServeHTTP routes r by the Host header, falling back to the TLS SNI name, then the default host.
+// Named captures of regex and glob routes are set as path values of the request.
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var matched *route
+	var captures map[string]string
+	for _, host := range requestHosts(r) {
+		if v := rt.lookup(host); v != nil {
+			matched, captures = v.match(r)
+			break
+		}
+	}
+	if matched == nil {
+		matched, captures = rt.fallback.match(r)
+	}
+	if matched == nil {
+		http.NotFound(w, r)
+		return
+	}
+	for name, value := range captures {
+		r.SetPathValue(name, value)
+	}
+	matched.handler.ServeHTTP(w, r)
+}
+
+// requestHosts returns the normalized Host header and SNI name of r, in that order.
+func requestHosts(r *http.Request) []string {
+	var hosts []string
+	if host := normalizeHost(r.Host); host != "" {
+		hosts = append(hosts, host)
+	}
+	if r.TLS != nil {
+		if sni := normalizeHost(r.TLS.ServerName); sni != "" {
+			hosts = append(hosts, sni)
+		}
+	}
+	return hosts
+}
+
+// normalizeHost strips the port and trailing dot and lowercases host.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
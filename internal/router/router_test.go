@@ -0,0 +1,217 @@
+package router
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abswn/revproxy-go/internal/config"
+)
+
+// named returns a handler that writes name as the body.
+func named(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	})
+}
+
+func serve(rt *Router, r *http.Request) (int, string) {
+	rw := httptest.NewRecorder()
+	rt.ServeHTTP(rw, r)
+	return rw.Code, rw.Body.String()
+}
+
+func TestRouter_HostRouting(t *testing.T) {
+	rt := New()
+	rt.Handle("", config.RouteConfig{Path: "/api"}, named("default"))
+	rt.Handle("a.com", config.RouteConfig{Path: "/api"}, named("a"))
+	rt.Handle("*.b.com", config.RouteConfig{Path: "/api"}, named("wildcard-b"))
+	rt.Handle("*.x.b.com", config.RouteConfig{Path: "/api"}, named("wildcard-x-b"))
+	rt.Handle("exact.b.com", config.RouteConfig{Path: "/api"}, named("exact-b"))
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"a.com", "a"},
+		{"A.COM:8443", "a"},
+		{"a.com.", "a"},
+		{"www.b.com", "wildcard-b"},
+		{"deep.www.b.com", "wildcard-b"},
+		{"y.x.b.com", "wildcard-x-b"},
+		{"exact.b.com", "exact-b"},
+		{"b.com", "default"},
+		{"unknown.org", "default"},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api", nil)
+		r.Host = tc.host
+		if _, body := serve(rt, r); body != tc.want {
+			t.Errorf("host %s: got %s, want %s", tc.host, body, tc.want)
+		}
+	}
+}
+
+func TestRouter_FallsBackToDefaultForUnknownPath(t *testing.T) {
+	rt := New()
+	rt.Handle("", config.RouteConfig{Path: "/shared"}, named("default-shared"))
+	rt.Handle("a.com", config.RouteConfig{Path: "/api"}, named("a"))
+
+	r := httptest.NewRequest(http.MethodGet, "/shared", nil)
+	r.Host = "a.com"
+	if _, body := serve(rt, r); body != "default-shared" {
+		t.Errorf("expected fallback to default host, got %s", body)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/missing", nil)
+	r.Host = "a.com"
+	if code, _ := serve(rt, r); code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", code)
+	}
+}
+
+func TestRouter_SNIFallback(t *testing.T) {
+	rt := New()
+	rt.Handle("", config.RouteConfig{Path: "/api"}, named("default"))
+	rt.Handle("sni.com", config.RouteConfig{Path: "/api"}, named("sni"))
+
+	r := httptest.NewRequest(http.MethodGet, "/api", nil)
+	r.Host = "10.0.0.1:443"
+	r.TLS = &tls.ConnectionState{ServerName: "sni.com"}
+	if _, body := serve(rt, r); body != "sni" {
+		t.Errorf("expected routing by SNI, got %s", body)
+	}
+}
+
+func TestRouter_SamePathDifferentHosts(t *testing.T) {
+	rt := New()
+	rt.Handle("a.com", config.RouteConfig{Path: "/api"}, named("a"))
+	rt.Handle("b.com", config.RouteConfig{Path: "/api"}, named("b"))
+
+	for host, want := range map[string]string{"a.com": "a", "b.com": "b"} {
+		r := httptest.NewRequest(http.MethodGet, "/api", nil)
+		r.Host = host
+		if _, body := serve(rt, r); body != want {
+			t.Errorf("host %s: got %s, want %s", host, body, want)
+		}
+	}
+}
+
+func TestRouter_MethodHeaderQuery(t *testing.T) {
+	rt := New()
+	rt.Handle("", config.RouteConfig{Path: "/api", Methods: []string{"GET"}}, named("get"))
+	rt.Handle("", config.RouteConfig{Path: "/api", Methods: []string{"POST"}}, named("post"))
+	rt.Handle("", config.RouteConfig{Path: "/api", Headers: map[string]string{"X-Tenant": "acme"}}, named("acme"))
+	rt.Handle("", config.RouteConfig{Path: "/api", Query: map[string]string{"debug": ""}}, named("debug"))
+	rt.Handle("", config.RouteConfig{Path: "/api"}, named("any"))
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		header map[string]string
+		want   string
+	}{
+		{"get", http.MethodGet, "/api", nil, "get"},
+		{"head uses get", http.MethodHead, "/api", nil, "get"},
+		{"post", http.MethodPost, "/api", nil, "post"},
+		{"header value", http.MethodPut, "/api", map[string]string{"X-Tenant": "acme"}, "acme"},
+		{"other header value", http.MethodPut, "/api", map[string]string{"X-Tenant": "other"}, "any"},
+		{"query presence", http.MethodPut, "/api?debug", nil, "debug"},
+		{"no conditions", http.MethodDelete, "/api", nil, "any"},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		for k, v := range tc.header {
+			r.Header.Set(k, v)
+		}
+		if _, body := serve(rt, r); body != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, body, tc.want)
+		}
+	}
+}
+
+func TestRouter_Priority(t *testing.T) {
+	rt := New()
+	rt.Handle("", config.RouteConfig{Path: "/api/v1"}, named("exact"))
+	rt.Handle("", config.RouteConfig{Path: "/api/"}, named("prefix"))
+	rt.Handle("", config.RouteConfig{Path: "/", Headers: map[string]string{"X-Canary": ""}, Priority: 10}, named("canary"))
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1", nil)
+	if _, body := serve(rt, r); body != "exact" {
+		t.Errorf("expected exact path to win over prefix, got %s", body)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/api/other", nil)
+	if _, body := serve(rt, r); body != "prefix" {
+		t.Errorf("expected prefix route, got %s", body)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/api/v1", nil)
+	r.Header.Set("X-Canary", "1")
+	if _, body := serve(rt, r); body != "canary" {
+		t.Errorf("expected higher priority route to win, got %s", body)
+	}
+}
+
+func TestRouter_RegexAndGlobCaptures(t *testing.T) {
+	rt := New()
+	capture := func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.PathValue("version")+" "+r.PathValue("model"))
+	}
+	if err := rt.Handle("", config.RouteConfig{Regex: `^/(?P<version>v\d+)/(?P<model>[^/]+)/chat$`}, http.HandlerFunc(capture)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Handle("", config.RouteConfig{Glob: "/models/{model}/**"}, http.HandlerFunc(capture)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Handle("", config.RouteConfig{Glob: "/static/*.css"}, named("css")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"/v1/gpt/chat":      "v1 gpt",
+		"/models/llama/a/b": " llama",
+		"/static/site.css":  "css",
+	}
+	for target, want := range tests {
+		if _, body := serve(rt, httptest.NewRequest(http.MethodGet, target, nil)); body != want {
+			t.Errorf("%s: got %q, want %q", target, body, want)
+		}
+	}
+	for _, target := range []string{"/v1/gpt/chat/extra", "/static/dir/site.css"} {
+		if code, _ := serve(rt, httptest.NewRequest(http.MethodGet, target, nil)); code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", target, code)
+		}
+	}
+}
+
+func TestRouter_RegexMatchesWholePath(t *testing.T) {
+	rt := New()
+	if err := rt.Handle("", config.RouteConfig{Regex: "/api/v[0-9]+"}, named("versioned")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Handle("", config.RouteConfig{Path: "/foo/"}, named("foo")); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"/api/v1":       "versioned",
+		"/foo/api/v1/x": "foo",
+	}
+	for target, want := range tests {
+		if _, body := serve(rt, httptest.NewRequest(http.MethodGet, target, nil)); body != want {
+			t.Errorf("%s: got %q, want %q", target, body, want)
+		}
+	}
+	for _, target := range []string{"/api/v1/x", "/x/api/v1"} {
+		if code, _ := serve(rt, httptest.NewRequest(http.MethodGet, target, nil)); code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", target, code)
+		}
+	}
+}
+
+func TestRouter_InvalidGlob(t *testing.T) {
+	if err := New().Handle("", config.RouteConfig{Glob: "/a/{name"}, named("x")); err == nil {
+		t.Error("expected error for unclosed glob capture")
+	}
+}
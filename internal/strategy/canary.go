@@ -0,0 +1,196 @@
+package strategy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/ban"
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/metrics"
+	"github.com/abswn/revproxy-go/internal/requestid"
+)
+
+var (
+	canaryPercentage = metrics.NewGauge("revproxy_canary_percentage",
+		"Current share of clients sent to the canary subset, 0 after a rollback.", "endpoint")
+	canaryRequests = metrics.NewCounter("revproxy_canary_requests_total",
+		"Requests by endpoint, group (canary or stable) and outcome (ok or error).", "endpoint", "group", "outcome")
+)
+
+// Canary splits the targets of an endpoint into the URLs marked canary and the stable remainder.
+// Clients are assigned to the canary stickily by hashing their key, or by a forcing header or cookie.
+// The canary share follows the configured schedule and drops to zero for good once its error rate
+// exceeds the rollback threshold.
+type Canary struct {
+	endpoint string
+	cfg      config.CanaryConfig
+	start    time.Time
+
+	mu          sync.Mutex
+	rolledBack  bool
+	windowStart time.Time
+	total       int
+	errors      int
+}
+
+// NewCanary validates cfg and creates the canary state of an endpoint.
+func NewCanary(endpoint string, cfg config.CanaryConfig) (*Canary, error) {
+	if cfg.Percentage < 0 || cfg.Percentage > 100 {
+		return nil, fmt.Errorf("canary percentage must be between 0 and 100")
+	}
+	steps := append([]config.CanaryStep{}, cfg.Schedule...)
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].After < steps[j].After })
+	for _, step := range steps {
+		if step.Percentage < 0 || step.Percentage > 100 {
+			return nil, fmt.Errorf("canary schedule percentage must be between 0 and 100")
+		}
+	}
+	cfg.Schedule = steps
+	if cfg.Rollback != nil {
+		rb := *cfg.Rollback
+		if rb.ErrorRate <= 0 || rb.ErrorRate > 1 {
+			return nil, fmt.Errorf("canary rollback error_rate must be between 0 and 1")
+		}
+		if rb.Window <= 0 {
+			rb.Window = 60
+		}
+		if rb.MinRequests <= 0 {
+			rb.MinRequests = 20
+		}
+		cfg.Rollback = &rb
+	}
+	c := &Canary{endpoint: endpoint, cfg: cfg, start: time.Now()}
+	c.windowStart = c.start
+	canaryPercentage.Set(c.Percentage(), endpoint)
+	return c, nil
+}
+
+// Percentage returns the current canary share according to the schedule, or 0 after a rollback.
+func (c *Canary) Percentage() float64 {
+	c.mu.Lock()
+	rolledBack := c.rolledBack
+	c.mu.Unlock()
+	if rolledBack {
+		return 0
+	}
+	elapsed := time.Since(c.start)
+	pct := c.cfg.Percentage
+	for _, step := range c.cfg.Schedule {
+		if elapsed < time.Duration(step.After)*time.Second {
+			break
+		}
+		pct = step.Percentage
+	}
+	return pct
+}
+
+// RolledBack reports whether the canary has been disabled by the rollback rule.
+func (c *Canary) RolledBack() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rolledBack
+}
+
+// Split returns the targets the request may be sent to and whether they are the canary subset.
+// If every canary URL is banned the request falls back to the stable subset.
+func (c *Canary) Split(r *http.Request, clientKey string, targets []config.URLConfig, bm *ban.BanManager) ([]config.URLConfig, bool) {
+	var canary, stable []config.URLConfig
+	for _, target := range targets {
+		if target.Canary {
+			canary = append(canary, target)
+		} else {
+			stable = append(stable, target)
+		}
+	}
+	pct := c.Percentage()
+	canaryPercentage.Set(pct, c.endpoint)
+	if len(canary) == 0 || c.RolledBack() || !(c.forced(r) || c.sticky(r, clientKey, pct)) {
+		return stable, false
+	}
+	for _, target := range canary {
+		if !bm.IsBanned(target.BanKey()) {
+			return canary, true
+		}
+	}
+	requestid.Logger(r.Context()).Debugf("All canary backends banned for %s, using stable backends", c.endpoint)
+	return stable, false
+}
+
+// forced reports whether the request carries the canary header or cookie.
+func (c *Canary) forced(r *http.Request) bool {
+	if c.cfg.Header != "" {
+		if values := r.Header.Values(c.cfg.Header); len(values) > 0 {
+			if c.cfg.HeaderValue == "" {
+				return true
+			}
+			for _, v := range values {
+				if v == c.cfg.HeaderValue {
+					return true
+				}
+			}
+		}
+	}
+	if c.cfg.Cookie != "" {
+		if cookie, err := r.Cookie(c.cfg.Cookie); err == nil {
+			return c.cfg.CookieValue == "" || cookie.Value == c.cfg.CookieValue
+		}
+	}
+	return false
+}
+
+// sticky hashes the client key into one of 10000 buckets, so a client stays in its group while the
+// percentage is unchanged and only moves towards the canary as the percentage grows.
+func (c *Canary) sticky(r *http.Request, clientKey string, pct float64) bool {
+	if pct <= 0 {
+		return false
+	}
+	if c.cfg.StickyHeader != "" {
+		if v := r.Header.Get(c.cfg.StickyHeader); v != "" {
+			clientKey = v
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(clientKey))
+	return float64(h.Sum32()%10000) < pct*100
+}
+
+// Report records the outcome of request r sent to the given group and rolls the canary back
+// when its error rate in the current window exceeds the threshold.
+func (c *Canary) Report(r *http.Request, canary, failed bool) {
+	group, outcome := "stable", "ok"
+	if canary {
+		group = "canary"
+	}
+	if failed {
+		outcome = "error"
+	}
+	canaryRequests.Inc(c.endpoint, group, outcome)
+	if !canary || c.cfg.Rollback == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rolledBack {
+		return
+	}
+	now := time.Now()
+	if now.Sub(c.windowStart) > time.Duration(c.cfg.Rollback.Window)*time.Second {
+		c.windowStart, c.total, c.errors = now, 0, 0
+	}
+	c.total++
+	if failed {
+		c.errors++
+	}
+	rate := float64(c.errors) / float64(c.total)
+	if c.total >= c.cfg.Rollback.MinRequests && rate > c.cfg.Rollback.ErrorRate {
+		c.rolledBack = true
+		canaryPercentage.Set(0, c.endpoint)
+		requestid.Logger(r.Context()).Warnf("Canary for %s rolled back: error rate %.2f over %d requests exceeds %.2f",
+			c.endpoint, rate, c.total, c.cfg.Rollback.ErrorRate)
+	}
+}
@@ -0,0 +1,164 @@
+package strategy_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/abswn/revproxy-go/internal/ban"
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/strategy"
+)
+
+var canaryTargets = []config.URLConfig{
+	{URL: "http://stable-a.com", Weight: 1},
+	{URL: "http://stable-b.com", Weight: 1},
+	{URL: "http://canary.com", Weight: 1, Canary: true},
+}
+
+func TestCanary_StickyPercentage(t *testing.T) {
+	c, err := strategy.NewCanary("/sticky", config.CanaryConfig{Percentage: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bm := ban.NewManager()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	inCanary := 0
+	for i := range 10000 {
+		key := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		_, canary := c.Split(r, key, canaryTargets, bm)
+		// The same client always lands in the same group
+		_, again := c.Split(r, key, canaryTargets, bm)
+		if canary != again {
+			t.Fatalf("client %s is not sticky", key)
+		}
+		if canary {
+			inCanary++
+		}
+	}
+	if inCanary < 1700 || inCanary > 2300 {
+		t.Errorf("expected about 20%% of clients in the canary, got %d/10000", inCanary)
+	}
+}
+
+func TestCanary_SubsetsUseWeighted(t *testing.T) {
+	c, err := strategy.NewCanary("/subsets", config.CanaryConfig{Percentage: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bm := ban.NewManager()
+	subset, canary := c.Split(httptest.NewRequest(http.MethodGet, "/", nil), "client", canaryTargets, bm)
+	if !canary || len(subset) != 1 {
+		t.Fatalf("expected canary subset, got %v %v", canary, subset)
+	}
+	selected, ok := strategy.Weighted(subset, bm)
+	if !ok || selected.URL != "http://canary.com" {
+		t.Errorf("expected canary backend, got %s", selected.URL)
+	}
+}
+
+func TestCanary_ForcedByHeaderAndCookie(t *testing.T) {
+	c, err := strategy.NewCanary("/forced", config.CanaryConfig{Header: "X-Canary", HeaderValue: "yes", Cookie: "beta"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bm := ban.NewManager()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if _, canary := c.Split(r, "client", canaryTargets, bm); canary {
+		t.Error("expected stable group at 0% without header or cookie")
+	}
+	r.Header.Set("X-Canary", "no")
+	if _, canary := c.Split(r, "client", canaryTargets, bm); canary {
+		t.Error("expected header with other value to be ignored")
+	}
+	r.Header.Set("X-Canary", "yes")
+	if _, canary := c.Split(r, "client", canaryTargets, bm); !canary {
+		t.Error("expected header to force the canary")
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "beta", Value: "1"})
+	if _, canary := c.Split(r, "client", canaryTargets, bm); !canary {
+		t.Error("expected cookie to force the canary")
+	}
+}
+
+func TestCanary_FallsBackWhenCanaryBanned(t *testing.T) {
+	c, err := strategy.NewCanary("/fallback", config.CanaryConfig{Percentage: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bm := ban.NewManager()
+	bm.BanURL("http://canary.com", time.Minute)
+
+	subset, canary := c.Split(httptest.NewRequest(http.MethodGet, "/", nil), "client", canaryTargets, bm)
+	if canary || len(subset) != 2 {
+		t.Errorf("expected stable subset when canary is banned, got %v %v", canary, subset)
+	}
+}
+
+func TestCanary_Schedule(t *testing.T) {
+	c, err := strategy.NewCanary("/schedule", config.CanaryConfig{
+		Percentage: 5,
+		Schedule: []config.CanaryStep{
+			{After: 3600, Percentage: 100},
+			{After: 0, Percentage: 25},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pct := c.Percentage(); pct != 25 {
+		t.Errorf("expected the step due at startup to apply, got %v", pct)
+	}
+}
+
+func TestCanary_Rollback(t *testing.T) {
+	c, err := strategy.NewCanary("/rollback", config.CanaryConfig{
+		Percentage: 100,
+		Rollback:   &config.CanaryRollback{ErrorRate: 0.5, MinRequests: 4},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bm := ban.NewManager()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	// Stable errors never count towards the rollback
+	for range 10 {
+		c.Report(r, false, true)
+	}
+	c.Report(r, true, false)
+	c.Report(r, true, true)
+	c.Report(r, true, true)
+	if c.RolledBack() {
+		t.Fatal("expected no rollback below min_requests")
+	}
+	c.Report(r, true, true)
+	if !c.RolledBack() {
+		t.Fatal("expected rollback once the error rate exceeds the threshold")
+	}
+	if c.Percentage() != 0 {
+		t.Errorf("expected 0%% after rollback, got %v", c.Percentage())
+	}
+	if _, canary := c.Split(r, "client", canaryTargets, bm); canary {
+		t.Error("expected no canary traffic after rollback")
+	}
+}
+
+func TestCanary_InvalidConfig(t *testing.T) {
+	tests := map[string]config.CanaryConfig{
+		"percentage":      {Percentage: 101},
+		"step percentage": {Schedule: []config.CanaryStep{{After: 10, Percentage: -1}}},
+		"error rate":      {Rollback: &config.CanaryRollback{ErrorRate: 2}},
+	}
+	for name, cfg := range tests {
+		if _, err := strategy.NewCanary("/invalid", cfg); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
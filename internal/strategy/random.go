@@ -21,7 +21,7 @@ func Random(targets []config.URLConfig, bm *ban.BanManager) (config.URLConfig, b
 
 	// Filter out banned URLs and prepare a list with valid weights
 	for _, target := range targets {
-		if !bm.IsBanned(target.URL) {
+		if !bm.IsBanned(target.BanKey()) {
 			validTargets = append(validTargets, target)
 		}
 	}
@@ -13,7 +13,7 @@ func RoundRobin(targets []config.URLConfig, counter *uint32, bm *ban.BanManager)
 	for range maxAttempts {
 		index := atomic.AddUint32(counter, 1) - 1
 		target := targets[int(index)%len(targets)]
-		if !bm.IsBanned(target.URL) {
+		if !bm.IsBanned(target.BanKey()) {
 			return target, true
 		}
 	}
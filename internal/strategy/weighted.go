@@ -33,7 +33,7 @@ func Weighted(targets []config.URLConfig, bm *ban.BanManager) (config.URLConfig,
 	// Filter out banned URLs and prepare a list with valid weights
 	for _, target := range targets {
 		// 0 or negative weight is skipped
-		if target.Weight <= 0 || bm.IsBanned(target.URL) {
+		if target.Weight <= 0 || bm.IsBanned(target.BanKey()) {
 			continue
 		}
 		validTargets = append(validTargets, target)
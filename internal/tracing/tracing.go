@@ -0,0 +1,165 @@
+// Exports OpenTelemetry traces over OTLP and opens the server span of every request.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/forward"
+	"github.com/abswn/revproxy-go/internal/requestid"
+)
+
+// Instrumentation names the tracer used by the proxy's own spans.
+const Instrumentation = "github.com/abswn/revproxy-go"
+
+// Tracer returns the proxy's tracer from the global provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(Instrumentation)
+}
+
+// Setup creates the OTLP exporter described by cfg and installs a provider sampling according to cfg.
+// The returned function flushes and stops the provider.
+func Setup(ctx context.Context, cfg config.TracingConfig) (func(context.Context) error, error) {
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch cfg.Protocol {
+	case "http":
+		opts := []otlptracehttp.Option{otlptracehttp.WithHeaders(cfg.Headers)}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case "", "grpc":
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithHeaders(cfg.Headers)}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unsupported tracing protocol '%s'", cfg.Protocol)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+	tp := NewProvider(cfg, sdktrace.WithBatcher(exporter))
+	Install(tp)
+	return tp.Shutdown, nil
+}
+
+// NewProvider returns a provider with the service name and sampler of cfg. New traces are sampled
+// at cfg.SampleRatio, requests whose parent was sampled are always recorded.
+func NewProvider(cfg config.TracingConfig, opts ...sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	ratio := 1.0
+	if cfg.SampleRatio != nil {
+		ratio = *cfg.SampleRatio
+	}
+	name := cfg.ServiceName
+	if name == "" {
+		name = "revproxy-go"
+	}
+	opts = append([]sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", name))),
+	}, opts...)
+	return sdktrace.NewTracerProvider(opts...)
+}
+
+// Install makes tp the global provider and propagates W3C trace context and baggage.
+func Install(tp trace.TracerProvider) {
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// Middleware opens a server span for every request, continuing the caller's trace if the request
+// carries a traceparent header. The span is named after the endpoint once one has served the request.
+func Middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, res := forward.WithResult(ctx)
+		clientAddr, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			clientAddr = r.RemoteAddr
+		}
+		ctx, span := Tracer().Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("server.address", r.Host),
+				attribute.String("client.address", clientAddr),
+				attribute.String("user_agent.original", r.UserAgent()),
+			))
+		defer span.End()
+		if id := requestid.FromContext(ctx); id != "" {
+			span.SetAttributes(attribute.String("revproxy.request_id", id))
+		}
+
+		rw := &statusWriter{ResponseWriter: w}
+		next(rw, r.WithContext(ctx))
+
+		if rw.status == 0 {
+			rw.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", rw.status))
+		if res.Endpoint != "" {
+			span.SetName(r.Method + " " + res.Endpoint)
+			span.SetAttributes(attribute.String("revproxy.endpoint", res.Endpoint))
+		}
+		if rw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rw.status))
+		}
+	}
+}
+
+// statusWriter captures the status code sent to the client.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush lets streamed responses reach the client through the wrapper.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,205 @@
+package tracing
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/abswn/revproxy-go/internal/ban"
+	"github.com/abswn/revproxy-go/internal/config"
+	"github.com/abswn/revproxy-go/internal/forward"
+)
+
+// setup installs a provider recording synchronously into an in-memory exporter.
+func setup(t *testing.T, cfg config.TracingConfig) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := NewProvider(cfg, sdktrace.WithSyncer(exporter))
+	Install(tp)
+	t.Cleanup(func() { tp.Shutdown(t.Context()) })
+	return exporter
+}
+
+// proxyHandler serves every request as endpoint /api through ForwardRequest.
+func proxyHandler(target config.URLConfig, rules []config.BanRuleClean) http.HandlerFunc {
+	bm := ban.NewManager()
+	return Middleware(func(w http.ResponseWriter, r *http.Request) {
+		_, res := forward.WithResult(r.Context())
+		res.Endpoint = "/api"
+		forward.ForwardRequest(w, r, target, rules, bm)
+	})
+}
+
+// byName indexes the ended spans by name.
+func byName(spans tracetest.SpanStubs) map[string]tracetest.SpanStub {
+	m := make(map[string]tracetest.SpanStub)
+	for _, s := range spans {
+		m[s.Name] = s
+	}
+	return m
+}
+
+func attr(s tracetest.SpanStub, key string) attribute.Value {
+	for _, kv := range s.Attributes {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestMiddleware_SpansAndPropagation(t *testing.T) {
+	exporter := setup(t, config.TracingConfig{})
+	var traceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer backend.Close()
+
+	rules := []config.BanRuleClean{{Match: "429", Duration: 5}}
+	proxyHandler(config.URLConfig{URL: backend.URL}, rules)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api", nil))
+
+	spans := byName(exporter.GetSpans())
+	server, ok := spans["GET /api"]
+	if !ok {
+		t.Fatalf("expected server span named after the endpoint, got %v", spans)
+	}
+	if attr(server, "http.response.status_code").AsInt64() != http.StatusTooManyRequests {
+		t.Errorf("expected status attribute on server span, got %v", server.Attributes)
+	}
+	upstream, banSpan := spans["upstream GET"], spans["ban.evaluate"]
+	for name, s := range map[string]tracetest.SpanStub{"upstream": upstream, "ban": banSpan} {
+		if s.Parent.SpanID() != server.SpanContext.SpanID() {
+			t.Errorf("expected %s span to be a child of the server span", name)
+		}
+	}
+	if !attr(banSpan, "revproxy.banned").AsBool() {
+		t.Error("expected ban span to record the ban")
+	}
+	hasFirstByte := false
+	for _, e := range upstream.Events {
+		hasFirstByte = hasFirstByte || e.Name == "response.first_byte"
+	}
+	if !hasFirstByte {
+		t.Errorf("expected connection events on the upstream span, got %v", upstream.Events)
+	}
+	want := "00-" + server.SpanContext.TraceID().String() + "-" + upstream.SpanContext.SpanID().String() + "-01"
+	if traceparent != want {
+		t.Errorf("expected traceparent %s upstream, got %s", want, traceparent)
+	}
+}
+
+func TestMiddleware_Sampling(t *testing.T) {
+	ratio := 0.0
+	exporter := setup(t, config.TracingConfig{SampleRatio: &ratio})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	handler := proxyHandler(config.URLConfig{URL: backend.URL}, nil)
+
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api", nil))
+	if n := len(exporter.GetSpans()); n != 0 {
+		t.Fatalf("expected no spans at sample ratio 0, got %d", n)
+	}
+
+	// A sampled caller is always continued
+	r := httptest.NewRequest(http.MethodGet, "/api", nil)
+	r.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler(httptest.NewRecorder(), r)
+	server, ok := byName(exporter.GetSpans())["GET /api"]
+	if !ok {
+		t.Fatal("expected server span for sampled parent")
+	}
+	if server.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || server.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("expected incoming trace to be continued, got trace %s parent %s", server.SpanContext.TraceID(), server.Parent.SpanID())
+	}
+}
+
+func TestForward_SOCKS5DialSpan(t *testing.T) {
+	exporter := setup(t, config.TracingConfig{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	target := config.URLConfig{URL: backend.URL, Socks5: startSOCKS5(t)}
+	rw := httptest.NewRecorder()
+	proxyHandler(target, nil)(rw, httptest.NewRequest(http.MethodGet, "/api", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected 200 through SOCKS5, got %d", rw.Code)
+	}
+
+	spans := byName(exporter.GetSpans())
+	dial, ok := spans["socks5.dial"]
+	if !ok {
+		t.Fatalf("expected socks5.dial span, got %v", spans)
+	}
+	if dial.Parent.SpanID() != spans["upstream GET"].SpanContext.SpanID() {
+		t.Error("expected the dial span to be a child of the upstream span")
+	}
+}
+
+// startSOCKS5 serves a minimal no-auth SOCKS5 CONNECT proxy and returns its address.
+func startSOCKS5(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveSOCKS5(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 262)
+	// Greeting: version, method count, methods
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 0})
+	// Request: version, CONNECT, reserved, address type
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		io.ReadFull(conn, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 3:
+		io.ReadFull(conn, buf[:1])
+		n := int(buf[0])
+		io.ReadFull(conn, buf[:n])
+		host = string(buf[:n])
+	default:
+		return
+	}
+	io.ReadFull(conn, buf[:2])
+	port := binary.BigEndian.Uint16(buf[:2])
+	upstream, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
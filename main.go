@@ -1,21 +1,45 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
+	"slices"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/acme"
 	"gopkg.in/natefinch/lumberjack.v2"
 
+	"github.com/abswn/revproxy-go/internal/accesslog"
+	"github.com/abswn/revproxy-go/internal/acl"
+	"github.com/abswn/revproxy-go/internal/auth"
 	"github.com/abswn/revproxy-go/internal/ban"
+	"github.com/abswn/revproxy-go/internal/cache"
+	"github.com/abswn/revproxy-go/internal/cert"
+	"github.com/abswn/revproxy-go/internal/coalesce"
+	"github.com/abswn/revproxy-go/internal/compression"
 	"github.com/abswn/revproxy-go/internal/config"
 	"github.com/abswn/revproxy-go/internal/forward"
+	"github.com/abswn/revproxy-go/internal/grpcstatus"
+	"github.com/abswn/revproxy-go/internal/listener"
+	"github.com/abswn/revproxy-go/internal/metrics"
+	"github.com/abswn/revproxy-go/internal/mirror"
+	"github.com/abswn/revproxy-go/internal/mtls"
+	"github.com/abswn/revproxy-go/internal/proxypool"
+	"github.com/abswn/revproxy-go/internal/requestid"
+	"github.com/abswn/revproxy-go/internal/resolver"
+	"github.com/abswn/revproxy-go/internal/router"
 	"github.com/abswn/revproxy-go/internal/strategy"
+	"github.com/abswn/revproxy-go/internal/tracing"
 )
 
 func main() {
@@ -63,79 +87,503 @@ func main() {
 	}
 	log.Infof("Loaded %d enabled endpoint config(s)", len(endpointsMap))
 
+	// Load the proxy pools backend URLs may leave through, each with its own exit bans
+	poolConfigs, err := config.LoadProxyPools("configs/proxies.yaml")
+	if err != nil {
+		log.Fatalf("Failed to load proxy pools: %v", err)
+	}
+	if err := config.CheckProxyPools(endpointsMap, poolConfigs); err != nil {
+		log.Fatalf("Failed to load endpoint configs: %v", err)
+	}
+	proxyPools := make(map[string]*proxypool.Pool, len(poolConfigs))
+	for name, poolCfg := range poolConfigs {
+		proxyPools[name] = proxypool.New(name, poolCfg)
+	}
+
 	// Initialize the BanManager - temporarily bans backend URLs that hit RPS limit, etc.
 	banManager := ban.NewManager()
 	banManager.StartEvictionLoop(5 * time.Second) // Check if it is time to re-add the banned URLs
 
+	// Resolve the real client IP from X-Forwarded-For when behind trusted load balancers
+	trustedProxies, err := acl.NewTrustedProxies(mainCfg.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Failed to load trusted proxies: %v", err)
+	}
+
 	// Initialize round-robin counters per client endpoint
 	rrCounters := make(map[string]*uint32)
 
-	// Create the request multiplexer - matches incoming requests to handlers
-	mux := http.NewServeMux()
-
-	for path, strategyCfg := range endpointsMap {
+	// Endpoint handlers are registered on the router of every listener serving them
+	var routes []route
+	for key, strategyCfg := range endpointsMap {
 		log.Debugf("Loaded raw endpoint config keys: %v", reflect.ValueOf(endpointsMap).MapKeys())
 
-		targets := strategyCfg.URLs
 		// Initialize counter for round-robin
 		if strategyCfg.Strategy == "round-robin" {
-			rrCounters[path] = new(uint32)
+			rrCounters[key] = new(uint32)
+		}
+		// Split traffic between canary and stable URLs if configured
+		var canary *strategy.Canary
+		if strategyCfg.Canary != nil {
+			canary, err = strategy.NewCanary(key, *strategyCfg.Canary)
+			if err != nil {
+				log.Fatalf("Failed to configure canary for %s: %v", key, err)
+			}
 		}
-		// Register HTTP handler for each path
-		mux.HandleFunc(path, recoveryMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		// Expand URLs discovered through DNS into their targets
+		discovery := resolver.NewDiscovery(key, strategyCfg.URLs)
+		// Register HTTP handler for each endpoint
+		handler := func(w http.ResponseWriter, r *http.Request) {
 			var (
 				target config.URLConfig
 				ok     bool
 			)
-			log.Debugf("Registered handler for path: %s", path)
+			logger := requestid.Logger(r.Context())
+			logger.Debugf("Registered handler for endpoint: %s", key)
+			_, span := tracing.Tracer().Start(r.Context(), "strategy.select", trace.WithAttributes(
+				attribute.String("revproxy.endpoint", key),
+				attribute.String("revproxy.strategy", strategyCfg.Strategy),
+			))
+			targets := discovery.Targets()
+			inCanary := false
+			if canary != nil {
+				targets, inCanary = canary.Split(r, trustedProxies.ClientIP(r).String(), targets, banManager)
+			}
 			// Determine strategy
 			switch strategyCfg.Strategy {
 			case "round-robin":
-				target, ok = strategy.RoundRobin(targets, rrCounters[path], banManager)
+				target, ok = strategy.RoundRobin(targets, rrCounters[key], banManager)
 			case "weighted":
 				target, ok = strategy.Weighted(targets, banManager)
 			case "random":
 				target, ok = strategy.Random(targets, banManager)
 			default:
 				// Unknown strategy, respond with 503
-				log.Warnf("Unsupported strategy '%s' for path %s", strategyCfg.Strategy, path)
+				logger.Warnf("Unsupported strategy '%s' for endpoint %s", strategyCfg.Strategy, key)
+				span.SetStatus(codes.Error, "unsupported strategy")
+				span.End()
 				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 				return
 			}
+			span.SetAttributes(attribute.Bool("revproxy.canary", inCanary), attribute.Bool("revproxy.backend_available", ok))
+			span.End()
 			// If no usable backends are available
 			if !ok {
-				log.Warnf("%s - All backends temporarily banned for %s", strategyCfg.Strategy, path)
+				logger.Warnf("%s - All backends temporarily banned for %s", strategyCfg.Strategy, key)
+				if strategyCfg.Protocol == "grpc" {
+					grpcstatus.WriteError(w, grpcstatus.Unavailable, "all backends temporarily unavailable")
+					return
+				}
 				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 				return
 			}
 			// Forward request to selected backend
-			forward.ForwardRequest(w, r, target, strategyCfg.BanRules, banManager)
-		}))
-	}
-
-	// Start HTTPS server
-	log.Infof("Starting server on port :%d", mainCfg.Port)
-	fmt.Printf("Starting revproxy server on port %d...\n", mainCfg.Port)
-	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
-	server := &http.Server{
-		Addr:      fmt.Sprintf(":%d", mainCfg.Port),
-		TLSConfig: tlsConfig,
-		Handler:   mux,
-	}
-	certExists := func() bool { _, err := os.Stat(mainCfg.HTTPSCertPath); return err == nil }()
-	keyExists := func() bool { _, err := os.Stat(mainCfg.HTTPSKeyPath); return err == nil }()
-	if certExists && keyExists {
-		log.Infof("TLS certificates found. Starting HTTPS server")
-		if err := server.ListenAndServeTLS(mainCfg.HTTPSCertPath, mainCfg.HTTPSKeyPath); err != nil {
-			log.Fatalf("HTTPS server failed: %v", err)
+			ctx, res := forward.WithResult(r.Context())
+			if target.ProxyPool != "" {
+				ctx = forward.WithProxyPool(ctx, proxyPools[target.ProxyPool], trustedProxies.ClientIP(r).String())
+			}
+			err := forward.ForwardRequest(w, r.WithContext(ctx), target, strategyCfg.BanRules, banManager)
+			if canary != nil {
+				canary.Report(r, inCanary, err != nil || res.Banned)
+			}
+		}
+		// Copy a share of the authenticated traffic to the mirror pool
+		if strategyCfg.Mirror != nil {
+			m, err := mirror.New(key, *strategyCfg.Mirror)
+			if err != nil {
+				log.Fatalf("Failed to configure mirror for %s: %v", key, err)
+			}
+			handler = m.Middleware(handler)
+		}
+		// Share one upstream call between identical concurrent requests
+		if strategyCfg.Coalesce != nil {
+			g, err := coalesce.New(key, *strategyCfg.Coalesce)
+			if err != nil {
+				log.Fatalf("Failed to configure coalescing for %s: %v", key, err)
+			}
+			handler = g.Middleware(handler)
+		}
+		// Answer repeatable requests from the cache before a backend is selected
+		if strategyCfg.Cache != nil {
+			c, err := cache.New(key, *strategyCfg.Cache)
+			if err != nil {
+				log.Fatalf("Failed to configure cache for %s: %v", key, err)
+			}
+			handler = c.Middleware(handler)
+		}
+		// Compress responses for clients that accept it, cache hits included
+		if strategyCfg.Compression != nil {
+			c, err := compression.New(*strategyCfg.Compression)
+			if err != nil {
+				log.Fatalf("Failed to configure compression for %s: %v", key, err)
+			}
+			handler = c.Middleware(handler)
+		}
+		// Reject unauthenticated clients before a backend is selected
+		if strategyCfg.Auth != nil {
+			authenticator, err := auth.New(*strategyCfg.Auth)
+			if err != nil {
+				log.Fatalf("Failed to configure auth for %s: %v", key, err)
+			}
+			handler = auth.Middleware(authenticator, handler)
+		}
+		// Reject clients without an acceptable certificate, by default from the listener's CA
+		if strategyCfg.ClientAuth != nil {
+			clientAuth := *strategyCfg.ClientAuth
+			if clientAuth.CAFile == "" {
+				clientAuth.CAFile = mainCfg.TLS.ClientAuth.CAFile
+			}
+			verifier, err := mtls.New(clientAuth)
+			if err != nil {
+				log.Fatalf("Failed to configure client_auth for %s: %v", key, err)
+			}
+			handler = verifier.Middleware(handler)
+		}
+		// Reject clients outside the endpoint's allow/deny lists
+		if strategyCfg.AccessControl != nil {
+			handler = acl.Middleware(newAccessList(*strategyCfg.AccessControl), trustedProxies, handler)
+		}
+		// Bound request and response sizes and upstream timeouts, the endpoint's limits taking precedence
+		handler = forward.Limit(mainCfg.Limits.Override(strategyCfg.Limits), handler)
+		routes = append(routes, route{key: key, host: strategyCfg.Host, route: strategyCfg.Route, handler: recoveryMiddleware(endpointMiddleware(key, handler))})
+	}
+
+	metricsPath := mainCfg.Metrics.Path
+	if metricsPath == "" {
+		metricsPath = "/metrics"
+	}
+	var globalACL *acl.List
+	if mainCfg.AccessControl != nil {
+		globalACL = newAccessList(*mainCfg.AccessControl)
+	}
+	var accessLog *accesslog.Logger
+	if mainCfg.AccessLog.Enabled {
+		accessLog, err = accesslog.New(mainCfg.AccessLog, trustedProxies)
+		if err != nil {
+			log.Fatalf("Failed to set up access log: %v", err)
+		}
+	}
+	if mainCfg.Tracing.Enabled {
+		shutdown, err := tracing.Setup(context.Background(), mainCfg.Tracing)
+		if err != nil {
+			log.Fatalf("Failed to set up tracing: %v", err)
+		}
+		defer shutdown(context.Background())
+	}
+
+	listeners := mainCfg.Listeners
+	tlsConfig, acmeManager, err := serverTLSConfig(mainCfg, endpointsMap, redirectsHTTPS(listeners))
+	if err != nil {
+		log.Fatalf("Failed to set up TLS: %v", err)
+	}
+	if len(listeners) == 0 {
+		// A single listener on port, serving HTTPS when a certificate is available
+		listeners = []config.ListenerConfig{{Address: fmt.Sprintf(":%d", mainCfg.Port), TLS: tlsConfig != nil}}
+	}
+	if usesGRPC(endpointsMap) && !slices.ContainsFunc(listeners, func(l config.ListenerConfig) bool { return l.TLS || l.H2C }) {
+		log.Warnf("gRPC endpoints are configured but no listener accepts HTTP/2, enable TLS or h2c on one")
+	}
+	errs := make(chan error, 2*len(listeners))
+	for _, l := range listeners {
+		name := l.Name
+		if name == "" {
+			name = l.Address
+		}
+		if l.TLS && tlsConfig == nil {
+			log.Fatalf("Listener %s needs TLS but no certificate is available (tls.mode: %s)", name, mainCfg.TLS.Mode)
+		}
+		clientAuthCfg := mainCfg.TLS.ClientAuth
+		if l.ClientAuth != nil {
+			clientAuthCfg = *l.ClientAuth
+			if clientAuthCfg.CAFile == "" {
+				clientAuthCfg.CAFile = mainCfg.TLS.ClientAuth.CAFile
+			}
+		}
+		listenerAuth, err := mtls.New(clientAuthCfg)
+		if err != nil {
+			log.Fatalf("Failed to configure client_auth for listener %s: %v", name, err)
+		}
+
+		var handler http.HandlerFunc
+		if l.RedirectHTTPS {
+			handler = listener.RedirectHTTPS(l.RedirectPort)
+			// ACME HTTP-01 challenges are answered here instead of on a listener of their own
+			if acmeManager != nil {
+				handler = acmeManager.HTTPHandler(handler).ServeHTTP
+			}
+		} else {
+			// Match incoming requests to the endpoints this listener serves by host, path, method, headers and query
+			rt := router.New()
+			for _, r := range routes {
+				if !listener.Serves(l.Endpoints, r.key) {
+					continue
+				}
+				if err := rt.Handle(r.host, r.route, r.handler); err != nil {
+					log.Fatalf("Failed to register route for %s: %v", r.key, err)
+				}
+			}
+			handler = rt.ServeHTTP
+			if mainCfg.Metrics.Enabled && listener.Serves(l.Endpoints, metricsPath) {
+				metricsHandler := metrics.Handler()
+				routes := handler
+				handler = func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path == metricsPath {
+						metricsHandler.ServeHTTP(w, r)
+						return
+					}
+					routes(w, r)
+				}
+			}
+		}
+		// Global allow/deny lists are checked before any endpoint handler
+		if globalACL != nil {
+			handler = acl.Middleware(globalACL, trustedProxies, handler)
+		}
+		// Record the identity of verified client certificates and forward it upstream if configured
+		handler = listenerAuth.Middleware(handler)
+		// Record every request, rejected ones included, in the access log
+		if accessLog != nil {
+			handler = accessLog.Middleware(handler)
+		}
+		// Open a server span per request and export traces over OTLP
+		if mainCfg.Tracing.Enabled {
+			handler = tracing.Middleware(handler)
+		}
+		// Tag the request, its upstream call, the response and every log line with a request ID
+		handler = requestid.Middleware(mainCfg.RequestID, handler)
+
+		var listenerTLS *tls.Config
+		if l.TLS {
+			listenerTLS = tlsConfig.Clone()
+			configureClientAuth(listenerTLS, listenerAuth, endpointsMap)
+		} else if listenerAuth.Enabled() || requestsClientCerts(endpointsMap) {
+			log.Warnf("Client certificates are configured but listener %s has no TLS, requests needing one will be rejected", name)
+		}
+		ln, err := listener.Listen(l.Address)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", l.Address, err)
+		}
+		server := newServer(handler, mainCfg.Limits)
+		server.TLSConfig = listenerTLS
+		// Internal clients may speak HTTP/2 without TLS, using prior knowledge
+		if l.H2C {
+			server.Protocols = new(http.Protocols)
+			server.Protocols.SetHTTP1(true)
+			server.Protocols.SetUnencryptedHTTP2(true)
+		}
+		// Clients on lossy networks may switch to HTTP/3 on the same port over UDP, served by the same handler
+		if l.HTTP3 {
+			h3, err := listener.ListenHTTP3(l.Address, server)
+			if err != nil {
+				log.Fatalf("Failed to listen for HTTP/3 on %s: %v", l.Address, err)
+			}
+			server.Handler = listener.AltSvc(h3.Port(), server.Handler)
+			go func() {
+				log.Infof("Serving HTTP/3 on %s", name)
+				errs <- fmt.Errorf("HTTP/3 server on %s failed: %v", name, h3.Serve())
+			}()
+		}
+		go func() {
+			if listenerTLS != nil {
+				log.Infof("Serving HTTPS on %s", name)
+				errs <- fmt.Errorf("HTTPS server on %s failed: %v", name, server.ServeTLS(ln, "", ""))
+			} else {
+				log.Infof("Serving HTTP on %s", name)
+				errs <- fmt.Errorf("HTTP server on %s failed: %v", name, server.Serve(ln))
+			}
+		}()
+	}
+	fmt.Printf("revproxy server started with %d listener(s)\n", len(listeners))
+	log.Fatal(<-errs)
+}
+
+// route is an endpoint handler waiting to be registered on the routers of the listeners serving it.
+type route struct {
+	key     string
+	host    string
+	route   config.RouteConfig
+	handler http.HandlerFunc
+}
+
+// newServer creates a server for one listener. Its timeouts guard against clients holding
+// connections open by sending or reading slowly.
+func newServer(handler http.HandlerFunc, limits config.LimitsConfig) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		MaxHeaderBytes:    limits.MaxHeaderBytes,
+		ReadHeaderTimeout: config.Seconds(limits.ReadHeaderTimeout, 10*time.Second),
+		ReadTimeout:       config.Seconds(limits.ReadTimeout, 0),
+		WriteTimeout:      config.Seconds(limits.WriteTimeout, 0),
+		IdleTimeout:       config.Seconds(limits.IdleTimeout, 120*time.Second),
+	}
+}
+
+// usesGRPC reports whether an endpoint serves gRPC.
+func usesGRPC(endpoints map[string]config.StrategyConfigClean) bool {
+	for _, e := range endpoints {
+		if e.Protocol == "grpc" {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectsHTTPS reports whether a listener redirects to HTTPS.
+func redirectsHTTPS(listeners []config.ListenerConfig) bool {
+	for _, l := range listeners {
+		if l.RedirectHTTPS {
+			return true
+		}
+	}
+	return false
+}
+
+// serverTLSConfig returns the TLS config of the HTTPS listeners for the configured tls.mode, or nil to
+// serve plain HTTP. Certificates are chosen by SNI and reloaded when their files change. In acme mode
+// the manager is returned too; redirecting listeners answer its HTTP-01 challenges if redirects is set.
+func serverTLSConfig(cfg *config.MainConfig, endpoints map[string]config.StrategyConfigClean, redirects bool) (*tls.Config, *cert.ACME, error) {
+	certPath, keyPath := cfg.HTTPSCertPath, cfg.HTTPSKeyPath
+	var hosts []string
+	for _, e := range endpoints {
+		if e.Host != "" && !slices.Contains(hosts, e.Host) {
+			hosts = append(hosts, e.Host)
+		}
+	}
+	var pairs []config.CertificateConfig
+	switch cfg.TLS.Mode {
+	case "off":
+		log.Infof("TLS disabled (tls.mode: off). Serving HTTP.")
+		return nil, nil, nil
+	case "self-signed", "acme":
+		// Valid for localhost, the endpoint hosts and any extra configured names. With ACME it is
+		// served while issuance fails.
+		sans := append(append([]string{"localhost", "127.0.0.1", "::1"}, cfg.TLS.Hosts...), hosts...)
+		var err error
+		if certPath, keyPath, err = cert.EnsureCert(certPath, keyPath, sans); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate self-signed certificate: %v", err)
+		}
+		pairs = append(pairs, config.CertificateConfig{CertFile: certPath, KeyFile: keyPath})
+	default:
+		certExists := func() bool { _, err := os.Stat(certPath); return certPath != "" && err == nil }()
+		keyExists := func() bool { _, err := os.Stat(keyPath); return keyPath != "" && err == nil }()
+		if certExists && keyExists {
+			pairs = append(pairs, config.CertificateConfig{CertFile: certPath, KeyFile: keyPath})
+		}
+	}
+	expiryWarning := cfg.TLS.ExpiryWarning
+	if expiryWarning == 0 {
+		expiryWarning = 30
+	}
+	store, err := cert.NewStore(append(pairs, cfg.TLS.Certificates...), cfg.TLS.CertificatesDir, time.Duration(expiryWarning)*24*time.Hour)
+	if err != nil {
+		return nil, nil, err
+	}
+	if store.Len() == 0 {
+		if cfg.TLS.Mode == "required" {
+			return nil, nil, fmt.Errorf("no certificate found (tls.mode: required)")
 		}
-	} else {
 		log.Warnf("TLS certificates not found. Falling back to HTTP.")
-		server.TLSConfig = nil
-		if err := server.ListenAndServe(); err != nil {
-			log.Fatalf("HTTP server failed: %v", err)
+		return nil, nil, nil
+	}
+	for _, host := range hosts {
+		if !store.Covers(host) {
+			log.Warnf("No TLS certificate covers host %s, clients will get the default certificate", host)
 		}
 	}
+	reloadInterval := cfg.TLS.ReloadInterval
+	if reloadInterval == 0 {
+		reloadInterval = 60
+	}
+	store.StartReloadLoop(time.Duration(reloadInterval) * time.Second)
+	if cfg.TLS.Mode == "acme" {
+		return acmeTLSConfig(cfg.TLS.ACME, hosts, store, redirects)
+	}
+	log.Infof("Serving %d TLS certificate(s)", store.Len())
+	return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: store.GetCertificate}, nil, nil
+}
+
+// acmeTLSConfig obtains certificates for the ACME hosts, by default the exact endpoint hosts, serving
+// fallback for other names. HTTP-01 challenges are answered on a separate plain HTTP listener, unless
+// http_addr is empty and redirecting listeners answer them.
+func acmeTLSConfig(cfg config.ACMEConfig, endpointHosts []string, fallback *cert.Store, redirects bool) (*tls.Config, *cert.ACME, error) {
+	hosts := cfg.Hosts
+	if len(hosts) == 0 {
+		for _, h := range endpointHosts {
+			if strings.HasPrefix(h, "*.") {
+				log.Warnf("No ACME certificate for wildcard host %s, it needs a DNS challenge", h)
+				continue
+			}
+			hosts = append(hosts, h)
+		}
+	}
+	manager, err := cert.NewACME(cfg, hosts, fallback)
+	if err != nil {
+		return nil, nil, err
+	}
+	httpAddr := cfg.HTTPAddr
+	if httpAddr == "" && !redirects {
+		httpAddr = ":80"
+	}
+	if httpAddr != "" {
+		go func() {
+			challengeServer := &http.Server{
+				Addr:              httpAddr,
+				Handler:           manager.HTTPHandler(nil),
+				ReadHeaderTimeout: 10 * time.Second,
+			}
+			if err := challengeServer.ListenAndServe(); err != nil {
+				log.Errorf("ACME HTTP-01 listener on %s failed: %v", httpAddr, err)
+			}
+		}()
+	}
+	// Request the certificates once the listeners answering the challenges are up
+	time.AfterFunc(time.Second, manager.Prefetch)
+	log.Infof("Obtaining ACME certificates for %s", strings.Join(hosts, ", "))
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: manager.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+	}, manager, nil
+}
+
+// configureClientAuth verifies client certificates in the handshake as tls.client_auth requires.
+// If only endpoints check them, the listener still asks clients for one without verifying it.
+func configureClientAuth(c *tls.Config, listener *mtls.Verifier, endpoints map[string]config.StrategyConfigClean) {
+	listener.Configure(c)
+	if c.ClientAuth == tls.NoClientCert && requestsClientCerts(endpoints) {
+		c.ClientAuth = tls.RequestClientCert
+	}
+}
+
+// requestsClientCerts reports whether an endpoint verifies client certificates.
+func requestsClientCerts(endpoints map[string]config.StrategyConfigClean) bool {
+	for _, e := range endpoints {
+		if e.ClientAuth != nil && (e.ClientAuth.Verify == "optional" || e.ClientAuth.Verify == "required") {
+			return true
+		}
+	}
+	return false
+}
+
+// newAccessList builds an allow/deny list and starts reloading its files if configured.
+func newAccessList(cfg config.AccessControlConfig) *acl.List {
+	list, err := acl.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load access control list: %v", err)
+	}
+	if cfg.ReloadInterval > 0 {
+		list.StartReloadLoop(time.Duration(cfg.ReloadInterval) * time.Second)
+	}
+	return list
+}
+
+// endpointMiddleware records the endpoint serving the request for the access log.
+func endpointMiddleware(key string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, res := forward.WithResult(r.Context())
+		res.Endpoint = key
+		fn(w, r.WithContext(ctx))
+	}
 }
 
 // recoveryMiddleware recovers from panics in HTTP handlers and responds with 500 Internal Server Error.
@@ -143,7 +591,7 @@ func recoveryMiddleware(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if rec := recover(); rec != nil {
-				log.Errorf("Panic recovered in handler for %s: %v", r.URL.Path, rec)
+				requestid.Logger(r.Context()).Errorf("Panic recovered in handler for %s: %v", r.URL.Path, rec)
 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			}
 		}()